@@ -9,17 +9,28 @@ import (
 )
 
 type Config struct {
-	Host             string
-	Port             int
-	Domain           string
-	LogLevel         string
-	ReadTimeout      time.Duration
-	WriteTimeout     time.Duration
-	RequestTimeout   time.Duration
-	Mongo            MongoConfig
-	Kafka            KafkaConfig
-	Consumers        struct{}
+	Host           string
+	Port           int
+	Domain         string
+	LogLevel       string
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	RequestTimeout time.Duration
+	AdminToken     string
+	Mongo          MongoConfig
+	Kafka          KafkaConfig
+	InboundSmtp    InboundSmtpConfig
+	Email          EmailConfig
+	Consumers      struct{}
+	// Mailer selects the emailsvc.Mailer, either "mailersend" (default), "smtp"
+	// or "capture" to keep outbound emails in a local inbox for development.
+	// It's ignored if MailerRouter has routes.
+	Mailer           string
+	MailerRouter     MailerRouterConfig
+	MailCapture      MailCaptureConfig
 	MailerSendApiKey string
+	Smtp             SmtpConfig
+	BlobStore        BlobStoreConfig
 	Keycloak         keycloak.Config
 }
 
@@ -42,13 +53,156 @@ type MongoConfig struct {
 }
 
 type KafkaConfig struct {
-	Brokers        string
-	User           string
-	Password       string
+	// InMemory replaces the Kafka cluster with an in-process broker for tests and local development.
+	// Records are not shared between processes.
+	InMemory bool
+	Brokers  string
+	// SecurityProtocol is one of PLAINTEXT, SSL, SASL_PLAINTEXT or SASL_SSL. Defaults to SASL_SSL.
+	SecurityProtocol string
+	// SaslMechanism is one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512. Defaults to SCRAM-SHA-512.
+	SaslMechanism string
+	User          string
+	Password      string
+	// CAFile is a PEM bundle verifying brokers instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and key for mTLS.
+	CertFile       string
+	KeyFile        string
 	MaxPollRecords int
-	Topics         struct {
-		InboundEmails string
-		ChatMessages  string
+	// Workers is the number of records handled concurrently by a consumer client,
+	// ordered per key. Partitions are handled serially if not greater than 1.
+	Workers int
+	Topics  struct {
+		InboundEmails      string
+		InboundEmailsRetry string
+		InboundEmailsDLQ   string
+		ChatMessages       string
 	}
+	Retry    RetryConfig
 	LogLevel int
 }
+
+// RetryConfig configures the retry topic of a consumer.
+// MaxRetries defaults to 5, a negative value dead-letters without retrying.
+type RetryConfig struct {
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// InboundSmtpConfig configures the native inbound SMTP server.
+// Mode is either "kafka" to publish accepted emails to Topics.InboundEmails
+// or "forward" to call ForwardInboundEmail in-process.
+type InboundSmtpConfig struct {
+	Addr            string
+	Mode            string
+	MaxMessageBytes int64
+	MaxRecipients   int
+}
+
+type EmailConfig struct {
+	// SubjectFallback resolves inbound emails without known threading headers
+	// by normalized subject and sender participant.
+	SubjectFallback bool
+	// ReplySecret signs per-thread reply+<token>@Domain addresses set as Reply-To.
+	// Reply addresses are disabled if empty.
+	ReplySecret string
+	// ReplyTokenTTL is how long reply addresses are honored. Zero never expires.
+	ReplyTokenTTL time.Duration
+	// InboundLease is how long a consumer owns an inbound email it's forwarding
+	// before a redelivery may take it over. Defaults to 1m.
+	InboundLease time.Duration
+	Outbox       OutboxConfig
+	LinkOut      LinkOutConfig
+	// ImageProxy is the URL prefix remote images of inbound HTML are loaded through,
+	// followed by their escaped URL and "&sig=" with the base64url HMAC-SHA256 of the
+	// URL by ImageProxySecret, e.g. "https://proxy.opendoor.chat/?url=". The proxy must
+	// verify the signature. Remote images are removed if either is empty.
+	ImageProxy       string
+	ImageProxySecret string
+}
+
+// LinkOutConfig configures replacing large attachments of forwarded emails
+// with signed download links served by the backend to thread participants.
+// It requires a BlobStore.
+type LinkOutConfig struct {
+	// Threshold is the size in bytes above which attachments are linked instead of attached.
+	// Link-out is disabled if zero.
+	Threshold int
+	// Secret signs download links. Link-out is disabled if empty.
+	Secret string
+	// TTL is how long download links are valid. Defaults to 7 days.
+	TTL time.Duration
+	// BaseURL is the public URL of the frontend HTTP server, which authenticates
+	// downloads before proxying them to the backend.
+	BaseURL string
+}
+
+// OutboxConfig configures the dispatcher of queued outbound emails.
+type OutboxConfig struct {
+	// PollInterval is the wait between polls of an empty outbox. Defaults to 1s.
+	PollInterval time.Duration
+	// Lease is how long a dispatcher owns a message before others may retry it. Defaults to 1m.
+	Lease time.Duration
+	// MaxAttempts fails a message after as many retryable send errors. Defaults to 20.
+	MaxAttempts int
+	// Backoff and MaxBackoff space out attempts exponentially. Default to 1s and 1h.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// SmtpConfig configures the SMTP submission Mailer.
+type SmtpConfig struct {
+	// Addr is the host:port of the submission server.
+	Addr string
+	// Security is "starttls" (default), "tls" for implicit TLS or "none".
+	Security           string
+	InsecureSkipVerify bool
+	Username           string
+	Password           string
+	// PoolSize is the number of idle connections kept open. Defaults to 2.
+	PoolSize int
+}
+
+// MailerRouterConfig routes outbound emails across several Mailers,
+// failing over on retryable errors.
+type MailerRouterConfig struct {
+	Routes []MailerRouteConfig
+	// FailureThreshold is the number of consecutive retryable failures
+	// opening the circuit of a Mailer. Defaults to 3.
+	FailureThreshold int
+	// Cooldown is how long an open circuit skips its Mailer before a trial send.
+	// Defaults to 30s.
+	Cooldown time.Duration
+}
+
+type MailerRouteConfig struct {
+	// Name identifies the route in metrics and SendResult.Provider and must be unique.
+	// Defaults to Provider.
+	Name string
+	// Provider is "mailersend", "smtp" or "capture".
+	Provider string
+	// MailerSendApiKey and Smtp override the Config ones for this route,
+	// e.g. to route across several SMTP relays.
+	MailerSendApiKey string
+	Smtp             *SmtpConfig
+	// Priority orders routes ascending. Routes of equal priority share traffic by Weight.
+	Priority int
+	// Weight defaults to 1.
+	Weight int
+}
+
+// MailCaptureConfig configures the capturing Mailer served at /dev/mail to local clients only.
+type MailCaptureConfig struct {
+	// Dir keeps captured emails as .eml files so they're shared between processes
+	// and survive restarts. Emails are kept in memory if empty.
+	Dir string
+	// MaxMessages is the number of emails kept, older ones are dropped. Defaults to 500.
+	MaxMessages int
+}
+
+// BlobStoreConfig configures where attachments of sent emails are stored.
+type BlobStoreConfig struct {
+	// Dir keeps blobs on the local filesystem. Attachments aren't stored if empty.
+	Dir string
+}
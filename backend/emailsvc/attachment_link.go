@@ -0,0 +1,233 @@
+package emailsvc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Download links look like <BaseURL>/email/thread/<threadId>/attachments/<sha256>?exp=<unix>&sig=<mac>
+// where mac is the base64url HMAC-SHA256 of threadId, sha256 and exp.
+const defaultLinkTTL = 7 * 24 * time.Hour
+
+// AttachmentLink identifies the download of an attachment of an EmailThread.
+type AttachmentLink struct {
+	ThreadId  string
+	Sha256    string
+	Expiry    int64
+	Signature string
+}
+
+// AttachmentURL returns the signed download link of the attachment stored under digest,
+// or "" if link-out is disabled.
+func AttachmentURL(
+	cfg backend.Config,
+	threadId primitive.ObjectID,
+	digest string,
+	now time.Time,
+) string {
+	if cfg.Email.LinkOut.Secret == "" {
+		return ""
+	}
+	link := AttachmentLink{
+		ThreadId: threadId.Hex(),
+		Sha256:   digest,
+		Expiry:   now.Add(linkTTL(cfg)).Unix(),
+	}
+	u, err := url.JoinPath(cfg.Email.LinkOut.BaseURL, "email/thread", link.ThreadId, "attachments", digest)
+	if err != nil {
+		log.Error().Err(err).Str("baseURL", cfg.Email.LinkOut.BaseURL).Msg("failed JoinPath")
+		return ""
+	}
+	q := url.Values{
+		"exp": {strconv.FormatInt(link.Expiry, 10)},
+		"sig": {linkMac(cfg.Email.LinkOut.Secret, link)},
+	}
+	return u + "?" + q.Encode()
+}
+
+// ParseAttachmentLink reads an AttachmentLink from the path values and query of a download request.
+func ParseAttachmentLink(threadId, digest string, query url.Values) AttachmentLink {
+	expiry, _ := strconv.ParseInt(query.Get("exp"), 10, 64)
+	return AttachmentLink{
+		ThreadId:  threadId,
+		Sha256:    digest,
+		Expiry:    expiry,
+		Signature: query.Get("sig"),
+	}
+}
+
+// verifyAttachmentLink rejects forged and expired links with 403.
+func verifyAttachmentLink(cfg backend.Config, link AttachmentLink, now time.Time) app.Error {
+	if cfg.Email.LinkOut.Secret == "" {
+		return app.NewErr(403, "", "download links are disabled")
+	}
+	if !hmac.Equal([]byte(link.Signature), []byte(linkMac(cfg.Email.LinkOut.Secret, link))) {
+		return app.NewErr(403, "", "forged download link")
+	}
+	if now.Unix() > link.Expiry {
+		return app.NewErr(403, "", "expired download link")
+	}
+	return nil
+}
+
+func linkMac(secret string, link AttachmentLink) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s|%s|%d", link.ThreadId, link.Sha256, link.Expiry)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// OpenAttachment verifies link and returns the attachment it points to if requester
+// is a current participant of the thread, so links stop working for whoever left it.
+func (s *emailService) OpenAttachment(
+	ctx context.Context,
+	link AttachmentLink,
+	requester app.User,
+) (Attachment, io.ReadCloser, app.Error) {
+	const op = "OpenAttachment"
+	if err := verifyAttachmentLink(s.cfg, link, time.Now()); err != nil {
+		return Attachment{}, nil, err
+	}
+	if s.blobs == nil {
+		return Attachment{}, nil, app.NewErr(404, "", "attachments aren't stored")
+	}
+
+	// access check
+	thread, err := s.ThreadSearch(ctx, ThreadSearchTerms{ThreadId: link.ThreadId})
+	if err != nil {
+		return Attachment{}, nil, app.FromErr(err, op)
+	}
+	if !isParticipant(thread, requester) {
+		return Attachment{}, nil, app.NewErr(403, "", "requester is not a thread participant")
+	}
+	_, attachment, ok := findAttachment(thread, link.Sha256)
+	if !ok {
+		return Attachment{}, nil, app.NewErr(404, "", "attachment not in thread")
+	}
+
+	//
+	r, err := s.blobs.OpenBlob(ctx, link.Sha256)
+	if err != nil {
+		return Attachment{}, nil, app.FromErr(err, op)
+	}
+	return attachment, r, nil
+}
+
+func findAttachment(thread EmailThread, digest string) (Email, Attachment, bool) {
+	for _, email := range thread.Emails {
+		for _, a := range email.Attachments {
+			if a.Sha256 == digest {
+				return email, a, true
+			}
+		}
+	}
+	return Email{}, Attachment{}, false
+}
+
+func isParticipant(thread EmailThread, usr app.User) bool {
+	if usr == nil || usr.GetEmail() == "" {
+		return false
+	}
+	for _, p := range thread.Participants {
+		if strings.EqualFold(p.GetEmail(), usr.GetEmail()) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkOut stores attachments of outbound above the link-out threshold and replaces them
+// with download links in its bodies. It returns the linked attachments to record on the Email.
+func (s *emailService) linkOut(
+	ctx context.Context,
+	threadId primitive.ObjectID,
+	outbound *enmime.Envelope,
+) ([]Attachment, app.Error) {
+	const op = "linkOut"
+	lcfg := s.cfg.Email.LinkOut
+	if lcfg.Threshold <= 0 || lcfg.Secret == "" || s.blobs == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var kept []*enmime.Part
+	var links []Attachment
+	for _, p := range outbound.Attachments {
+		if len(p.Content) <= lcfg.Threshold {
+			kept = append(kept, p)
+			continue
+		}
+		putCtx, putCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+		digest, err := s.blobs.PutBlob(putCtx, p.Content)
+		putCanc()
+		if err != nil {
+			err = app.FromErr(err, fmt.Sprintf("%s: PutBlob %q", op, p.FileName))
+			log.Error().Err(err).Send()
+			return nil, err
+		}
+		a := newAttachment(p, false)
+		a.URL = AttachmentURL(s.cfg, threadId, digest, now)
+		links = append(links, a)
+		log.Debug().
+			Str("fileName", p.FileName).
+			Int("size", len(p.Content)).
+			Msg("linked out attachment")
+	}
+	if len(links) == 0 {
+		return nil, nil
+	}
+
+	// the envelope shares its parts with the inbound clone, so replace rather than edit them
+	outbound.Attachments = kept
+	expires := now.Add(linkTTL(s.cfg)).Format("Jan 2, 2006")
+	var text, htm strings.Builder
+	fmt.Fprintf(&text, "\r\n\r\nAttachments available until %s:\r\n", expires)
+	fmt.Fprintf(&htm, "<p>Attachments available until %s:</p><ul>", expires)
+	for _, a := range links {
+		fmt.Fprintf(&text, "%s (%s): %s\r\n", a.FileName, formatSize(a.Size), a.URL)
+		fmt.Fprintf(&htm, `<li><a href="%s">%s</a> (%s)</li>`,
+			html.EscapeString(a.URL), html.EscapeString(a.FileName), formatSize(a.Size))
+	}
+	htm.WriteString("</ul>")
+	outbound.Text += text.String()
+	if outbound.HTML != "" {
+		if i := strings.LastIndex(strings.ToLower(outbound.HTML), "</body>"); i >= 0 {
+			outbound.HTML = outbound.HTML[:i] + htm.String() + outbound.HTML[i:]
+		} else {
+			outbound.HTML += htm.String()
+		}
+	}
+	return links, nil
+}
+
+func linkTTL(cfg backend.Config) time.Duration {
+	if cfg.Email.LinkOut.TTL <= 0 {
+		return defaultLinkTTL
+	}
+	return cfg.Email.LinkOut.TTL
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
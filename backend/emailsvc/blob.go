@@ -0,0 +1,57 @@
+package emailsvc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+)
+
+// BlobStore stores attachment content addressed by its SHA-256 digest,
+// as returned by BlobDigest.
+type BlobStore interface {
+	// PutBlob stores content under its digest. Storing existing content is a no-op.
+	PutBlob(ctx context.Context, content []byte) (string, app.Error)
+	// OpenBlob returns the content of digest, or 404 if it isn't stored.
+	OpenBlob(ctx context.Context, digest string) (io.ReadCloser, app.Error)
+}
+
+// BlobDigest returns the lowercase hex SHA-256 digest content is stored under.
+func BlobDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// storeAttachments stores the attachments and inline parts of env so they're
+// retrievable by the Attachment.Sha256 of the Email recorded for it.
+func (s *emailService) storeAttachments(
+	ctx context.Context,
+	env *enmime.Envelope,
+) app.Error {
+	const op = "storeAttachments"
+	if s.blobs == nil {
+		return nil
+	}
+	for _, p := range slices.Concat(env.Attachments, env.Inlines) {
+		putCtx, putCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+		digest, err := s.blobs.PutBlob(putCtx, p.Content)
+		putCanc()
+		if err != nil {
+			err = app.FromErr(err, fmt.Sprintf("%s: PutBlob %q", op, p.FileName))
+			log.Error().Err(err).Send()
+			return err
+		}
+		log.Debug().
+			Str("fileName", p.FileName).
+			Str("sha256", digest).
+			Int("size", len(p.Content)).
+			Msg("stored attachment")
+	}
+	return nil
+}
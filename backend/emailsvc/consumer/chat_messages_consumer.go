@@ -1,107 +1,182 @@
 package consumer
 
-// import (
-// 	"bytes"
-// 	"context"
-// 	"encoding/json"
-// 	"fmt"
-// 	"time"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
-// 	"github.com/benjamonnguyen/opendoor-commons/mq"
-// 	"github.com/benjamonnguyen/opendoor-email-svc/internal/emailcfg"
-// 	"github.com/benjamonnguyen/opendoor-email-svc/internal/mailer"
-// 	"github.com/benjamonnguyen/opendoor-email-svc/internal/service"
-// 	"github.com/benjamonnguyen/opendoor-protos/pb/chatpb"
-// 	"github.com/benjamonnguyen/opendoor-protos/pb/emailpb"
-// 	"github.com/benjamonnguyen/opendoor-protos/pb/userpb"
-// 	"github.com/jhillyerd/enmime"
-// 	"github.com/rs/zerolog/log"
-// 	"github.com/twmb/franz-go/pkg/kgo"
-// )
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
 
-// const (
-// 	chatMessagesConsumer = "chat-messages"
-// )
+const (
+	chatMessagesConsumer = "chat-messages"
+)
 
-// func AddChatMessagesConsumer(
-// 	ctx context.Context,
-// 	cfg emailcfg.Config,
-// 	emailSvc service.IEmailService,
-// 	m mailer.Mailer,
-// 	cl mq.KafkaConsumerClient,
-// ) {
-// 	if err := cl.SetRecordHandler(cfg.Kafka.Topics[chatMessagesConsumer], func(rec *kgo.Record) {
-// 		sendEmail(ctx, cfg, emailSvc, m, rec)
-// 	}); err != nil {
-// 		log.Fatal().Err(err).Msg("failed AddChatMessagesConsumer")
-// 	}
-// 	log.Info().Msg("added chatMessages consumer")
-// }
+// ChatMessage is the payload of records on the chatMessages topic.
+type ChatMessage struct {
+	ChatId    string    `json:"chatId"`
+	From      string    `json:"from"` // sender email
+	Text      string    `json:"text"`
+	HTML      string    `json:"html,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
 
-// func sendEmail(
-// 	ctx context.Context,
-// 	cfg emailcfg.Config,
-// 	emailSvc service.IEmailService,
-// 	m mailer.Mailer,
-// 	rec *kgo.Record,
-// ) {
-// 	start := time.Now()
-// 	log.Debug().
-// 		Str("record", string(rec.Value)).
-// 		Str("consumer", chatMessagesConsumer).
-// 		Msg("got chat message")
-// 	var payload *chatpb.MessagePayload
-// 	err := json.NewDecoder(bytes.NewReader(rec.Value)).Decode(payload)
-// 	if err != nil {
-// 		log.Error().Err(err).Msg("failed decoding record")
-// 		return
-// 	}
+func AddChatMessagesConsumer(
+	ctx context.Context,
+	cfg backend.Config,
+	emailSvc emailsvc.EmailService,
+	m emailsvc.Mailer,
+	cl kafka.KafkaConsumerClient,
+) {
+	if err := cl.SetRecordHandler(cfg.Kafka.Topics.ChatMessages, func(rec *kgo.Record) error {
+		return sendEmail(ctx, cfg, emailSvc, m, rec)
+	}); err != nil {
+		log.Fatal().Err(err).Msg("failed AddChatMessagesConsumer")
+	}
+	cl.SetKeyFunc(cfg.Kafka.Topics.ChatMessages, chatIdKey)
+	log.Info().Msg("added chatMessages consumer")
+}
 
-// 	// get thread
-// 	threadCtx, threadCanc := context.WithTimeout(ctx, cfg.ReadTimeout)
-// 	defer threadCanc()
-// 	req := &emailpb.ThreadSearchReq{
-// 		ChatId: &payload.ChatId,
-// 	}
-// 	threadResp, err := emailSvc.ThreadSearch(threadCtx, req)
-// 	if err != nil {
-// 		log.Error().Err(err).Interface("req", req).Msg("failed ThreadSearch")
-// 		return
-// 	}
+// chatIdKey orders chat messages per chat.
+func chatIdKey(rec *kgo.Record) string {
+	var payload ChatMessage
+	if err := json.Unmarshal(rec.Value, &payload); err != nil {
+		return string(rec.Key)
+	}
+	return payload.ChatId
+}
 
-// 	// get sender/rcpt
-// 	sender, rcpts, err := getSenderAndRcpts(
-// 		payload.Message.From,
-// 		threadResp.EmailThread,
-// 	)
-// 	if err != nil {
-// 		log.Error().Err(err).Msg("failed getSenderAndRcpt")
-// 		return
-// 	}
+func sendEmail(
+	ctx context.Context,
+	cfg backend.Config,
+	emailSvc emailsvc.EmailService,
+	m emailsvc.Mailer,
+	rec *kgo.Record,
+) error {
+	start := time.Now()
+	log.Debug().
+		Str("record", string(rec.Value)).
+		Str("consumer", chatMessagesConsumer).
+		Msg("got chat message")
+	var payload ChatMessage
+	if err := json.NewDecoder(bytes.NewReader(rec.Value)).Decode(&payload); err != nil {
+		return kafka.DeadLetterRecord(fmt.Errorf("failed decoding record: %w", err))
+	}
 
-// 	// construct email
-// 	enmime.Builder().
+	// get thread
+	threadCtx, threadCanc := context.WithTimeout(ctx, cfg.ReadTimeout)
+	defer threadCanc()
+	st := emailsvc.ThreadSearchTerms{
+		ChatId: payload.ChatId,
+	}
+	thread, err := emailSvc.ThreadSearch(threadCtx, st)
+	if err != nil {
+		return fmt.Errorf("failed ThreadSearch for chat %s: %w", payload.ChatId, err)
+	}
 
-// 	// mailer.Send
+	// get sender/rcpt
+	sender, rcpts, e := getSenderAndRcpts(payload.From, thread)
+	if e != nil {
+		return kafka.DeadLetterRecord(e)
+	}
+	if len(rcpts) == 0 {
+		log.Debug().Str("chatId", payload.ChatId).Msg("no email recipients")
+		return nil
+	}
 
-// 	// emailSvc.AddEmail
-// }
+	// construct email
+	outbound, err := buildEmail(cfg, thread, sender, rcpts, payload)
+	if err != nil {
+		return kafka.DeadLetterRecord(err)
+	}
 
-// func getSenderAndRcpts(
-// 	from string,
-// 	thread *emailpb.EmailThread,
-// ) (sender *userpb.User, rcpts []*userpb.User, err error) {
-// 	for i, _ := range thread.Participants {
-// 		p := thread.Participants[i]
-// 		if p.Id == from {
-// 			sender = p
-// 		} else {
-// 			rcpts = append(rcpts, p)
-// 		}
-// 	}
-// 	if sender == nil {
-// 		err = fmt.Errorf("sender %s not found in thread %s", from, thread.Id)
-// 		return nil, nil, err
-// 	}
-// 	return
-// }
+	// mailer.Send and emailSvc.AddEmail, once per chat message record
+	if err := emailSvc.SendThreadEmail(ctx, m, thread, outbound, kafka.SourceId(rec)); err != nil {
+		return fmt.Errorf("failed SendThreadEmail for chat %s: %w", payload.ChatId, err)
+	}
+	log.Debug().
+		Dur("timeSinceConsumed", time.Since(start)).
+		Str("chatId", payload.ChatId).
+		Msg("sent chat message email")
+	return nil
+}
+
+func buildEmail(
+	cfg backend.Config,
+	thread emailsvc.EmailThread,
+	sender app.User,
+	rcpts []app.User,
+	payload ChatMessage,
+) (*enmime.Envelope, app.Error) {
+	const op = "buildEmail"
+	subject := thread.Subject
+	if subject != "" && !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	b := enmime.Builder().
+		From(
+			fmt.Sprintf("%s %s", sender.GetFirstName(), sender.GetLastName()),
+			fmt.Sprintf("%s@%s", "mailer", cfg.Domain),
+		).
+		Subject(subject).
+		Text([]byte(payload.Text))
+	if payload.HTML != "" {
+		b = b.HTML([]byte(payload.HTML))
+	}
+	if replyTo := emailsvc.ReplyAddress(cfg, thread.Id, time.Now()); replyTo != "" {
+		b = b.ReplyTo("", replyTo)
+	}
+	if !payload.CreatedAt.IsZero() {
+		b = b.Date(payload.CreatedAt)
+	}
+	for _, r := range rcpts {
+		b = b.To(fmt.Sprintf("%s %s", r.GetFirstName(), r.GetLastName()), r.GetEmail())
+	}
+
+	// thread headers
+	if n := len(thread.Emails); n > 0 {
+		var references []string
+		for _, e := range thread.Emails {
+			references = append(references, e.MessageId)
+		}
+		b = b.Header("In-Reply-To", thread.Emails[n-1].MessageId).
+			Header("References", strings.Join(references, " "))
+	}
+
+	root, err := b.Build()
+	if err != nil {
+		return nil, app.FromErr(err, fmt.Sprintf("%s: Build", op))
+	}
+	env, err := enmime.EnvelopeFromPart(root)
+	if err != nil {
+		return nil, app.FromErr(err, fmt.Sprintf("%s: EnvelopeFromPart", op))
+	}
+	return env, nil
+}
+
+func getSenderAndRcpts(
+	from string,
+	thread emailsvc.EmailThread,
+) (sender app.User, rcpts []app.User, err error) {
+	for _, p := range thread.Participants {
+		if strings.EqualFold(p.GetEmail(), from) {
+			sender = p
+		} else {
+			rcpts = append(rcpts, p)
+		}
+	}
+	if sender == nil {
+		err = fmt.Errorf("sender %s not found in thread %s", from, thread.Id.Hex())
+		return nil, nil, err
+	}
+	return
+}
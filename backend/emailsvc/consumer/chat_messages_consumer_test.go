@@ -0,0 +1,129 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/benjamonnguyen/opendoorchat/keycloak"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+var (
+	cfg = backend.Config{
+		Domain:      "domain.com",
+		ReadTimeout: time.Second,
+	}
+	john = keycloak.User{FirstName: "John", LastName: "Smith", Email: "johnsmith@yahoo.com"}
+	ben  = keycloak.User{FirstName: "Ben", LastName: "N", Email: "ben@yahoo.com"}
+	ann  = keycloak.User{FirstName: "Ann", LastName: "Lee", Email: "ann@yahoo.com"}
+)
+
+func TestSendEmail(t *testing.T) {
+	thread := emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{john, ben, ann},
+		Subject:      "subject",
+		Emails: []emailsvc.Email{
+			{MessageId: "<first@yahoo.com>"},
+			{MessageId: "<second@domain.com>"},
+		},
+	}
+	svc := &testService{thread: thread}
+	rec := chatRecord(t, ChatMessage{ChatId: "chat", From: "JohnSmith@yahoo.com", Text: "hi"})
+	if err := sendEmail(context.Background(), cfg, svc, nil, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.sent) != 1 {
+		t.Fatalf("got %d emails, want 1", len(svc.sent))
+	}
+	outbound := svc.sent[0]
+	if got, want := outbound.GetHeader("To"), `"Ben N" <ben@yahoo.com>, "Ann Lee" <ann@yahoo.com>`; got != want {
+		t.Errorf("got To %q, want %q", got, want)
+	}
+	if got, want := outbound.GetHeader("Subject"), "Re: subject"; got != want {
+		t.Errorf("got Subject %q, want %q", got, want)
+	}
+	if got, want := outbound.GetHeader("In-Reply-To"), "<second@domain.com>"; got != want {
+		t.Errorf("got In-Reply-To %q, want %q", got, want)
+	}
+	if got, want := outbound.GetHeader("References"), "<first@yahoo.com> <second@domain.com>"; got != want {
+		t.Errorf("got References %q, want %q", got, want)
+	}
+	if got, want := svc.keys[0], kafka.SourceId(rec); got != want {
+		t.Errorf("got key %q, want %q", got, want)
+	}
+}
+
+func TestSendEmailDeadLetters(t *testing.T) {
+	svc := &testService{thread: emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{john, ben},
+	}}
+	tests := []struct {
+		name string
+		rec  *kgo.Record
+	}{
+		{name: "undecodable record", rec: &kgo.Record{Topic: "chat", Value: []byte("{")}},
+		{name: "unknown sender", rec: chatRecord(t, ChatMessage{ChatId: "chat", From: "outsider@yahoo.com"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sendEmail(context.Background(), cfg, svc, nil, tt.rec)
+			if d := kafka.DispositionOf(err); d != kafka.DeadLetter {
+				t.Errorf("got disposition %s (%v), want %s", d, err, kafka.DeadLetter)
+			}
+		})
+	}
+	if len(svc.sent) != 0 {
+		t.Errorf("got %d emails, want 0", len(svc.sent))
+	}
+}
+
+func chatRecord(t *testing.T, msg ChatMessage) *kgo.Record {
+	t.Helper()
+	value, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kgo.Record{Topic: "chat", Value: value}
+}
+
+type testService struct {
+	emailsvc.EmailService
+	thread emailsvc.EmailThread
+	sent   []*enmime.Envelope
+	keys   []string
+}
+
+func (s *testService) ThreadSearch(
+	context.Context,
+	emailsvc.ThreadSearchTerms,
+) (emailsvc.EmailThread, app.Error) {
+	return s.thread, nil
+}
+
+func (s *testService) SendThreadEmail(
+	_ context.Context,
+	_ emailsvc.Mailer,
+	_ emailsvc.EmailThread,
+	outbound *enmime.Envelope,
+	key string,
+) app.Error {
+	s.sent = append(s.sent, outbound)
+	s.keys = append(s.keys, key)
+	return nil
+}
@@ -0,0 +1,84 @@
+package consumer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/textproto"
+	"strings"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/benjamonnguyen/opendoorchat/httputil"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// AddInboundEmailsConsumer forwards records of the inboundEmails topic, routing
+// failures to the inboundEmails retry and dead-letter topics.
+func AddInboundEmailsConsumer(
+	ctx context.Context,
+	cfg backend.Config,
+	emailSvc emailsvc.EmailService,
+	m emailsvc.Mailer,
+	cl kafka.KafkaConsumerClient,
+	producer kafka.KafkaProducerClient,
+) {
+	retryPolicy := kafka.RetryPolicy{
+		RetryTopic:      cfg.Kafka.Topics.InboundEmailsRetry,
+		DeadLetterTopic: cfg.Kafka.Topics.InboundEmailsDLQ,
+		MaxRetries:      cfg.Kafka.Retry.MaxRetries,
+		Backoff: httputil.ExponentialBackoffConfigs{
+			Interval: cfg.Kafka.Retry.Backoff,
+			Max:      cfg.Kafka.Retry.MaxBackoff,
+		},
+	}
+	handler := kafka.RetryingRecordHandler(ctx, producer, retryPolicy,
+		InboundEmailsHandler(ctx, cfg, emailSvc, m))
+	if err := cl.SetRecordHandler(cfg.Kafka.Topics.InboundEmails, handler); err != nil {
+		log.Fatal().Err(err).Msg("failed AddInboundEmailsConsumer")
+	}
+	cl.SetKeyFunc(cfg.Kafka.Topics.InboundEmails, InboundEmailThreadKey)
+	if retryPolicy.RetryTopic != "" {
+		if err := cl.SetRecordHandler(retryPolicy.RetryTopic, handler); err != nil {
+			log.Fatal().Err(err).Msg("failed AddInboundEmailsRetryConsumer")
+		}
+		cl.SetKeyFunc(retryPolicy.RetryTopic, InboundEmailThreadKey)
+	}
+	log.Info().Msg("added inboundEmails consumer")
+}
+
+// InboundEmailsHandler forwards the raw inbound email of a record. Forwarding is
+// idempotent by Message-Id, so records can be safely redelivered or replayed.
+func InboundEmailsHandler(
+	ctx context.Context,
+	cfg backend.Config,
+	emailSvc emailsvc.EmailService,
+	m emailsvc.Mailer,
+) kafka.RecordHandler {
+	return func(rec *kgo.Record) error {
+		inbound, err := enmime.ReadEnvelope(bytes.NewReader(rec.Value))
+		if err != nil {
+			return err
+		}
+		if err := emailSvc.ForwardInboundEmail(ctx, m, inbound); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// InboundEmailThreadKey orders inbound emails of a thread by the root of their
+// References chain, falling back to In-Reply-To and the record key.
+func InboundEmailThreadKey(rec *kgo.Record) string {
+	hdr, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(rec.Value))).ReadMIMEHeader()
+	if refs := strings.Fields(hdr.Get("References")); len(refs) > 0 {
+		return refs[0]
+	}
+	if inReplyTo := strings.TrimSpace(hdr.Get("In-Reply-To")); inReplyTo != "" {
+		return inReplyTo
+	}
+	return string(rec.Key)
+}
@@ -2,25 +2,44 @@ package emailsvc
 
 import (
 	"encoding/json"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type EmailController interface {
 	ThreadSearch(http.ResponseWriter, *http.Request)
+	ThreadResolve(http.ResponseWriter, *http.Request)
+	DownloadAttachment(http.ResponseWriter, *http.Request)
 }
 
 var _ EmailController = (*emailController)(nil)
 
 type emailController struct {
+	cfg     backend.Config
 	service EmailService
+	users   app.UserRepo
 }
 
-func NewEmailController(service EmailService) *emailController {
+// NewEmailController constructs an EmailController authenticating thread reads
+// and attachment downloads by the access token of users.
+func NewEmailController(cfg backend.Config, service EmailService, users app.UserRepo) *emailController {
 	return &emailController{
+		cfg:     cfg,
 		service: service,
+		users:   users,
 	}
 }
 
+// ThreadSearch serves the thread matching the search terms to the thread participant
+// identified by the access token of the X-Auth-Token header.
 func (ctrl *emailController) ThreadSearch(w http.ResponseWriter, r *http.Request) {
 	// decode search terms
 	var st ThreadSearchTerms
@@ -29,12 +48,30 @@ func (ctrl *emailController) ThreadSearch(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// authenticate
+	requester, ok := ctrl.authenticate(w, r)
+	if !ok {
+		return
+	}
+
 	//
 	thread, httperr := ctrl.service.ThreadSearch(r.Context(), st)
 	if httperr != nil {
 		http.Error(w, "failed ThreadSearch: "+httperr.Error(), httperr.StatusCode())
 		return
 	}
+	if !isParticipant(thread, requester) {
+		http.Error(w, "requester is not a thread participant", http.StatusForbidden)
+		return
+	}
+
+	// link inline images for the reader
+	now := time.Now()
+	emails := make([]Email, len(thread.Emails))
+	for i, email := range thread.Emails {
+		emails[i] = linkInlines(ctrl.cfg, thread.Id, email, now)
+	}
+	thread.Emails = emails
 
 	//
 	data, err := json.Marshal(thread)
@@ -47,3 +84,86 @@ func (ctrl *emailController) ThreadSearch(w http.ResponseWriter, r *http.Request
 	w.Header().Add("Content-Type", "application/json")
 	w.Write(data)
 }
+
+// threadResolveResponse identifies the resolved thread without exposing its content.
+type threadResolveResponse struct {
+	ThreadId primitive.ObjectID `json:"threadId"`
+	Strategy ResolveStrategy    `json:"strategy"`
+}
+
+// ThreadResolve reports which thread an inbound email resolves to.
+func (ctrl *emailController) ThreadResolve(w http.ResponseWriter, r *http.Request) {
+	// decode resolve terms
+	var terms ThreadResolveTerms
+	if err := json.NewDecoder(r.Body).Decode(&terms); err != nil {
+		http.Error(w, "provide ThreadResolveTerms", http.StatusBadRequest)
+		return
+	}
+
+	//
+	resolution, httperr := ctrl.service.ResolveThread(r.Context(), terms)
+	if httperr != nil {
+		http.Error(w, "failed ResolveThread: "+httperr.Error(), httperr.StatusCode())
+		return
+	}
+
+	//
+	data, err := json.Marshal(threadResolveResponse{
+		ThreadId: resolution.Thread.Id,
+		Strategy: resolution.Strategy,
+	})
+	if err != nil {
+		http.Error(w, "failed Marshal: "+err.Error(), 500)
+		return
+	}
+
+	//
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// DownloadAttachment serves an attachment by its signed download link to the thread
+// participant identified by the access token of the X-Auth-Token header.
+func (ctrl *emailController) DownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	link := ParseAttachmentLink(r.PathValue("threadId"), r.PathValue("sha256"), r.URL.Query())
+
+	// authenticate
+	requester, ok := ctrl.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	//
+	attachment, content, httperr := ctrl.service.OpenAttachment(r.Context(), link, requester)
+	if httperr != nil {
+		http.Error(w, "failed OpenAttachment: "+httperr.Error(), httperr.StatusCode())
+		return
+	}
+	defer content.Close()
+
+	//
+	w.Header().Add("Content-Type", attachment.ContentType)
+	w.Header().Add("Content-Length", strconv.Itoa(attachment.Size))
+	w.Header().Add("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, content); err != nil {
+		log.Error().Err(err).Str("sha256", link.Sha256).Msg("failed writing attachment")
+	}
+}
+
+// authenticate resolves the user of the access token of the X-Auth-Token header,
+// writing the error response if it fails.
+func (ctrl *emailController) authenticate(w http.ResponseWriter, r *http.Request) (app.User, bool) {
+	token := r.Header.Get(app.AUTH_TOKEN_HEADER_KEY)
+	if token == "" {
+		http.Error(w, "provide access token", http.StatusUnauthorized)
+		return nil, false
+	}
+	usr, httperr := ctrl.users.Me(r.Context(), token)
+	if httperr != nil {
+		http.Error(w, "failed Me: "+httperr.Error(), httperr.StatusCode())
+		return nil, false
+	}
+	return usr, true
+}
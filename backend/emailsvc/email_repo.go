@@ -5,28 +5,152 @@ import (
 	"time"
 
 	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc/replyparse"
+	"github.com/jhillyerd/enmime"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type EmailRepo interface {
 	ThreadSearch(context.Context, ThreadSearchTerms) (EmailThread, app.Error)
+	// AddEmail adds email to the thread unless an email with its MessageId was added already.
 	AddEmail(context.Context, primitive.ObjectID, Email) app.Error
+	// BeginInbound returns the InboundRecord of the inbound Message-Id, creating it with
+	// InboundProcessing status if it does not exist. Processing records are leased until
+	// now+lease, and BeginInbound returns 503 while another caller holds the lease.
+	BeginInbound(
+		ctx context.Context,
+		messageId string,
+		threadId primitive.ObjectID,
+		now time.Time,
+		lease time.Duration,
+	) (InboundRecord, app.Error)
+	// UpdateInbound saves the Status, Email and LeasedUntil of record.
+	UpdateInbound(context.Context, InboundRecord) app.Error
+}
+
+type InboundStatus string
+
+const (
+	InboundProcessing InboundStatus = "processing"
+	InboundSent       InboundStatus = "sent"
+	InboundCompleted  InboundStatus = "completed"
+)
+
+// InboundRecord tracks the processing of an inbound email by its Message-Id
+// so redelivered emails are skipped or resumed instead of forwarded twice.
+type InboundRecord struct {
+	MessageId string             `bson:"messageId"`
+	ThreadId  primitive.ObjectID `bson:"threadId"`
+	Status    InboundStatus      `bson:"status"`
+	// Email is the forwarded email, set once Status is InboundSent.
+	Email *Email `bson:"email,omitempty"`
+	// LeasedUntil is when the consumer processing the email may be taken over.
+	LeasedUntil time.Time `bson:"leasedUntil"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	UpdatedAt   time.Time `bson:"updatedAt"`
 }
 
 type Email struct {
-	MessageId string    `json:"messageId,omitempty" bson:"messageId"`
-	SentAt    time.Time `json:"sentAt,omitempty"    bson:"sentAt"`
+	MessageId   string            `json:"messageId,omitempty"   bson:"messageId"`
+	From        string            `json:"from,omitempty"        bson:"from"`
+	To          []string          `json:"to,omitempty"          bson:"to"`
+	Subject     string            `json:"subject,omitempty"     bson:"subject"`
+	Text        string            `json:"text,omitempty"        bson:"text"`
+	HTML        string            `json:"html,omitempty"        bson:"html"`
+	Headers     map[string]string `json:"headers,omitempty"     bson:"headers"`
+	Attachments []Attachment      `json:"attachments,omitempty" bson:"attachments"`
+	SentAt      time.Time         `json:"sentAt,omitempty"      bson:"sentAt"`
+	// ReplyText and ReplyHTML are what the sender wrote, without the quoted history
+	// and signature kept in Text and HTML.
+	ReplyText string `json:"replyText,omitempty" bson:"replyText,omitempty"`
+	ReplyHTML string `json:"replyHTML,omitempty" bson:"replyHTML,omitempty"`
+	// Provider is the Mailer that sent the Email and ProviderMessageId its id there.
+	Provider          string `json:"provider,omitempty"          bson:"provider,omitempty"`
+	ProviderMessageId string `json:"providerMessageId,omitempty" bson:"providerMessageId,omitempty"`
+}
+
+// Attachment describes an attachment or inline part of an Email.
+type Attachment struct {
+	FileName    string `json:"fileName,omitempty"    bson:"fileName"`
+	ContentType string `json:"contentType,omitempty" bson:"contentType"`
+	ContentId   string `json:"contentId,omitempty"   bson:"contentId,omitempty"`
+	Size        int    `json:"size"                  bson:"size"`
+	Inline      bool   `json:"inline,omitempty"      bson:"inline,omitempty"`
+	// Sha256 is the BlobDigest the content is stored under in the BlobStore.
+	Sha256 string `json:"sha256,omitempty"      bson:"sha256,omitempty"`
+	// URL is the signed download link of attachments too large to be sent.
+	URL string `json:"url,omitempty"         bson:"url,omitempty"`
+}
+
+// headersOfInterest are the envelope headers recorded on Email.Headers.
+var headersOfInterest = []string{
+	"Cc",
+	"Date",
+	"In-Reply-To",
+	"References",
+	"Reply-To",
+}
+
+// NewEmail records the content of env. MessageId is left for the caller
+// since it is assigned by the Mailer.
+func NewEmail(env *enmime.Envelope) Email {
+	email := Email{
+		From:    env.GetHeader("From"),
+		Subject: env.GetHeader("Subject"),
+		Text:    env.Text,
+		HTML:    env.HTML,
+		Headers: make(map[string]string),
+	}
+	if addrs, err := env.AddressList("To"); err == nil {
+		for _, addr := range addrs {
+			email.To = append(email.To, addr.String())
+		}
+	}
+	email.ReplyText = replyparse.ParseText(env.Text).Body
+	if env.HTML != "" {
+		if reply, err := replyparse.ParseHTML(env.HTML); err == nil {
+			email.ReplyHTML = reply.Body
+		}
+	}
+	for _, h := range headersOfInterest {
+		if v := env.GetHeader(h); v != "" {
+			email.Headers[h] = v
+		}
+	}
+	for _, p := range env.Attachments {
+		email.Attachments = append(email.Attachments, newAttachment(p, false))
+	}
+	for _, p := range env.Inlines {
+		email.Attachments = append(email.Attachments, newAttachment(p, true))
+	}
+	return email
+}
+
+func newAttachment(p *enmime.Part, inline bool) Attachment {
+	return Attachment{
+		FileName:    p.FileName,
+		ContentType: p.ContentType,
+		ContentId:   p.ContentID,
+		Size:        len(p.Content),
+		Inline:      inline,
+		Sha256:      BlobDigest(p.Content),
+	}
 }
 
 type EmailThread struct {
 	Id           primitive.ObjectID `json:"id,omitempty"        bson:"_id"`
 	Participants []app.User         `                           bson:"participants"`
+	Subject      string             `json:"subject,omitempty"   bson:"subject"`
 	Emails       []Email            `json:"emails,omitempty"    bson:"emails"`
 	ChatId       primitive.ObjectID `json:"chatId,omitempty"    bson:"chatId"`
 	CreatedAt    time.Time          `json:"createdAt,omitempty" bson:"createdAt"`
 }
 
 type ThreadSearchTerms struct {
+	ThreadId       string `json:"threadId,omitempty"`
 	ChatId         string `json:"chatId,omitempty"`
 	EmailMessageId string `json:"emailMessageId,omitempty"`
+	// Subject matches the normalized thread subject and requires ParticipantEmail.
+	Subject          string `json:"subject,omitempty"`
+	ParticipantEmail string `json:"participantEmail,omitempty"`
 }
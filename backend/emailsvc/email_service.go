@@ -3,7 +3,9 @@ package emailsvc
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/mail"
+	"strings"
 	"time"
 
 	app "github.com/benjamonnguyen/opendoorchat"
@@ -18,6 +20,10 @@ type EmailService interface {
 		ctx context.Context,
 		st ThreadSearchTerms,
 	) (EmailThread, app.Error)
+	ResolveThread(
+		ctx context.Context,
+		terms ThreadResolveTerms,
+	) (ThreadResolution, app.Error)
 	AddEmail(
 		ctx context.Context,
 		threadId primitive.ObjectID,
@@ -25,21 +31,46 @@ type EmailService interface {
 	) app.Error
 	ForwardInboundEmail(
 		ctx context.Context,
-		cfg backend.Config,
 		m Mailer,
 		inbound *enmime.Envelope,
 	) app.Error
+	SendThreadEmail(
+		ctx context.Context,
+		m Mailer,
+		thread EmailThread,
+		outbound *enmime.Envelope,
+		key string,
+	) app.Error
+	OpenAttachment(
+		ctx context.Context,
+		link AttachmentLink,
+		requester app.User,
+	) (Attachment, io.ReadCloser, app.Error)
 }
 
 var _ EmailService = (*emailService)(nil)
 
 type emailService struct {
-	repo EmailRepo
+	cfg    backend.Config
+	repo   EmailRepo
+	outbox OutboxRepo
+	blobs  BlobStore
 }
 
-func NewEmailService(repo EmailRepo) *emailService {
+// NewEmailService constructs an EmailService queueing outbound emails in outbox
+// for DispatchOutbox. If outbox is nil, they're sent right away instead.
+// Attachments of sent emails are stored in blobs unless it's nil.
+func NewEmailService(
+	cfg backend.Config,
+	repo EmailRepo,
+	outbox OutboxRepo,
+	blobs BlobStore,
+) *emailService {
 	return &emailService{
-		repo: repo,
+		cfg:    cfg,
+		repo:   repo,
+		outbox: outbox,
+		blobs:  blobs,
 	}
 }
 
@@ -50,15 +81,75 @@ func (s *emailService) ThreadSearch(
 	if st == (ThreadSearchTerms{}) {
 		return EmailThread{}, app.NewErr(400, "missing ThreadSearchTerms", "")
 	}
+	if st.Subject != "" && st.ParticipantEmail == "" {
+		return EmailThread{}, app.NewErr(400, "subject search requires participantEmail", "")
+	}
 
 	thread, err := s.repo.ThreadSearch(ctx, st)
 	if err != nil {
 		return EmailThread{}, err
 	}
-
 	return thread, nil
 }
 
+// ResolveThread resolves the EmailThread an inbound email belongs to by trying
+// a signed reply address among its recipients, "In-Reply-To", then every Message-Id in "References" newest first and, if
+// enabled, the normalized subject of a thread the sender participates in.
+func (s *emailService) ResolveThread(
+	ctx context.Context,
+	terms ThreadResolveTerms,
+) (ThreadResolution, app.Error) {
+	const op = "ResolveThread"
+	for _, rcpt := range terms.Recipients {
+		if !IsReplyAddress(rcpt) {
+			continue
+		}
+		threadId, err := ParseReplyAddress(s.cfg, rcpt, time.Now())
+		if err != nil {
+			// forged or expired, the threading headers may still resolve it
+			log.Debug().Err(err).Str("rcpt", rcpt).Msg("skipped reply address")
+			continue
+		}
+		thread, err := s.ThreadSearch(ctx, ThreadSearchTerms{ThreadId: threadId.Hex()})
+		if err == nil {
+			return ThreadResolution{Thread: thread, Strategy: ResolvedByReplyAddress}, nil
+		}
+		if err.StatusCode() != 404 {
+			return ThreadResolution{}, app.FromErr(err, op)
+		}
+	}
+
+	for _, st := range terms.searchOrder() {
+		thread, err := s.ThreadSearch(ctx, st)
+		if err == nil {
+			strategy := ResolvedByReferences
+			if st.EmailMessageId == terms.InReplyTo {
+				strategy = ResolvedByInReplyTo
+			}
+			return ThreadResolution{Thread: thread, Strategy: strategy}, nil
+		}
+		if err.StatusCode() != 404 {
+			return ThreadResolution{}, app.FromErr(err, op)
+		}
+	}
+
+	subject := NormalizeSubject(terms.Subject)
+	if s.cfg.Email.SubjectFallback && subject != "" && terms.From != "" {
+		thread, err := s.ThreadSearch(ctx, ThreadSearchTerms{
+			Subject:          subject,
+			ParticipantEmail: terms.From,
+		})
+		if err == nil {
+			return ThreadResolution{Thread: thread, Strategy: ResolvedBySubject}, nil
+		}
+		if err.StatusCode() != 404 {
+			return ThreadResolution{}, app.FromErr(err, op)
+		}
+	}
+
+	return ThreadResolution{}, app.NewErr(404, "", "thread not resolved")
+}
+
 func (s *emailService) AddEmail(
 	ctx context.Context,
 	threadId primitive.ObjectID,
@@ -67,8 +158,8 @@ func (s *emailService) AddEmail(
 	if threadId == primitive.NilObjectID {
 		return app.NewErr(400, "missing threadId", "")
 	}
-	if email == (Email{}) {
-		return app.NewErr(400, "missing email", "")
+	if email.MessageId == "" {
+		return app.NewErr(400, "missing email messageId", "")
 	}
 
 	if err := s.repo.AddEmail(ctx, threadId, email); err != nil {
@@ -78,36 +169,94 @@ func (s *emailService) AddEmail(
 }
 
 // ForwardInboundEmail forwards inbound email to participants of the EmailThread
-// matching the "In-Reply-To" header
+// resolved from its threading headers
 func (s *emailService) ForwardInboundEmail(
 	ctx context.Context,
-	cfg backend.Config,
 	m Mailer,
 	inbound *enmime.Envelope,
 ) app.Error {
 	start := time.Now()
+	err := s.forwardInboundEmail(ctx, m, inbound)
+	observeForward(start, err)
+	return err
+}
+
+func (s *emailService) forwardInboundEmail(
+	ctx context.Context,
+	m Mailer,
+	inbound *enmime.Envelope,
+) app.Error {
 	const op = "ForwardInboundEmail"
 	// devlog.Printf("got inbound email %#v\n", inbound)
 
 	if inbound == nil {
 		return app.NewErr(400, "inbound is nil", "")
 	}
+	inboundMsgId := strings.TrimSpace(inbound.GetHeader("Message-Id"))
+	// the outbound clone shares headers with inbound, so keep the sender before rewriting From
+	inboundFrom := inbound.GetHeader("From")
+	inboundDate, _ := inbound.Date()
+
 	// get thread
-	msgId := inbound.GetHeader("In-Reply-To")
-	threadCtx, threadCanc := context.WithTimeout(ctx, cfg.ReadTimeout)
+	threadCtx, threadCanc := context.WithTimeout(ctx, s.cfg.ReadTimeout)
 	defer threadCanc()
-	st := ThreadSearchTerms{
-		EmailMessageId: msgId,
-	}
-	thread, err := s.ThreadSearch(threadCtx, st)
+	resolution, err := s.ResolveThread(threadCtx, NewThreadResolveTerms(inbound))
 	if err != nil {
 		err = app.FromErr(err, op)
 		return err
 	}
+	thread := resolution.Thread
+	log.Debug().
+		Str("threadId", thread.Id.Hex()).
+		Str("strategy", string(resolution.Strategy)).
+		Msg("resolved thread")
+
+	// skip or resume duplicates
+	var record InboundRecord
+	if inboundMsgId != "" {
+		beginCtx, beginCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+		defer beginCanc()
+		lease := s.cfg.Email.InboundLease
+		if lease <= 0 {
+			lease = time.Minute
+		}
+		record, err = s.repo.BeginInbound(beginCtx, inboundMsgId, thread.Id, time.Now(), lease)
+		if err != nil {
+			err = app.FromErr(err, op)
+			log.Error().Err(err).Send()
+			return err
+		}
+		switch record.Status {
+		case InboundCompleted:
+			log.Info().Str("messageId", inboundMsgId).Msg("skipping duplicate inbound email")
+			return nil
+		case InboundSent:
+			log.Info().Str("messageId", inboundMsgId).Msg("resuming duplicate inbound email")
+			return s.completeInbound(ctx, record)
+		}
+		// release the lease if not sent so redeliveries needn't wait for it to expire
+		defer func() {
+			if record.Status == InboundProcessing {
+				s.releaseInbound(ctx, record)
+			}
+		}()
+	} else {
+		log.Warn().Msg("inbound email is missing Message-Id, skipping duplicate check")
+	}
 
 	// contruct outbound
 	outbound := inbound.Clone()
 	outbound.DeleteHeader("To")
+	outbound.DeleteHeader("Message-Id")
+	outbound.DeleteHeader("Reply-To")
+	if e := sanitizeHTML(s.cfg, outbound); e != nil {
+		err := app.FromErr(e, fmt.Sprintf("%s: sanitizeHTML", op))
+		log.Error().Err(err).Send()
+		return err
+	}
+	if replyTo := ReplyAddress(s.cfg, thread.Id, time.Now()); replyTo != "" {
+		outbound.SetHeader("Reply-To", []string{replyTo})
+	}
 	senderAddr, e := mail.ParseAddress(outbound.GetHeader("From"))
 	if e != nil {
 		err := app.FromErr(e, fmt.Sprintf("%s: ParseAddress", op))
@@ -125,7 +274,7 @@ func (s *emailService) ForwardInboundEmail(
 						p.GetFirstName(),
 						p.GetLastName(),
 						"mailer",
-						cfg.Domain,
+						s.cfg.Domain,
 					),
 				},
 			)
@@ -135,40 +284,218 @@ func (s *emailService) ForwardInboundEmail(
 		}
 	}
 
+	// link out large attachments
+	links, err := s.linkOut(ctx, thread.Id, outbound)
+	if err != nil {
+		return app.FromErr(err, op)
+	}
+
+	// queue email for the outbox dispatcher
+	if s.outbox != nil {
+		msg := OutboxMessage{
+			Key:         inboundMsgId,
+			ThreadId:    thread.Id,
+			From:        inboundFrom,
+			InboundDate: inboundDate,
+			Links:       links,
+		}
+		if err := s.enqueue(ctx, msg, outbound); err != nil {
+			return app.FromErr(err, op)
+		}
+		if inboundMsgId == "" {
+			return nil
+		}
+		record.Status = InboundCompleted
+		updateCtx, updateCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+		defer updateCanc()
+		if err := s.repo.UpdateInbound(updateCtx, record); err != nil {
+			// redelivery enqueues by the same key, so it's not sent twice
+			err = app.FromErr(err, op)
+			log.Error().Err(err).Str("messageId", inboundMsgId).Send()
+			return err
+		}
+		return nil
+	}
+
 	// send email
-	sendCtx, sendCanc := context.WithTimeout(ctx, cfg.RequestTimeout)
-	defer sendCanc()
-	mailerResp, err := m.Send(sendCtx, *outbound)
+	email, err := s.send(ctx, m, outbound)
 	if err != nil {
+		return app.FromErr(err, op)
+	}
+	// record the sender rather than the rewritten From
+	email.From = inboundFrom
+	email.Attachments = append(email.Attachments, links...)
+	observeDelivery(inboundDate)
+
+	// add new messageId to thread
+	if inboundMsgId == "" {
+		if err := s.addEmail(ctx, thread.Id, email); err != nil {
+			return app.FromErr(err, op)
+		}
+		return nil
+	}
+	record.Status = InboundSent
+	record.Email = &email
+	updateCtx, updateCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer updateCanc()
+	if err := s.repo.UpdateInbound(updateCtx, record); err != nil {
+		// the email went out, so adding it to the thread takes precedence
+		log.Error().Err(app.FromErr(err, op)).Str("messageId", inboundMsgId).Send()
+	}
+	if err := s.completeInbound(ctx, record); err != nil {
+		return app.FromErr(err, op)
+	}
+	return nil
+}
+
+// completeInbound adds the Email sent for an InboundRecord to its thread
+// and marks the record completed.
+func (s *emailService) completeInbound(
+	ctx context.Context,
+	record InboundRecord,
+) app.Error {
+	const op = "completeInbound"
+	if record.Email == nil {
+		return app.NewErr(500, "", fmt.Sprintf("%s: %s has no sent email", op, record.MessageId))
+	}
+	if err := s.addEmail(ctx, record.ThreadId, *record.Email); err != nil {
+		return app.FromErr(err, op)
+	}
+	record.Status = InboundCompleted
+	updateCtx, updateCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer updateCanc()
+	if err := s.repo.UpdateInbound(updateCtx, record); err != nil {
 		err = app.FromErr(err, op)
 		log.Error().Err(err).Send()
 		return err
 	}
-	sent, _ := inbound.Date()
-	log.Debug().
-		Int("code", mailerResp.StatusCode).
-		Dur("timeSinceSent", time.Since(sent)).
-		Dur("timeSinceConsumed", time.Since(start)).
-		Msg("got Mailer.Send() response")
+	return nil
+}
 
-	// add new messageId to thread
-	if mailerResp.StatusCode == 202 {
-		email, err := m.GetEmail(ctx, mailerResp.Header.Get("X-Message-Id"))
-		if err != nil {
-			err = app.FromErr(err, op)
-			log.Error().Err(err).Send()
-			return err
-		}
-		addCtx, addCanc := context.WithTimeout(ctx, cfg.RequestTimeout)
-		defer addCanc()
-		log.Debug().Str("emailMessageId", email.MessageId).Msg("AddEmail")
-		err = s.AddEmail(addCtx, thread.Id, email)
-		if err != nil {
-			err = app.FromErr(err, op)
-			log.Error().Err(err).Send()
-			return err
+// releaseInbound releases the lease of a record that wasn't sent.
+func (s *emailService) releaseInbound(ctx context.Context, record InboundRecord) {
+	record.LeasedUntil = time.Time{}
+	updateCtx, updateCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer updateCanc()
+	if err := s.repo.UpdateInbound(updateCtx, record); err != nil {
+		log.Error().Err(app.FromErr(err, "releaseInbound")).Str("messageId", record.MessageId).Send()
+	}
+}
+
+// SendThreadEmail sends outbound through the Mailer, or queues it if the service has an outbox,
+// and adds the resulting Message-Id to the EmailThread. key identifies the source of outbound,
+// like a chat message, so it's queued once however often it's redelivered.
+func (s *emailService) SendThreadEmail(
+	ctx context.Context,
+	m Mailer,
+	thread EmailThread,
+	outbound *enmime.Envelope,
+	key string,
+) app.Error {
+	const op = "SendThreadEmail"
+
+	if outbound == nil {
+		return app.NewErr(400, "outbound is nil", "")
+	}
+	if s.outbox != nil {
+		if err := s.enqueue(ctx, OutboxMessage{Key: key, ThreadId: thread.Id}, outbound); err != nil {
+			return app.FromErr(err, op)
 		}
 		return nil
 	}
-	return app.NewErr(mailerResp.StatusCode, mailerResp.Status, "")
+
+	email, err := s.send(ctx, m, outbound)
+	if err != nil {
+		return app.FromErr(err, op)
+	}
+	if err := s.addEmail(ctx, thread.Id, email); err != nil {
+		return app.FromErr(err, op)
+	}
+	return nil
+}
+
+// send sends outbound through the Mailer and returns the Email to record.
+func (s *emailService) send(
+	ctx context.Context,
+	m Mailer,
+	outbound *enmime.Envelope,
+) (Email, app.Error) {
+	const op = "send"
+
+	// self-assign the Message-Id so Mailers sending it need no lookup,
+	// others replace it with their own
+	if strings.TrimSpace(outbound.GetHeader("Message-Id")) == "" {
+		outbound.SetHeader("Message-Id", []string{NewMessageId(s.cfg.Domain)})
+	}
+	if err := s.storeAttachments(ctx, outbound); err != nil {
+		return Email{}, app.FromErr(err, op)
+	}
+
+	sendCtx, sendCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer sendCanc()
+	res, err := m.Send(sendCtx, *outbound)
+	if err != nil {
+		err = app.FromErr(err, op)
+		log.Error().Err(err).Send()
+		return Email{}, err
+	}
+	log.Debug().
+		Str("provider", res.Provider).
+		Strs("accepted", res.Accepted).
+		Strs("rejected", res.Rejected).
+		Msg("got Mailer.Send() result")
+	if len(res.Accepted) == 0 {
+		code := 422
+		if res.Retryable {
+			code = 503
+		}
+		return Email{}, app.NewErr(code, "no recipients accepted", op)
+	}
+	if len(res.Rejected) > 0 {
+		log.Warn().
+			Str("provider", res.Provider).
+			Strs("rejected", res.Rejected).
+			Msg("recipients rejected")
+	}
+
+	email := NewEmail(outbound)
+	email.MessageId = res.MessageId
+	email.Provider = res.Provider
+	email.ProviderMessageId = res.ProviderMessageId
+	if email.MessageId == "" {
+		// the Mailer assigned its own Message-Id, e.g. MailerSend. The email went out,
+		// so it's recorded by its ProviderMessageId if the lookup fails
+		s.lookupMessageId(ctx, m, &email)
+	}
+	return email, nil
+}
+
+// lookupMessageId sets the Message-Id the Mailer assigned to the sent email.
+func (s *emailService) lookupMessageId(ctx context.Context, m Mailer, email *Email) app.Error {
+	getCtx, getCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer getCanc()
+	sent, err := m.GetEmail(getCtx, email.ProviderMessageId)
+	if err != nil {
+		err = app.FromErr(err, "lookupMessageId")
+		log.Warn().Err(err).Str("providerMessageId", email.ProviderMessageId).Msg("failed looking up Message-Id")
+		return err
+	}
+	email.MessageId = sent.MessageId
+	return nil
+}
+
+func (s *emailService) addEmail(
+	ctx context.Context,
+	threadId primitive.ObjectID,
+	email Email,
+) app.Error {
+	addCtx, addCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer addCanc()
+	log.Debug().Str("emailMessageId", email.MessageId).Msg("AddEmail")
+	if err := s.AddEmail(addCtx, threadId, email); err != nil {
+		err = app.FromErr(err, "addEmail")
+		log.Error().Err(err).Send()
+		return err
+	}
+	return nil
 }
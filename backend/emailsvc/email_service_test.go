@@ -3,9 +3,18 @@ package emailsvc_test
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"net/http"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	app "github.com/benjamonnguyen/opendoorchat"
 	"github.com/benjamonnguyen/opendoorchat/backend"
@@ -46,7 +55,6 @@ func init() {
 func TestForwardEmail(t *testing.T) {
 	eRepo = new(emailRepo)
 	tMailer = new(testMailer)
-	svc := emailsvc.NewEmailService(eRepo)
 
 	const (
 		emailData = "Received: from sonic313-56.consmr.mail.ne1.yahoo.com (sonic313-56.consmr.mail.ne1.yahoo.com [66.163.185.31])\r\n\tby benjamins-air.lan (Haraka/3.0.2) with ESMTP id 310BBEB2-8575-40CE-BAB5-DD7176D59EC5.1\r\n\tenvelope-from <johnsmith@yahoo.com>;\r\n\tFri, 10 Nov 2023 01:11:13 -0800\r\nDKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=yahoo.com; s=s2048; t=1699607468; bh=O+eQOZb0WApF01OBl7YfH5Bc4Yo1hLik9FBKxwjYmIE=; h=From:Subject:Date:References:In-Reply-To:To:From:Subject:Reply-To; b=fBFTz+0eqhmsoYyW9z3qPbE0PVQsFRqfptWMNrkcCemkzCUuQZo6qDBtPxeBHsn2jxWzsDWO9nTPz7hPwYzZAoo1ocVtgsMVff82165Aeah5xQYESMHqq+lkFZqaZhxWAISn995qy9aGxtEXJGNJELnQNvJFfWzCngtVN8xKcKun0Z+uGmqBqcnxXf7lQI0Csu9IJ54jT1rK5KTTslsOQRhKzg39uCC4KePfF3FeLkzzOa4hrCVJb3As50OJzcschgIjlpNWjwNcZkpLTZVreR5YUae6e3kl4fAqmbS/mgzzA49y0E1JZhwMc6GCgT3nh2FLg6e+aPcNNhLtrYnymg==\r\nX-SONIC-DKIM-SIGN: v=1; a=rsa-sha256; c=relaxed/relaxed; d=yahoo.com; s=s2048; t=1699607468; bh=bw9L71hs8r0+l+uKe9AjTxPJVQbYQNpcj7j2O2zCu52=; h=X-Sonic-MF:From:Subject:Date:To:From:Subject; b=ZivJ3WzdQ3bQDwpZUc2ZRpRmMK+4fYS6J60PUUuvyImsj7zny6RQuQisnxeFTiNZ4f6svfBWD+6/GtIc+tAigcSm879Ex18yfstMVd/RHHrts3pU5d3FJLutVWv9lSBPGNcZ5ARLeGiOntVwsJGGOZ6OWADTYErlBKwQonZwtv8y6+z7VWPtqPqrt7AICUe+LqLKmulxxa/675oQWxgZCVG1GoDecD6F1tTEmPylgInpXzEzCn5YvyDrYG71IozXnydXgXN7MCY8zZ9D3ODg3CtFr81KvX/MI+/uHbl4WMDp3QbSoQq4ePBZjGQH8CrRhekHLoD8fhcIPRHGyRrJEA==\r\nX-YMail-OSG: B8guXgQVM1lPJUPiDe_1qyTsUe03cODHi3Jx3TXAeAQ373GEXVyIPxWwHWMWgW0\r\n qZUp2YBQN94ghq57iirAQQVYB.DMMQkSe1DVflL.ev3VoS1auQ8QxTwpo61C.CBtQuhRRPZ8QX1O\r\n JZ6RKta3.Pld2dOAFCna9D41Q_oEYVvbJY9mOx8KxfWu.N8lSOE5.O_G3bRJacOMETXDfK.1khSh\r\n UmocUl0R5YVCdqRhU1fuyAWQcSxWsMJfANu1lsoih.YA5JX0LGefb5L2sRCLedBUI_VFHNExmN1A\r\n c0YEs98Q238hQskvJyDZlZuQ3CFtjAn_IQpZPTyVd6nEA5XQyQejqm9RzUMJlU8zqnRkMT23m1IH\r\n jqOnTUeS0cTTYOVFqrP3lfc0icQCqyca_fWN2vf8yFA9T_wHyoyyb9co0xDgK5YLFP1qlGtSg9SA\r\n OW6G2BcNbnE2JWQJPhYf0z4NCt8QOPiJax8O3vEwzz8LQYPZrJaCFLQWSIiqnxWoIB6VtFXMYBub\r\n QOFlbBPXcgrqdTrdf_xwSTcrZOOQVe2qxfIcKFUcC5BNqJDzPIM_yxRkfFM78Emft7L9xYILqgV2\r\n 7W_CwW67F_ZvzSQAdrN9KIxx7bKqIT_b3d2d8t6IYb2gTLERX3s_fb9Q3YDCTugpmV7G3jyMI3ej\r\n IY0gd4Bty4z3oqsY3Yq5WltDWfzhvMod2dE14TcpEdZn64X2PuLpvDD7jJjNqZl18irr767tO.tw\r\n ks27D.tdeC9GV0dHzyywbMFrKJHjyMKaoJLyAYP_AYUVbpSuo0O.82cd5DdSta2Xzgs7hyMMyzyX\r\n mdz3CEzOWcJB2ON8gBWmhidHfmJwbKyEFXkBhx1WzJYIMJzBgF07lT2.1_.idSe.QTgBTINN1e9n\r\n FQAputbipHyHkIhQDIdCvEOZ5cJST6w974joAVnR8UmvR0ynchfAzwrbV1ix6FGKI8VnS6rvMhYx\r\n XyiqJ5JXYSMlRrdWJpBsBlnQVDRe4Y3spbL2DIlGlgtd0qciMvdQFrYbs6ykekowvoctg5MY2hkg\r\n eBs13SFPaeFPKmmPOga5daOjsDB_GiTNWpc19s1ra3fIAwhLM0_oBMDEILelGiSQcggV0E_cr0Yd\r\n jbnIkxm_YGjgiOb5xj3gu3acC0CzfPnlGgdAn3XFz3xI6viYQwuRM03Fh7yXtcG4nx.dzGemcTP7\r\n 4dSP3xegGFtBO9QZni498Kcr6Mposx21DxJHZ2n6ZJ8EvGYC1xF7J_fzc9nLuGMJsgLw9zTqcVNd\r\n zW3iju1t9wB1csE9ASQVTKkHh4nsBzqm1IFUI4QlMbTX7pf7NIDoOJzbB2QRegrNuUXoIjdqmkd0\r\n ZL6Dn5DAHnrxT_NGOmD3HV0xugG56OVn2nXqPnnZzBy_7y8WOJxGYlZkWzNoO3DKTnYsw9vnCGNK\r\n 0C5x1L0dOpuzCYyTk6xoCSsf_oQXym_IuWccTMEuQHKfG2hdoxe32Iekv_aPDQjctpHHWVCDVTI0\r\n bGDXPToQfsDdMg.4WXBGUKm.kL.DkWkVAM3TiiOiqux.LspOxSAdEHAOwTAiNlTFaJZ0VZvsjYno\r\n y9XI7Fsa.dBI.Cn0fI22bz9GgcXZQ7OHKSqoo9ocIpDjl.sW3jkZUHY1QDSSCS1.4jzdu1aG1PDp\r\n mDqyCiOL9lJtJ9lXkux0vJu3Mqf2QZRq80vSDSMvhGO.UcupFoaLYh1HNzvbacoLTPDng5Lt6d7m\r\n Yjy27xTC3oPyfrYkcOlCjPm8u2q.L1a8yTVhaGY1DAF_XYiYmpiuTKWZjg0HbqwsOWrdwkgmtFUQ\r\n 97c3stRkuKDRbnyTjkpUZZOtQCUJJvJpSX9WNvk4Qf91cNnPMX_YxdReAxvNr1xkXIPAXEc5J.Rk\r\n 0P_IN_.TvPFvb6jTIwpT4TKFpPB2nEZJ8N4.REX7x3xwjofYHdWgBXfB5nqocw1KQcwolHkvN16v\r\n 2GsYFLP0HtOsdpf2jKmL345pef2GRddUdxfCENaEv0vbx_TVC1N7zZsHDWrl2ks7n2hGOP_LTPZT\r\n rRPOaUaOhmjoM6AJtgfL4N3MlIvgWcz02VNqj_G9GM8Pw.3b97vSNIAQxfNgaoJKNbyVp2ugBWe5\r\n GCbQyX9AB.nyWh6hX4ADzlJ8EkrQZRUwQXSTONckaYfeKoR6RPdczGIpaKMMghUVUWeEzL9ZUtUf\r\n n8I1VI33t4Lx0aU0Lg2b0k3AvuEMf01hsljU6VhGRwbuw7.HTW1ibJcdhhNymznfnPhVvK0Yos4J\r\n I2lguRWaEfRkm76DhoTiGNZkhIBY-\r\nX-Sonic-MF: <johnsmith@yahoo.com>\r\nX-Sonic-ID: 221dd87c-6ccb-4e96-8074-d332622b8b87\r\nReceived: from sonic.gate.mail.ne1.yahoo.com by sonic313.consmr.mail.ne1.yahoo.com with HTTP; Fri, 10 Nov 2023 09:11:08 +0000\r\nReceived: by hermes--production-ne1-56df75844-sgvl5 (Yahoo Inc. Hermes SMTP Server) with ESMTPA ID 24c441220d3992949f129e5823a987f8;\r\n          Fri, 10 Nov 2023 09:11:07 +0000 (UTC)\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\nFrom: <johnsmith@yahoo.com>\r\nMime-Version: 1.0 (1.0)\r\nSubject: Re: subject\r\nDate: Fri, 10 Nov 2023 01:10:56 -0800\r\nMessage-Id: <230A01FA-D0C6-4831-A454-FE5615AAA24A@yahoo.com>\r\nReferences: <65457bb0435d314ea86090d1@mailersend.net>\r\nIn-Reply-To: <65457bb0435d314ea86090d1@mailersend.net>\r\nTo: ben@domain.com\r\nX-Mailer: iPhone Mail (20G81)\r\nContent-Length: 84\r\n\r\nHello, world!\r\n\r\nOn Nov 3, 2023, at 16:01, ben@domain.com wrote:\r\n>=20\r\n> =EF=BB=BFTest\r\n\r\n"
@@ -56,6 +64,7 @@ func TestForwardEmail(t *testing.T) {
 	cfg := backend.Config{
 		Domain: "domain.com",
 	}
+	svc := emailsvc.NewEmailService(cfg, eRepo, nil, nil)
 	record := &kgo.Record{
 		Value: []byte(emailData),
 	}
@@ -79,19 +88,19 @@ func TestForwardEmail(t *testing.T) {
 	})).
 		Return(thread, nil)
 
-	// mailer.Send expectation; case response.StatusCode == 202
-	header := make(http.Header)
-	header.Add("X-Message-Id", mailerMsgId)
+	// mailer.Send expectation; case Message-Id unknown at send time
 	tMailer.On("Send", mock.Anything, mock.MatchedBy(func(outbound enmime.Envelope) bool {
 		return outbound.GetHeader("From") == fmt.Sprintf("%s %s <%s@%s>",
 			sender.FirstName, sender.LastName, "mailer", cfg.Domain) &&
 			outbound.GetHeader("To") == fmt.Sprintf("%s %s <%s>",
 				rcpt.FirstName, rcpt.LastName, rcpt.Email) &&
 			outbound.GetHeader("Subject") == "Re: subject" &&
+			strings.HasSuffix(outbound.GetHeader("Message-Id"), "@"+cfg.Domain+">") &&
 			outbound.Text == text
-	})).Return(&http.Response{
-		StatusCode: 202,
-		Header:     header,
+	})).Return(emailsvc.SendResult{
+		Provider:          "test",
+		ProviderMessageId: mailerMsgId,
+		Accepted:          []string{rcpt.Email},
 	}, nil)
 
 	// mailer.GetEmail expectation
@@ -100,18 +109,609 @@ func TestForwardEmail(t *testing.T) {
 	}
 	tMailer.On("GetEmail", mock.Anything, mailerMsgId).Return(email, nil)
 
+	// idempotency expectations
+	const inboundMsgId = "<230A01FA-D0C6-4831-A454-FE5615AAA24A@yahoo.com>"
+	eRepo.On("BeginInbound", mock.Anything, inboundMsgId, thread.Id).Return(emailsvc.InboundRecord{
+		MessageId: inboundMsgId,
+		ThreadId:  thread.Id,
+		Status:    emailsvc.InboundProcessing,
+	}, nil)
+	eRepo.On("UpdateInbound", mock.Anything, mock.MatchedBy(func(r emailsvc.InboundRecord) bool {
+		return r.Status == emailsvc.InboundSent && r.Email.MessageId == email.MessageId
+	})).Return(nil).Once()
+	eRepo.On("UpdateInbound", mock.Anything, mock.MatchedBy(func(r emailsvc.InboundRecord) bool {
+		return r.Status == emailsvc.InboundCompleted
+	})).Return(nil).Once()
+
 	// emailService.AddEmail expectation
-	eRepo.On("AddEmail", mock.Anything, thread.Id, email).Return(nil)
+	eRepo.On("AddEmail", mock.Anything, thread.Id, mock.MatchedBy(func(e emailsvc.Email) bool {
+		return e.MessageId == email.MessageId &&
+			e.From == "<johnsmith@yahoo.com>" &&
+			e.Subject == "Re: subject" &&
+			e.Text == text &&
+			e.ReplyText == "Hello, world!" &&
+			e.Headers["In-Reply-To"] == inReplyTo &&
+			len(e.To) == 1 && e.To[0] == fmt.Sprintf("\"%s %s\" <%s>",
+			rcpt.FirstName, rcpt.LastName, rcpt.Email)
+	})).Return(nil)
+
+	//
+	if err := svc.ForwardInboundEmail(context.Background(), tMailer, inbound); err != nil {
+		t.Fatal(err)
+	}
+
+	eRepo.AssertExpectations(t)
+	tMailer.AssertExpectations(t)
+
+	// duplicate is skipped without sending
+	dupRepo := new(emailRepo)
+	dupMailer := new(testMailer)
+	dupRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(thread, nil)
+	dupRepo.On("BeginInbound", mock.Anything, inboundMsgId, thread.Id).Return(emailsvc.InboundRecord{
+		MessageId: inboundMsgId,
+		ThreadId:  thread.Id,
+		Status:    emailsvc.InboundCompleted,
+	}, nil)
+	inbound, _ = enmime.ReadEnvelope(bytes.NewReader(record.Value))
+	err = emailsvc.NewEmailService(cfg, dupRepo, nil, nil).ForwardInboundEmail(
+		context.Background(), dupMailer, inbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupRepo.AssertExpectations(t)
+	dupMailer.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+}
+
+func TestForwardAttachments(t *testing.T) {
+	eRepo = new(emailRepo)
+	tMailer = new(testMailer)
+	blobs := &memBlobs{blobs: make(map[string][]byte)}
+	cfg := backend.Config{
+		Domain: "domain.com",
+		Email: backend.EmailConfig{
+			LinkOut:          backend.LinkOutConfig{Secret: "secret", BaseURL: "https://api.domain.com"},
+			ImageProxy:       "https://proxy.domain.com/?url=",
+			ImageProxySecret: "proxy-secret",
+		},
+	}
+	svc := emailsvc.NewEmailService(cfg, eRepo, nil, blobs)
+	mac := hmac.New(sha256.New, []byte("proxy-secret"))
+	mac.Write([]byte("https://t.co/p.gif"))
+	proxied := "https://proxy.domain.com/?url=https%3A%2F%2Ft.co%2Fp.gif&amp;sig=" +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	root, err := enmime.Builder().
+		From(sender.FirstName, sender.Email).
+		To("", "ben@domain.com").
+		Subject("Re: subject").
+		Header("In-Reply-To", "<a@domain.com>").
+		Text([]byte("see attached")).
+		HTML([]byte(`<p onclick="x()">see attached <img src="cid:logo"><img src="https://t.co/p.gif"></p><script>x()</script>`)).
+		AddAttachment([]byte("%PDF-1.4"), "application/pdf", "quote.pdf").
+		AddInline([]byte("png"), "image/png", "logo.png", "logo").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	inbound, err := enmime.ReadEnvelope(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread := emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{sender, rcpt},
+	}
+	eRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(thread, nil)
+	tMailer.On("Send", mock.Anything, mock.MatchedBy(func(outbound enmime.Envelope) bool {
+		return len(outbound.Attachments) == 1 && outbound.Attachments[0].FileName == "quote.pdf" &&
+			len(outbound.Inlines) == 1 && outbound.Inlines[0].ContentID == "logo" &&
+			outbound.HTML == `<p>see attached <img src="cid:logo"/><img src="`+proxied+`"/></p>`
+	})).Return(emailsvc.SendResult{
+		Provider:  "test",
+		MessageId: "<sent@domain.com>",
+		Accepted:  []string{rcpt.Email},
+	}, nil)
+	var sent emailsvc.Email
+	eRepo.On("AddEmail", mock.Anything, thread.Id, mock.MatchedBy(func(e emailsvc.Email) bool {
+		if len(e.Attachments) != 2 {
+			return false
+		}
+		sent = e
+		pdf, png := e.Attachments[0], e.Attachments[1]
+		// expiring links aren't stored
+		return pdf.FileName == "quote.pdf" && pdf.ContentType == "application/pdf" &&
+			pdf.Size == 8 && !pdf.Inline &&
+			string(blobs.blobs[pdf.Sha256]) == "%PDF-1.4" &&
+			png.Inline && png.ContentId == "logo" &&
+			string(blobs.blobs[png.Sha256]) == "png" &&
+			strings.Contains(e.HTML, `<img src="cid:logo"/>`)
+	})).Return(nil)
+
+	//
+	if err := svc.ForwardInboundEmail(context.Background(), tMailer, inbound); err != nil {
+		t.Fatal(err)
+	}
+
+	eRepo.AssertExpectations(t)
+	tMailer.AssertExpectations(t)
+
+	// inline images are linked when read
+	thread.Emails = []emailsvc.Email{sent}
+	eRepo = new(emailRepo)
+	eRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(thread, nil)
+	svc = emailsvc.NewEmailService(cfg, eRepo, nil, blobs)
+	ctrl := emailsvc.NewEmailController(cfg, svc, &tokenUsers{tokens: map[string]app.User{"rcpt": rcpt}})
+	r := httptest.NewRequest("POST", "/email/thread/search",
+		strings.NewReader(`{"threadId":"`+thread.Id.Hex()+`"}`))
+	r.Header.Set(app.AUTH_TOKEN_HEADER_KEY, "rcpt")
+	w := httptest.NewRecorder()
+	ctrl.ThreadSearch(w, r)
+	var got struct {
+		Emails []emailsvc.Email `json:"emails"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got.Emails) != 1 {
+		t.Fatalf("got %d %+v, %v", w.Code, got, err)
+	}
+	if !strings.Contains(got.Emails[0].HTML, `<img src="https://api.domain.com/email/thread/`+
+		thread.Id.Hex()+"/attachments/"+sent.Attachments[1].Sha256+"?") {
+		t.Errorf("inline image not linked: %s", got.Emails[0].HTML)
+	}
+	if thread.Emails[0].HTML != sent.HTML {
+		t.Errorf("stored email modified: %s", thread.Emails[0].HTML)
+	}
+
+	// internal lookups aren't linked
+	plain, appErr := svc.ThreadSearch(context.Background(), emailsvc.ThreadSearchTerms{ThreadId: thread.Id.Hex()})
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	if plain.Emails[0].HTML != sent.HTML {
+		t.Errorf("lookup linked inline images: %s", plain.Emails[0].HTML)
+	}
+}
+
+func TestAttachmentLinkOut(t *testing.T) {
+	eRepo = new(emailRepo)
+	tMailer = new(testMailer)
+	blobs := &memBlobs{blobs: make(map[string][]byte)}
+	cfg := backend.Config{
+		Domain: "domain.com",
+		Email: backend.EmailConfig{
+			LinkOut: backend.LinkOutConfig{
+				Threshold: 16,
+				Secret:    "secret",
+				BaseURL:   "https://api.domain.com",
+			},
+		},
+	}
+	svc := emailsvc.NewEmailService(cfg, eRepo, nil, blobs)
+
+	large := []byte(strings.Repeat("x", 32))
+	root, err := enmime.Builder().
+		From(sender.FirstName, sender.Email).
+		To("", "ben@domain.com").
+		Subject("Re: subject").
+		Header("In-Reply-To", "<a@domain.com>").
+		Text([]byte("see attached")).
+		AddAttachment([]byte("small"), "text/plain", "small.txt").
+		AddAttachment(large, "video/mp4", "large.mp4").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	inbound, err := enmime.ReadEnvelope(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thread := emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{sender, rcpt},
+	}
+	linkPrefix := fmt.Sprintf("https://api.domain.com/email/thread/%s/attachments/%s?",
+		thread.Id.Hex(), emailsvc.BlobDigest(large))
+	eRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(thread, nil).Once()
+	tMailer.On("Send", mock.Anything, mock.MatchedBy(func(outbound enmime.Envelope) bool {
+		return len(outbound.Attachments) == 1 && outbound.Attachments[0].FileName == "small.txt" &&
+			strings.Contains(outbound.Text, "large.mp4 (32 B): "+linkPrefix)
+	})).Return(emailsvc.SendResult{
+		Provider:  "test",
+		MessageId: "<sent@domain.com>",
+		Accepted:  []string{rcpt.Email},
+	}, nil)
+	var sent emailsvc.Email
+	eRepo.On("AddEmail", mock.Anything, thread.Id, mock.MatchedBy(func(e emailsvc.Email) bool {
+		sent = e
+		return len(e.Attachments) == 2 && e.Attachments[0].URL == "" &&
+			strings.HasPrefix(e.Attachments[1].URL, linkPrefix)
+	})).Return(nil)
 
 	//
-	if err := svc.ForwardInboundEmail(context.Background(), cfg, tMailer, inbound); err != nil {
+	if err := svc.ForwardInboundEmail(context.Background(), tMailer, inbound); err != nil {
+		t.Fatal(err)
+	}
+	eRepo.AssertExpectations(t)
+	tMailer.AssertExpectations(t)
+
+	// download
+	thread.Emails = []emailsvc.Email{sent}
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{ThreadId: thread.Id.Hex()}).
+		Return(thread, nil)
+	users := &tokenUsers{tokens: map[string]app.User{
+		"rcpt":     rcpt,
+		"outsider": keycloak.User{Email: "outsider@yahoo.com"},
+	}}
+	ctrl := emailsvc.NewEmailController(cfg, svc, users)
+	downloadAs := func(token, rawURL string) *httptest.ResponseRecorder {
+		u, _ := url.Parse(rawURL)
+		r := httptest.NewRequest("GET", u.RequestURI(), nil)
+		if token != "" {
+			r.Header.Set(app.AUTH_TOKEN_HEADER_KEY, token)
+		}
+		r.SetPathValue("threadId", thread.Id.Hex())
+		r.SetPathValue("sha256", emailsvc.BlobDigest(large))
+		w := httptest.NewRecorder()
+		ctrl.DownloadAttachment(w, r)
+		return w
+	}
+	download := func(rawURL string) *httptest.ResponseRecorder {
+		return downloadAs("rcpt", rawURL)
+	}
+	w := download(sent.Attachments[1].URL)
+	if w.Code != 200 || w.Body.String() != string(large) ||
+		w.Header().Get("Content-Type") != "video/mp4" {
+		t.Fatalf("got %d %v %q", w.Code, w.Header(), w.Body)
+	}
+	if w := download(sent.Attachments[1].URL + "x"); w.Code != 403 {
+		t.Errorf("forged link got %d, want 403", w.Code)
+	}
+	if w := downloadAs("", sent.Attachments[1].URL); w.Code != 401 {
+		t.Errorf("anonymous got %d, want 401", w.Code)
+	}
+	if w := downloadAs("expired", sent.Attachments[1].URL); w.Code != 401 {
+		t.Errorf("invalid token got %d, want 401", w.Code)
+	}
+	if w := downloadAs("outsider", sent.Attachments[1].URL); w.Code != 403 {
+		t.Errorf("non-participant got %d, want 403", w.Code)
+	}
+
+	// the recipient left the thread
+	eRepo = new(emailRepo)
+	eRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(emailsvc.EmailThread{
+		Id:           thread.Id,
+		Participants: []app.User{sender},
+		Emails:       thread.Emails,
+	}, nil)
+	svc = emailsvc.NewEmailService(cfg, eRepo, nil, blobs)
+	ctrl = emailsvc.NewEmailController(cfg, svc, users)
+	if w := download(sent.Attachments[1].URL); w.Code != 403 {
+		t.Errorf("removed participant got %d, want 403", w.Code)
+	}
+}
+
+func TestResolveThread(t *testing.T) {
+	eRepo = new(emailRepo)
+	cfg := backend.Config{
+		Domain: "domain.com",
+		Email:  backend.EmailConfig{SubjectFallback: true, ReplySecret: "secret"},
+	}
+	svc := emailsvc.NewEmailService(cfg, eRepo, nil, nil)
+	thread := emailsvc.EmailThread{
+		Id:      primitive.NewObjectID(),
+		Subject: "Kitchen remodel",
+	}
+	notFound := app.NewErr(404, "", "")
+
+	// reply address
+	replyTo := emailsvc.ReplyAddress(cfg, thread.Id, time.Now())
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{ThreadId: thread.Id.Hex()}).
+		Return(thread, nil).Once()
+	resolution, err := svc.ResolveThread(context.Background(), emailsvc.ThreadResolveTerms{
+		Recipients: []string{replyTo},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolution.Strategy != emailsvc.ResolvedByReplyAddress || resolution.Thread.Id != thread.Id {
+		t.Fatalf("got %#v", resolution)
+	}
+
+	// a forged reply address falls through to In-Reply-To
+	forged := strings.Replace(replyTo, "reply+", "reply+a", 1)
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{EmailMessageId: "<a>"}).
+		Return(thread, nil).Once()
+	resolution, err = svc.ResolveThread(context.Background(), emailsvc.ThreadResolveTerms{
+		Recipients: []string{forged},
+		InReplyTo:  "<a>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolution.Strategy != emailsvc.ResolvedByInReplyTo {
+		t.Fatalf("got %#v", resolution)
+	}
+
+	// References newest first, skipping In-Reply-To
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{EmailMessageId: "<c>"}).
+		Return(emailsvc.EmailThread{}, notFound).Once()
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{EmailMessageId: "<b>"}).
+		Return(thread, nil).Once()
+	resolution, err = svc.ResolveThread(context.Background(), emailsvc.ThreadResolveTerms{
+		InReplyTo:  "<c>",
+		References: []string{"<a>", "<b>", "<c>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolution.Strategy != emailsvc.ResolvedByReferences || resolution.Thread.Id != thread.Id {
+		t.Fatalf("got %#v", resolution)
+	}
+
+	// subject fallback
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{
+		Subject:          "Kitchen remodel",
+		ParticipantEmail: fromEmail,
+	}).Return(thread, nil).Once()
+	resolution, err = svc.ResolveThread(context.Background(), emailsvc.ThreadResolveTerms{
+		Subject: "RE: Fwd:  Kitchen   remodel",
+		From:    fromEmail,
+	})
+	if err != nil {
 		t.Fatal(err)
 	}
+	if resolution.Strategy != emailsvc.ResolvedBySubject {
+		t.Fatalf("got %#v", resolution)
+	}
+
+	// the controller only identifies the thread
+	thread.Emails = []emailsvc.Email{{MessageId: "<b>", Text: "private"}}
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{EmailMessageId: "<b>"}).
+		Return(thread, nil).Once()
+	w := httptest.NewRecorder()
+	emailsvc.NewEmailController(cfg, svc, nil).ThreadResolve(w, httptest.NewRequest(
+		"POST", "/email/thread/resolve", strings.NewReader(`{"inReplyTo":"<b>"}`)))
+	if want := `{"threadId":"` + thread.Id.Hex() + `","strategy":"inReplyTo"}`; w.Body.String() != want {
+		t.Fatalf("got %d %s, want %s", w.Code, w.Body, want)
+	}
+
+	// unresolved
+	_, err = svc.ResolveThread(context.Background(), emailsvc.ThreadResolveTerms{})
+	if err == nil || err.StatusCode() != 404 {
+		t.Fatalf("expected 404, got %v", err)
+	}
+
+	eRepo.AssertExpectations(t)
+}
+
+func TestInboundLease(t *testing.T) {
+	eRepo = new(emailRepo)
+	tMailer = new(testMailer)
+	cfg := backend.Config{
+		Domain:         "domain.com",
+		ReadTimeout:    time.Second,
+		RequestTimeout: time.Second,
+	}
+	svc := emailsvc.NewEmailService(cfg, eRepo, nil, nil)
+	thread := emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{sender, rcpt},
+	}
+	const inboundMsgId = "<reply@yahoo.com>"
+	raw := "From: John Smith <johnsmith@yahoo.com>\r\n" +
+		"To: ben@domain.com\r\n" +
+		"Subject: Re: subject\r\n" +
+		"Message-Id: " + inboundMsgId + "\r\n" +
+		"In-Reply-To: <first@domain.com>\r\n" +
+		"\r\n" +
+		"Hello, world!\r\n"
+	forward := func() app.Error {
+		inbound, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc.ForwardInboundEmail(context.Background(), tMailer, inbound)
+	}
+	eRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(thread, nil)
+
+	// another consumer holds the lease
+	eRepo.On("BeginInbound", mock.Anything, inboundMsgId, thread.Id).
+		Return(emailsvc.InboundRecord{}, app.NewErr(503, "", "")).Once()
+	if err := forward(); err == nil || err.StatusCode() != 503 {
+		t.Fatalf("expected 503, got %v", err)
+	}
+	tMailer.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+
+	// a failed send releases the lease
+	eRepo.On("BeginInbound", mock.Anything, inboundMsgId, thread.Id).Return(emailsvc.InboundRecord{
+		MessageId:   inboundMsgId,
+		ThreadId:    thread.Id,
+		Status:      emailsvc.InboundProcessing,
+		LeasedUntil: time.Now().Add(time.Minute),
+	}, nil).Once()
+	tMailer.On("Send", mock.Anything, mock.Anything).
+		Return(emailsvc.SendResult{}, app.NewErr(503, "", "")).Once()
+	eRepo.On("UpdateInbound", mock.Anything, mock.MatchedBy(func(r emailsvc.InboundRecord) bool {
+		return r.Status == emailsvc.InboundProcessing && r.LeasedUntil.IsZero()
+	})).Return(nil).Once()
+	if err := forward(); err == nil {
+		t.Fatal("expected send error")
+	}
 
 	eRepo.AssertExpectations(t)
 	tMailer.AssertExpectations(t)
 }
 
+func TestOutbox(t *testing.T) {
+	eRepo = new(emailRepo)
+	tMailer = new(testMailer)
+	outbox := &memOutbox{}
+	cfg := backend.Config{
+		Domain:         "domain.com",
+		ReadTimeout:    time.Second,
+		RequestTimeout: time.Second,
+	}
+	cfg.Email.Outbox.PollInterval = time.Millisecond
+	cfg.Email.Outbox.Backoff = time.Millisecond
+	svc := emailsvc.NewEmailService(cfg, eRepo, outbox, nil)
+
+	thread := emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{sender, rcpt},
+		Emails:       []emailsvc.Email{{MessageId: "<first@domain.com>"}},
+	}
+	const inboundMsgId = "<reply@yahoo.com>"
+	eRepo.On("ThreadSearch", mock.Anything, mock.Anything).Return(thread, nil)
+	eRepo.On("BeginInbound", mock.Anything, inboundMsgId, thread.Id).Return(emailsvc.InboundRecord{
+		MessageId: inboundMsgId,
+		ThreadId:  thread.Id,
+		Status:    emailsvc.InboundProcessing,
+	}, nil)
+	eRepo.On("UpdateInbound", mock.Anything, mock.MatchedBy(func(r emailsvc.InboundRecord) bool {
+		return r.Status == emailsvc.InboundCompleted
+	})).Return(nil).Twice()
+
+	// redelivery enqueues once
+	raw := "From: John Smith <johnsmith@yahoo.com>\r\n" +
+		"To: ben@domain.com\r\n" +
+		"Subject: Re: subject\r\n" +
+		"Message-Id: " + inboundMsgId + "\r\n" +
+		"In-Reply-To: <first@domain.com>\r\n" +
+		"\r\n" +
+		"Hello, world!\r\n"
+	for i := 0; i < 2; i++ {
+		inbound, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.ForwardInboundEmail(context.Background(), tMailer, inbound); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(outbox.msgs); n != 1 {
+		t.Fatalf("expected 1 queued email, got %d", n)
+	}
+	tMailer.AssertNotCalled(t, "Send", mock.Anything, mock.Anything)
+
+	// the dispatcher retries with the same Message-Id
+	messageIds := make(map[string]bool)
+	sendArg := mock.MatchedBy(func(outbound enmime.Envelope) bool {
+		messageIds[outbound.GetHeader("Message-Id")] = true
+		to, err := outbound.AddressList("To")
+		return err == nil && len(to) == 1 && to[0].Address == rcpt.Email
+	})
+	tMailer.On("Send", mock.Anything, sendArg).
+		Return(emailsvc.SendResult{}, app.NewErr(503, "", "")).Once()
+	tMailer.On("Send", mock.Anything, sendArg).Return(emailsvc.SendResult{
+		Provider:          "test",
+		ProviderMessageId: mailerMsgId,
+		Accepted:          []string{rcpt.Email},
+	}, nil).Once()
+	// the sent email is looked up again without resending it
+	tMailer.On("GetEmail", mock.Anything, mailerMsgId).
+		Return(emailsvc.Email{}, app.NewErr(404, "", "")).Once()
+	tMailer.On("GetEmail", mock.Anything, mailerMsgId).
+		Return(emailsvc.Email{MessageId: "<sent@domain.com>"}, nil).Once()
+	eRepo.On("AddEmail", mock.Anything, thread.Id, mock.MatchedBy(func(e emailsvc.Email) bool {
+		return e.MessageId == "<sent@domain.com>" && e.Provider == "test" &&
+			e.From == "John Smith <johnsmith@yahoo.com>"
+	})).Return(nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.DispatchOutbox(ctx, tMailer)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for outbox.status() != emailsvc.OutboxCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out dispatching, status %s", outbox.status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if len(messageIds) != 1 {
+		t.Fatalf("expected one Message-Id across attempts, got %v", messageIds)
+	}
+	if msg := outbox.msgs[0]; msg.Attempts != 2 || msg.Email.MessageId != "<sent@domain.com>" {
+		t.Fatalf("unexpected outbox message %+v", msg)
+	}
+	eRepo.AssertExpectations(t)
+	tMailer.AssertExpectations(t)
+}
+
+func TestSendThreadEmailKey(t *testing.T) {
+	outbox := &memOutbox{}
+	cfg := backend.Config{Domain: "domain.com", RequestTimeout: time.Second}
+	svc := emailsvc.NewEmailService(cfg, new(emailRepo), outbox, nil)
+	thread := emailsvc.EmailThread{Id: primitive.NewObjectID()}
+
+	// redelivered chat messages are rebuilt with a new Message-Id
+	for _, key := range []string{"chatMessages/0/1", "chatMessages/0/1", "chatMessages/0/2"} {
+		outbound, err := enmime.ReadEnvelope(strings.NewReader(
+			"From: mailer@domain.com\r\nTo: johnsmith@yahoo.com\r\n\r\nHello, world!\r\n",
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := svc.SendThreadEmail(context.Background(), tMailer, thread, outbound, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(outbox.msgs); n != 2 {
+		t.Fatalf("expected 2 queued emails, got %d", n)
+	}
+}
+
+func TestThreadSearchController(t *testing.T) {
+	eRepo = new(emailRepo)
+	thread := emailsvc.EmailThread{
+		Id:           primitive.NewObjectID(),
+		Participants: []app.User{sender, rcpt},
+	}
+	eRepo.On("ThreadSearch", mock.Anything, emailsvc.ThreadSearchTerms{ThreadId: thread.Id.Hex()}).
+		Return(thread, nil)
+	svc := emailsvc.NewEmailService(backend.Config{}, eRepo, nil, nil)
+	ctrl := emailsvc.NewEmailController(backend.Config{}, svc, &tokenUsers{tokens: map[string]app.User{
+		"rcpt":     rcpt,
+		"outsider": keycloak.User{Email: "outsider@yahoo.com"},
+	}})
+	searchAs := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/email/thread/search",
+			strings.NewReader(`{"threadId":"`+thread.Id.Hex()+`"}`))
+		if token != "" {
+			r.Header.Set(app.AUTH_TOKEN_HEADER_KEY, token)
+		}
+		w := httptest.NewRecorder()
+		ctrl.ThreadSearch(w, r)
+		return w
+	}
+
+	if w := searchAs("rcpt"); w.Code != 200 || !strings.Contains(w.Body.String(), thread.Id.Hex()) {
+		t.Errorf("participant got %d %q", w.Code, w.Body)
+	}
+	if w := searchAs(""); w.Code != 401 {
+		t.Errorf("anonymous got %d, want 401", w.Code)
+	}
+	if w := searchAs("expired"); w.Code != 401 {
+		t.Errorf("invalid token got %d, want 401", w.Code)
+	}
+	if w := searchAs("outsider"); w.Code != 403 {
+		t.Errorf("non-participant got %d, want 403", w.Code)
+	}
+}
+
 // mocks
 type emailRepo struct {
 	mock.Mock
@@ -142,6 +742,47 @@ func (s *emailRepo) AddEmail(
 	return nil
 }
 
+func (s *emailRepo) BeginInbound(
+	ctx context.Context,
+	messageId string,
+	threadId primitive.ObjectID,
+	_ time.Time,
+	_ time.Duration,
+) (emailsvc.InboundRecord, app.Error) {
+	args := s.Called(ctx, messageId, threadId)
+	err := args.Get(1)
+	if err != nil {
+		return args.Get(0).(emailsvc.InboundRecord), err.(app.Error)
+	}
+	return args.Get(0).(emailsvc.InboundRecord), nil
+}
+
+func (s *emailRepo) UpdateInbound(
+	ctx context.Context,
+	record emailsvc.InboundRecord,
+) app.Error {
+	args := s.Called(ctx, record)
+	err := args.Get(0)
+	if err != nil {
+		return err.(app.Error)
+	}
+	return nil
+}
+
+// tokenUsers authenticates users by their access token.
+type tokenUsers struct {
+	app.UserRepo
+	tokens map[string]app.User
+}
+
+func (u *tokenUsers) Me(_ context.Context, token string) (app.User, app.Error) {
+	usr, ok := u.tokens[token]
+	if !ok {
+		return nil, app.NewErr(401, "Unauthorized", "")
+	}
+	return usr, nil
+}
+
 type testMailer struct {
 	mock.Mock
 }
@@ -162,11 +803,91 @@ func (m *testMailer) GetEmail(
 func (m *testMailer) Send(
 	ctx context.Context,
 	env enmime.Envelope,
-) (*http.Response, app.Error) {
+) (emailsvc.SendResult, app.Error) {
 	args := m.Called(ctx, env)
 	err := args.Get(1)
 	if err != nil {
-		return args.Get(0).(*http.Response), err.(app.Error)
+		return args.Get(0).(emailsvc.SendResult), err.(app.Error)
+	}
+	return args.Get(0).(emailsvc.SendResult), nil
+}
+
+type memOutbox struct {
+	mu   sync.Mutex
+	msgs []emailsvc.OutboxMessage
+}
+
+func (o *memOutbox) EnqueueOutbox(_ context.Context, msg emailsvc.OutboxMessage) app.Error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range o.msgs {
+		if m.Key == msg.Key {
+			return nil
+		}
+	}
+	msg.Id = primitive.NewObjectID()
+	o.msgs = append(o.msgs, msg)
+	return nil
+}
+
+func (o *memOutbox) LeaseOutbox(
+	_ context.Context,
+	now time.Time,
+	lease time.Duration,
+) (emailsvc.OutboxMessage, app.Error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, m := range o.msgs {
+		if (m.Status == emailsvc.OutboxPending || m.Status == emailsvc.OutboxSent) &&
+			!m.NextAttemptAt.After(now) && !m.LeasedUntil.After(now) {
+			o.msgs[i].LeasedUntil = now.Add(lease)
+			return o.msgs[i], nil
+		}
+	}
+	return emailsvc.OutboxMessage{}, app.NewErr(404, "", "")
+}
+
+func (o *memOutbox) UpdateOutbox(_ context.Context, msg emailsvc.OutboxMessage) app.Error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, m := range o.msgs {
+		if m.Id == msg.Id {
+			msg.LeasedUntil = time.Time{}
+			o.msgs[i] = msg
+			return nil
+		}
+	}
+	return app.NewErr(404, "", "")
+}
+
+func (o *memOutbox) status() emailsvc.OutboxStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.msgs) == 0 {
+		return ""
+	}
+	return o.msgs[0].Status
+}
+
+type memBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (b *memBlobs) PutBlob(_ context.Context, content []byte) (string, app.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	digest := emailsvc.BlobDigest(content)
+	b.blobs[digest] = content
+	return digest, nil
+}
+
+func (b *memBlobs) OpenBlob(_ context.Context, digest string) (io.ReadCloser, app.Error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.blobs[digest]
+	if !ok {
+		return nil, app.NewErr(404, "", "")
 	}
-	return args.Get(0).(*http.Response), nil
+	return io.NopCloser(bytes.NewReader(content)), nil
 }
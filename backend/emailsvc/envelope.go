@@ -0,0 +1,85 @@
+package emailsvc
+
+import (
+	"bytes"
+	"net/mail"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// EncodeEnvelope renders payload as a MIME message with messageId. Headers are taken from
+// payload rather than its Root part, since edits to cloned envelopes don't update Root.
+func EncodeEnvelope(payload enmime.Envelope, messageId string) ([]byte, error) {
+	from, err := mail.ParseAddress(payload.GetHeader("From"))
+	if err != nil {
+		return nil, err
+	}
+	b := enmime.Builder().
+		From(from.Name, from.Address).
+		Subject(payload.GetHeader("Subject")).
+		Header("Message-Id", messageId)
+	lists := map[string]func(enmime.MailBuilder, []mail.Address) enmime.MailBuilder{
+		"To":       enmime.MailBuilder.ToAddrs,
+		"Cc":       enmime.MailBuilder.CCAddrs,
+		"Bcc":      enmime.MailBuilder.BCCAddrs,
+		"Reply-To": enmime.MailBuilder.ReplyToAddrs,
+	}
+	for h, set := range lists {
+		addrs, err := AddressList(payload, h)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) > 0 {
+			b = set(b, derefAddrs(addrs))
+		}
+	}
+	if date, err := payload.Date(); err == nil {
+		b = b.Date(date)
+	}
+	for _, h := range []string{"In-Reply-To", "References"} {
+		if v := payload.GetHeader(h); v != "" {
+			b = b.Header(h, v)
+		}
+	}
+	if payload.Text != "" {
+		b = b.Text([]byte(payload.Text))
+	}
+	if payload.HTML != "" {
+		b = b.HTML([]byte(payload.HTML))
+	}
+	for _, p := range payload.Attachments {
+		b = b.AddAttachment(p.Content, p.ContentType, p.FileName)
+	}
+	for _, p := range payload.Inlines {
+		b = b.AddInline(p.Content, p.ContentType, p.FileName, p.ContentID)
+	}
+	for _, p := range payload.OtherParts {
+		b = b.AddOtherPart(p.Content, p.ContentType, p.FileName, p.ContentID)
+	}
+
+	root, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// AddressList parses the address header h of payload, which may be absent.
+func AddressList(payload enmime.Envelope, h string) ([]*mail.Address, error) {
+	if payload.GetHeader(h) == "" {
+		return nil, nil
+	}
+	return payload.AddressList(h)
+}
+
+func derefAddrs(addrs []*mail.Address) []mail.Address {
+	res := make([]mail.Address, 0, len(addrs))
+	for _, a := range addrs {
+		res = append(res, *a)
+	}
+	return res
+}
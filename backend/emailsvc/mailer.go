@@ -2,14 +2,41 @@ package emailsvc
 
 import (
 	"context"
-	"net/http"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 
 	app "github.com/benjamonnguyen/opendoorchat"
 	"github.com/jhillyerd/enmime"
 )
 
 // Mailer provdes API to send and manage transactional emails.
+// Mailers should send the envelope's Message-Id if set and return it as SendResult.MessageId.
+// Mailers that assign their own, like MailerSend, leave it empty and the Message-Id
+// is looked up with GetEmail after every send.
 type Mailer interface {
-	Send(context.Context, enmime.Envelope) (*http.Response, app.Error)
+	Send(context.Context, enmime.Envelope) (SendResult, app.Error)
 	GetEmail(context.Context, string) (Email, app.Error)
 }
+
+// NewMessageId returns a random Message-Id on domain.
+func NewMessageId(domain string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(b), domain)
+}
+
+// SendResult describes a message accepted by a Mailer.
+type SendResult struct {
+	// Provider names the Mailer, e.g. "mailersend" or "smtp".
+	Provider string
+	// ProviderMessageId identifies the message to GetEmail.
+	ProviderMessageId string
+	// MessageId is the RFC 5322 Message-Id if known at send time, the one set on the
+	// envelope. It's empty if the Mailer assigned its own, to be looked up with GetEmail.
+	MessageId string
+	Accepted  []string
+	Rejected  []string
+	// Retryable reports whether Rejected recipients may be accepted on a later attempt.
+	Retryable bool
+}
@@ -0,0 +1,45 @@
+package emailsvc
+
+import (
+	"strconv"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	forwardDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "emailsvc",
+		Name:      "forward_duration_seconds",
+		Help:      "ForwardInboundEmail latency by status code, 200 if forwarded or skipped.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"code"})
+	deliveryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "emailsvc",
+		Name:      "inbound_delivery_latency_seconds",
+		Help:      "Time from the Date of inbound emails until they are forwarded.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 900, 3600},
+	})
+)
+
+func observeForward(start time.Time, err app.Error) {
+	code := 200
+	if err != nil {
+		code = err.StatusCode()
+	}
+	forwardDuration.WithLabelValues(strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
+
+// observeDelivery records the latency of a forwarded inbound email since its Date, if known.
+func observeDelivery(date time.Time) {
+	if date.IsZero() {
+		return
+	}
+	deliveryLatency.Observe(time.Since(date).Seconds())
+	log.Debug().Dur("timeSinceSent", time.Since(date)).Msg("forwarded inbound email")
+}
@@ -0,0 +1,247 @@
+package emailsvc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/httputil"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OutboxRepo persists outbound emails until they are sent and added to their thread.
+type OutboxRepo interface {
+	// EnqueueOutbox inserts msg unless a message with its Key exists.
+	EnqueueOutbox(context.Context, OutboxMessage) app.Error
+	// LeaseOutbox returns the next message due at now and leases it for lease.
+	// It returns 404 if none is due.
+	LeaseOutbox(ctx context.Context, now time.Time, lease time.Duration) (OutboxMessage, app.Error)
+	// UpdateOutbox saves the progress of a leased message and releases its lease.
+	UpdateOutbox(context.Context, OutboxMessage) app.Error
+}
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	// OutboxSent messages were sent but not yet added to their thread.
+	OutboxSent      OutboxStatus = "sent"
+	OutboxCompleted OutboxStatus = "completed"
+	// OutboxFailed messages were rejected or ran out of attempts.
+	OutboxFailed OutboxStatus = "failed"
+)
+
+// OutboxMessage is a queued outbound email of an EmailThread.
+type OutboxMessage struct {
+	Id primitive.ObjectID `bson:"_id,omitempty"`
+	// Key deduplicates enqueues, the inbound Message-Id of forwarded emails, the
+	// source of thread emails or else the outbound Message-Id.
+	Key      string             `bson:"key"`
+	ThreadId primitive.ObjectID `bson:"threadId"`
+	// From is the sender recorded on the Email, if other than the From of Raw.
+	From string `bson:"from,omitempty"`
+	// InboundDate is the Date of the forwarded inbound email, if any.
+	InboundDate time.Time `bson:"inboundDate,omitempty"`
+	// Raw is the MIME encoded outbound email. Bcc isn't rendered so it's kept apart.
+	Raw []byte   `bson:"raw"`
+	Bcc []string `bson:"bcc,omitempty"`
+	// Links are the attachments linked out of Raw, recorded on the Email once sent.
+	Links         []Attachment `bson:"links,omitempty"`
+	Status        OutboxStatus `bson:"status"`
+	Attempts      int          `bson:"attempts"`
+	NextAttemptAt time.Time    `bson:"nextAttemptAt"`
+	LeasedUntil   time.Time    `bson:"leasedUntil"`
+	LastError     string       `bson:"lastError,omitempty"`
+	// Email is the sent email, set once Status is OutboxSent.
+	Email     *Email    `bson:"email,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+// enqueue queues outbound for the thread of msg instead of sending it right away.
+// The Message-Id is assigned here so the message is sent with it on every attempt.
+func (s *emailService) enqueue(
+	ctx context.Context,
+	msg OutboxMessage,
+	outbound *enmime.Envelope,
+) app.Error {
+	const op = "enqueue"
+	messageId := strings.TrimSpace(outbound.GetHeader("Message-Id"))
+	if messageId == "" {
+		messageId = NewMessageId(s.cfg.Domain)
+	}
+	if msg.Key == "" {
+		msg.Key = messageId
+	}
+	raw, e := EncodeEnvelope(*outbound, messageId)
+	if e != nil {
+		return app.FromErr(e, fmt.Sprintf("%s: EncodeEnvelope", op))
+	}
+	var bcc []string
+	if addrs, e := AddressList(*outbound, "Bcc"); e == nil {
+		for _, addr := range addrs {
+			bcc = append(bcc, addr.String())
+		}
+	}
+
+	now := time.Now()
+	enqueueCtx, enqueueCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer enqueueCanc()
+	msg.Raw = raw
+	msg.Bcc = bcc
+	msg.Status = OutboxPending
+	msg.NextAttemptAt = now
+	msg.CreatedAt = now
+	msg.UpdatedAt = now
+	if err := s.outbox.EnqueueOutbox(enqueueCtx, msg); err != nil {
+		err = app.FromErr(err, op)
+		log.Error().Err(err).Send()
+		return err
+	}
+	log.Debug().Str("key", msg.Key).Str("messageId", messageId).Msg("enqueued outbound email")
+	return nil
+}
+
+// DispatchOutbox sends queued emails through m and adds them to their thread
+// until ctx is done. Dispatchers in several processes share the outbox by lease.
+func (s *emailService) DispatchOutbox(ctx context.Context, m Mailer) {
+	cfg := s.outboxConfig()
+	for {
+		leaseCtx, leaseCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+		msg, err := s.outbox.LeaseOutbox(leaseCtx, time.Now(), cfg.Lease)
+		leaseCanc()
+		if err == nil {
+			s.dispatch(ctx, m, msg)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err.StatusCode() != http.StatusNotFound {
+			log.Error().Err(app.FromErr(err, "DispatchOutbox")).Send()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+// dispatch advances msg by one attempt, sending it if pending
+// and then adding the sent Email to its thread.
+func (s *emailService) dispatch(ctx context.Context, m Mailer, msg OutboxMessage) {
+	const op = "dispatch"
+	if msg.Status != OutboxSent {
+		env, e := enmime.ReadEnvelope(bytes.NewReader(msg.Raw))
+		if e != nil {
+			msg.Status = OutboxFailed
+			msg.LastError = e.Error()
+			s.updateOutbox(ctx, msg)
+			return
+		}
+		if len(msg.Bcc) > 0 {
+			env.SetHeader("Bcc", []string{strings.Join(msg.Bcc, ", ")})
+		}
+		email, err := s.send(ctx, m, env)
+		if err != nil {
+			s.retryOutbox(ctx, msg, app.FromErr(err, op))
+			return
+		}
+		observeDelivery(msg.InboundDate)
+		if msg.From != "" {
+			email.From = msg.From
+		}
+		email.Attachments = append(email.Attachments, msg.Links...)
+		msg.Status = OutboxSent
+		msg.Email = &email
+		msg.LastError = ""
+		// a failed update resends the email, so adding it to the thread takes precedence
+		s.updateOutbox(ctx, msg)
+	} else if msg.Email.MessageId == "" && msg.Email.ProviderMessageId != "" {
+		s.lookupMessageId(ctx, m, msg.Email)
+	}
+
+	// the Mailer may not know the sent email yet, so it's looked up again on later
+	// attempts and added to its thread without a Message-Id on the last one
+	if msg.Email.MessageId == "" && msg.Email.ProviderMessageId != "" &&
+		msg.Attempts+1 < s.outboxConfig().MaxAttempts {
+		s.retryOutbox(ctx, msg, app.NewErr(http.StatusServiceUnavailable, "",
+			fmt.Sprintf("%s: Message-Id of %s not found", op, msg.Email.ProviderMessageId)))
+		return
+	}
+
+	if err := s.addEmail(ctx, msg.ThreadId, *msg.Email); err != nil {
+		s.retryOutbox(ctx, msg, app.FromErr(err, op))
+		return
+	}
+	msg.Status = OutboxCompleted
+	msg.LastError = ""
+	s.updateOutbox(ctx, msg)
+	log.Debug().Str("key", msg.Key).Str("messageId", msg.Email.MessageId).Msg("dispatched outbound email")
+}
+
+// retryOutbox schedules the next attempt of msg with exponential backoff,
+// or fails it if err isn't retryable or it's out of attempts.
+func (s *emailService) retryOutbox(ctx context.Context, msg OutboxMessage, err app.Error) {
+	cfg := s.outboxConfig()
+	msg.Attempts++
+	msg.LastError = err.Error()
+	if !RetryableStatus(err.StatusCode()) || msg.Attempts >= cfg.MaxAttempts {
+		msg.Status = OutboxFailed
+		log.Error().Err(err).Str("key", msg.Key).Int("attempts", msg.Attempts).Msg("failed outbound email")
+	} else {
+		backoff := httputil.ExponentialBackoff(httputil.ExponentialBackoffConfigs{
+			Rate:     2,
+			Interval: cfg.Backoff,
+			Max:      cfg.MaxBackoff,
+		}, msg.Attempts-1)
+		msg.NextAttemptAt = time.Now().Add(backoff)
+		log.Warn().Err(err).Str("key", msg.Key).Dur("backoff", backoff).Msg("retrying outbound email")
+	}
+	s.updateOutbox(ctx, msg)
+}
+
+// outboxConfig returns the OutboxConfig with defaults set.
+func (s *emailService) outboxConfig() backend.OutboxConfig {
+	cfg := s.cfg.Email.Outbox
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = time.Minute
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 20
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Hour
+	}
+	return cfg
+}
+
+// updateOutbox saves msg. On failure the lease expires and the attempt is repeated.
+func (s *emailService) updateOutbox(ctx context.Context, msg OutboxMessage) {
+	msg.UpdatedAt = time.Now()
+	updateCtx, updateCanc := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer updateCanc()
+	if err := s.outbox.UpdateOutbox(updateCtx, msg); err != nil {
+		log.Error().Err(app.FromErr(err, "updateOutbox")).Str("key", msg.Key).Send()
+	}
+}
+
+// RetryableStatus reports whether a send that failed with code may succeed later,
+// or through another Mailer.
+func RetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
@@ -0,0 +1,104 @@
+package emailsvc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reply addresses look like reply+<token>@domain where token is the base32
+// encoding of threadId (12 bytes) | expiry unix seconds (8 bytes) | truncated HMAC-SHA256.
+const (
+	replyAddressPrefix = "reply+"
+	replyTokenMacLen   = 12
+	replyTokenLen      = 12 + 8 + replyTokenMacLen
+)
+
+var replyTokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ReplyAddress returns the signed reply address of the EmailThread,
+// or "" if reply addresses are disabled.
+func ReplyAddress(cfg backend.Config, threadId primitive.ObjectID, now time.Time) string {
+	if cfg.Email.ReplySecret == "" {
+		return ""
+	}
+
+	var expiry int64
+	if cfg.Email.ReplyTokenTTL > 0 {
+		expiry = now.Add(cfg.Email.ReplyTokenTTL).Unix()
+	}
+	token := make([]byte, 0, replyTokenLen)
+	token = append(token, threadId[:]...)
+	token = binary.BigEndian.AppendUint64(token, uint64(expiry))
+	token = append(token, replyTokenMac(cfg.Email.ReplySecret, token)...)
+
+	return fmt.Sprintf("%s%s@%s",
+		replyAddressPrefix,
+		strings.ToLower(replyTokenEncoding.EncodeToString(token)),
+		cfg.Domain,
+	)
+}
+
+// IsReplyAddress reports whether addr has the reply+<token> local part.
+func IsReplyAddress(addr string) bool {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+	return strings.HasPrefix(strings.ToLower(addr), replyAddressPrefix)
+}
+
+// ParseReplyAddress verifies a reply address created by ReplyAddress and returns its thread id.
+// Forged, foreign and expired addresses are rejected with 403.
+func ParseReplyAddress(
+	cfg backend.Config,
+	addr string,
+	now time.Time,
+) (primitive.ObjectID, app.Error) {
+	if cfg.Email.ReplySecret == "" {
+		return primitive.NilObjectID, app.NewErr(403, "", "reply addresses are disabled")
+	}
+	if a, err := mail.ParseAddress(addr); err == nil {
+		addr = a.Address
+	}
+	local, domain, _ := strings.Cut(strings.ToLower(addr), "@")
+	if !strings.HasPrefix(local, replyAddressPrefix) {
+		return primitive.NilObjectID, app.NewErr(400, "", "not a reply address")
+	}
+	if !strings.EqualFold(domain, cfg.Domain) {
+		return primitive.NilObjectID, app.NewErr(403, "", "foreign reply address")
+	}
+
+	token, err := replyTokenEncoding.DecodeString(
+		strings.ToUpper(strings.TrimPrefix(local, replyAddressPrefix)),
+	)
+	if err != nil || len(token) != replyTokenLen {
+		return primitive.NilObjectID, app.NewErr(403, "", "malformed reply token")
+	}
+	payload, mac := token[:replyTokenLen-replyTokenMacLen], token[replyTokenLen-replyTokenMacLen:]
+	if !hmac.Equal(mac, replyTokenMac(cfg.Email.ReplySecret, payload)) {
+		return primitive.NilObjectID, app.NewErr(403, "", "forged reply token")
+	}
+	expiry := int64(binary.BigEndian.Uint64(payload[12:]))
+	if expiry != 0 && now.Unix() > expiry {
+		return primitive.NilObjectID, app.NewErr(403, "", "expired reply token")
+	}
+
+	var threadId primitive.ObjectID
+	copy(threadId[:], payload[:12])
+	return threadId, nil
+}
+
+func replyTokenMac(secret string, payload []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(payload)
+	return h.Sum(nil)[:replyTokenMacLen]
+}
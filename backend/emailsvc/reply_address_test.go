@@ -0,0 +1,62 @@
+package emailsvc_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReplyAddress(t *testing.T) {
+	cfg := backend.Config{
+		Domain: "domain.com",
+		Email: backend.EmailConfig{
+			ReplySecret:   "secret",
+			ReplyTokenTTL: time.Hour,
+		},
+	}
+	now := time.Now()
+	threadId := primitive.NewObjectID()
+
+	addr := emailsvc.ReplyAddress(cfg, threadId, now)
+	if !strings.HasPrefix(addr, "reply+") || !strings.HasSuffix(addr, "@domain.com") {
+		t.Fatalf("unexpected reply address %s", addr)
+	}
+	if local, _, _ := strings.Cut(addr, "@"); len(local) > 64 {
+		t.Fatalf("local part exceeds 64 characters: %s", local)
+	}
+
+	// round trip, case insensitive and with display name
+	for _, a := range []string{addr, strings.ToUpper(addr), "Ben <" + addr + ">"} {
+		got, err := emailsvc.ParseReplyAddress(cfg, a, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != threadId {
+			t.Fatalf("expected %s, got %s", threadId.Hex(), got.Hex())
+		}
+	}
+
+	// expired
+	if _, err := emailsvc.ParseReplyAddress(cfg, addr, now.Add(2*time.Hour)); err == nil {
+		t.Fatal("expected expired reply address to be rejected")
+	}
+
+	// forged
+	forgedCfg := cfg
+	forgedCfg.Email.ReplySecret = "guess"
+	forged := emailsvc.ReplyAddress(forgedCfg, threadId, now)
+	if _, err := emailsvc.ParseReplyAddress(cfg, forged, now); err == nil ||
+		err.StatusCode() != 403 {
+		t.Fatalf("expected 403 for forged reply address, got %v", err)
+	}
+
+	// foreign domain
+	foreign := strings.Replace(addr, "domain.com", "other.com", 1)
+	if _, err := emailsvc.ParseReplyAddress(cfg, foreign, now); err == nil {
+		t.Fatal("expected foreign reply address to be rejected")
+	}
+}
@@ -0,0 +1,212 @@
+package replyparse
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ParseHTML splits a text/html body into HTML fragments of the contents of its <body>.
+func ParseHTML(s string) (Reply, error) {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return Reply{}, err
+	}
+	body := find(doc, func(n *html.Node) bool { return n.DataAtom == atom.Body })
+	if body == nil {
+		return Reply{}, nil
+	}
+
+	var reply Reply
+	if n := find(body, isQuote); n != nil {
+		reply.Quoted = render(detachFrom(withQuoteHeader(n), body))
+	}
+	if n := find(body, isSignature); n != nil {
+		reply.Signature = render(detachFrom(n, body))
+	} else if n := lastText(body); n != nil && mobileFooter.MatchString(n.Data) {
+		if n.Parent != body {
+			n = n.Parent
+		}
+		reply.Signature = render(detachFrom(n, body))
+	}
+	var children []*html.Node
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		children = append(children, c)
+	}
+	reply.Body = render(children)
+	return reply, nil
+}
+
+// isQuote reports whether n starts the quoted history, either a quote container or
+// an "On ... wrote:" header directly followed by one. The header alone isn't enough
+// since the reply itself may have a line like it.
+func isQuote(n *html.Node) bool {
+	switch {
+	// Apple Mail, as other blockquotes may quote within the reply
+	case n.DataAtom == atom.Blockquote:
+		return attr(n, "type") == "cite"
+	case isQuoteContainer(n):
+		return true
+	}
+	if n.Type != html.TextNode && n.Type != html.ElementNode {
+		return false
+	}
+	return onWrote.MatchString(textContent(n)) && isQuoteContainer(nextSignificant(n))
+}
+
+// isQuoteContainer reports whether n wraps quoted history by the markup of a mail client.
+func isQuoteContainer(n *html.Node) bool {
+	if n == nil || n.Type != html.ElementNode {
+		return false
+	}
+	class, id := attr(n, "class"), attr(n, "id")
+	switch {
+	case n.DataAtom == atom.Blockquote:
+		return true
+	// Gmail
+	case strings.Contains(class, "gmail_quote"):
+		return true
+	// Yahoo
+	case strings.Contains(class, "yahoo_quoted") || strings.Contains(id, "yahoo_quoted"):
+		return true
+	// Outlook on the web and mobile, then desktop
+	case id == "divRplyFwdMsg" || id == "appendonsend" || id == "mail-editor-reference-message-container":
+		return true
+	case strings.Contains(strings.ReplaceAll(attr(n, "style"), " ", ""), "border-top:solid#E1E1E1"):
+		return true
+	}
+	return false
+}
+
+// isSignature reports whether n is a signature added by a mail client.
+func isSignature(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	class, id := attr(n, "class"), attr(n, "id")
+	return strings.Contains(class, "gmail_signature") ||
+		attr(n, "data-smartmail") == "gmail_signature" ||
+		id == "Signature" ||
+		id == "AppleMailSignature" ||
+		strings.Contains(id, "ymail_android_signature") ||
+		strings.Contains(class, "ymail_android_signature") ||
+		strings.Contains(id, "ymail_ios_signature")
+}
+
+// withQuoteHeader extends a quote to its header preceding it, e.g. the
+// "On ... wrote:" line of Apple Mail or the rule above an Outlook reply.
+func withQuoteHeader(n *html.Node) *html.Node {
+	for prev := prevSignificant(n); prev != nil; prev = prevSignificant(n) {
+		if prev.DataAtom == atom.Hr || onWrote.MatchString(textContent(prev)) {
+			n = prev
+			continue
+		}
+		break
+	}
+	return n
+}
+
+// nextSignificant returns the node following n in document order, skipping blank
+// text and line breaks, or its parent's if n is the last of its siblings.
+func nextSignificant(n *html.Node) *html.Node {
+	for ; n != nil; n = n.Parent {
+		for next := n.NextSibling; next != nil; next = next.NextSibling {
+			if next.Type == html.TextNode && strings.TrimSpace(next.Data) == "" || next.DataAtom == atom.Br {
+				continue
+			}
+			if next.Type == html.TextNode || next.Type == html.ElementNode {
+				return next
+			}
+		}
+		if n.Parent != nil && n.Parent.DataAtom == atom.Body {
+			return nil
+		}
+	}
+	return nil
+}
+
+func prevSignificant(n *html.Node) *html.Node {
+	for prev := n.PrevSibling; prev != nil; prev = prev.PrevSibling {
+		if prev.Type == html.TextNode && strings.TrimSpace(prev.Data) == "" || prev.DataAtom == atom.Br {
+			continue
+		}
+		if prev.Type == html.TextNode || prev.Type == html.ElementNode {
+			return prev
+		}
+	}
+	return nil
+}
+
+// detachFrom removes n and every node after it in document order from root.
+func detachFrom(n, root *html.Node) []*html.Node {
+	var res []*html.Node
+	for cur := n; cur != root && cur.Parent != nil; {
+		parent := cur.Parent
+		next := cur.NextSibling
+		if cur == n {
+			next = cur
+		}
+		for next != nil {
+			sib := next.NextSibling
+			parent.RemoveChild(next)
+			res = append(res, next)
+			next = sib
+		}
+		cur = parent
+	}
+	return res
+}
+
+// find returns the first node under n in document order satisfying match.
+func find(n *html.Node, match func(*html.Node) bool) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if match(c) {
+			return c
+		}
+		if found := find(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func lastText(n *html.Node) *html.Node {
+	for c := n.LastChild; c != nil; c = c.PrevSibling {
+		if c.Type == html.TextNode && strings.TrimSpace(c.Data) != "" {
+			return c
+		}
+		if found := lastText(c); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func render(nodes []*html.Node) string {
+	var sb strings.Builder
+	for _, n := range nodes {
+		html.Render(&sb, n)
+	}
+	return strings.TrimSpace(sb.String())
+}
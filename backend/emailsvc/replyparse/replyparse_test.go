@@ -0,0 +1,167 @@
+package replyparse_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc/replyparse"
+)
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		name, text string
+		want       replyparse.Reply
+	}{
+		{
+			name: "apple mail",
+			text: "Hello, world!\r\n\r\nOn Nov 3, 2023, at 16:01, ben@domain.com wrote:\r\n>\r\n> Test\r\n\r\n",
+			want: replyparse.Reply{
+				Body:   "Hello, world!",
+				Quoted: "On Nov 3, 2023, at 16:01, ben@domain.com wrote:\n>\n> Test",
+			},
+		},
+		{
+			name: "gmail wrapped header with signature",
+			text: "Sounds good.\n\n-- \nJohn Smith\nSmith Renovations\n\nOn Fri, Nov 10, 2023 at 1:10 AM Ben N <\nben@domain.com> wrote:\n\n> Test\n",
+			want: replyparse.Reply{
+				Body:      "Sounds good.",
+				Signature: "-- \nJohn Smith\nSmith Renovations",
+				Quoted:    "On Fri, Nov 10, 2023 at 1:10 AM Ben N <\nben@domain.com> wrote:\n\n> Test",
+			},
+		},
+		{
+			name: "outlook",
+			text: "See you then\r\n\r\nGet Outlook for iOS\r\n________________________________\r\nFrom: Ben N <ben@domain.com>\r\nSent: Friday, November 10, 2023 1:10 AM\r\nTo: John Smith <johnsmith@outlook.com>\r\nSubject: Kitchen remodel\r\n\r\nTest\r\n",
+			want: replyparse.Reply{
+				Body:      "See you then",
+				Signature: "Get Outlook for iOS",
+				Quoted:    "________________________________\nFrom: Ben N <ben@domain.com>\nSent: Friday, November 10, 2023 1:10 AM\nTo: John Smith <johnsmith@outlook.com>\nSubject: Kitchen remodel\n\nTest",
+			},
+		},
+		{
+			name: "yahoo",
+			text: "Thanks!\n\nSent from Yahoo Mail for iPhone\n\n\nOn Friday, November 10, 2023, 1:10 AM, Ben N <ben@domain.com> wrote:\n\nTest\n",
+			want: replyparse.Reply{
+				Body:      "Thanks!",
+				Signature: "Sent from Yahoo Mail for iPhone",
+				Quoted:    "On Friday, November 10, 2023, 1:10 AM, Ben N <ben@domain.com> wrote:\n\nTest",
+			},
+		},
+		{
+			name: "original message separator",
+			text: "Yes\n\n-----Original Message-----\nFrom: Ben N\n",
+			want: replyparse.Reply{
+				Body:   "Yes",
+				Quoted: "-----Original Message-----\nFrom: Ben N",
+			},
+		},
+		{
+			name: "interleaved quotes are kept",
+			text: "> Can you do Monday?\nYes\n> And Tuesday?\nNo\n\nSent from my iPhone",
+			want: replyparse.Reply{
+				Body:      "> Can you do Monday?\nYes\n> And Tuesday?\nNo",
+				Signature: "Sent from my iPhone",
+			},
+		},
+		{
+			name: "on wrote without quotes",
+			text: "Quick update.\n\nOn Monday Sarah wrote:\nthe tiles are in, so we can start Tuesday.\n\nThanks",
+			want: replyparse.Reply{
+				Body: "Quick update.\n\nOn Monday Sarah wrote:\nthe tiles are in, so we can start Tuesday.\n\nThanks",
+			},
+		},
+		{
+			name: "on wrote with quotes",
+			text: "Agreed.\n\nOn Monday Sarah wrote:\n> the tiles are in\n",
+			want: replyparse.Reply{
+				Body:   "Agreed.",
+				Quoted: "On Monday Sarah wrote:\n> the tiles are in",
+			},
+		},
+		{
+			name: "new content only",
+			text: "From: the office\nWe sent from my team yesterday",
+			want: replyparse.Reply{
+				Body: "From: the office\nWe sent from my team yesterday",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyparse.ParseText(tt.text); got != tt.want {
+				t.Errorf("got %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHTML(t *testing.T) {
+	tests := []struct {
+		name, html                string
+		body, signature, quoteHas string
+		bodyLacks                 []string
+	}{
+		{
+			name:      "gmail",
+			html:      `<div dir="ltr">Sounds good<div><br></div><span class="gmail_signature_prefix">-- </span><div dir="ltr" class="gmail_signature">John</div></div><br><div class="gmail_quote"><div dir="ltr" class="gmail_attr">On Fri, Nov 10, 2023 at 1:10 AM Ben N &lt;ben@domain.com&gt; wrote:<br></div><blockquote class="gmail_quote">Test</blockquote></div>`,
+			body:      `<div dir="ltr">Sounds good<div><br/></div></div>`,
+			signature: `<span class="gmail_signature_prefix">-- </span><div dir="ltr" class="gmail_signature">John</div><br/>`,
+			quoteHas:  "gmail_attr",
+		},
+		{
+			name:      "apple mail",
+			html:      `<html><head></head><body dir="auto">Hello, world!<br id="lineBreakAtBeginningOfSignature"><div dir="ltr">Sent from my iPhone</div><div dir="ltr"><br><blockquote type="cite">On Nov 3, 2023, at 16:01, ben@domain.com wrote:<br><br></blockquote></div><blockquote type="cite"><div dir="ltr">Test</div></blockquote></body></html>`,
+			body:      `Hello, world!<br id="lineBreakAtBeginningOfSignature"/>`,
+			signature: `<div dir="ltr">Sent from my iPhone</div>`,
+			quoteHas:  "wrote:",
+		},
+		{
+			name:      "outlook",
+			html:      `<div>See you then</div><div id="Signature">John</div><div id="appendonsend"></div><hr style="display:inline-block;width:98%"><div id="divRplyFwdMsg"><b>From:</b> Ben N</div><div>Test</div>`,
+			body:      `<div>See you then</div>`,
+			signature: `<div id="Signature">John</div>`,
+			quoteHas:  "divRplyFwdMsg",
+			bodyLacks: []string{"<hr"},
+		},
+		{
+			name:      "yahoo",
+			html:      `<div class="ydp1"><div>Thanks!</div></div><div id="ymail_android_signature"><a>Sent from Yahoo Mail on Android</a></div><div id="yahoo_quoted_123" class="yahoo_quoted"><div>On Fri, Nov 10, 2023 at 1:10, Ben N wrote:</div><div>Test</div></div>`,
+			body:      `<div class="ydp1"><div>Thanks!</div></div>`,
+			signature: `<div id="ymail_android_signature"><a>Sent from Yahoo Mail on Android</a></div>`,
+			quoteHas:  "Test",
+		},
+		{
+			name:     "header followed by blockquote",
+			html:     `<p>Works for me</p><div>On Mon, Nov 13, 2023, Ben N wrote:</div><br><blockquote>Test</blockquote>`,
+			body:     `<p>Works for me</p>`,
+			quoteHas: "wrote:",
+		},
+		{
+			name: "header without quote",
+			html: `<p>Here are my notes.</p><p>On Monday the report I wrote:</p><p>needs a review</p>`,
+			body: `<p>Here are my notes.</p><p>On Monday the report I wrote:</p><p>needs a review</p>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := replyparse.ParseHTML(tt.html)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Body != tt.body {
+				t.Errorf("Body got %s\nwant %s", got.Body, tt.body)
+			}
+			if got.Signature != tt.signature {
+				t.Errorf("Signature got %s\nwant %s", got.Signature, tt.signature)
+			}
+			if !strings.Contains(got.Quoted, tt.quoteHas) {
+				t.Errorf("Quoted %s\nmissing %s", got.Quoted, tt.quoteHas)
+			}
+			for _, s := range tt.bodyLacks {
+				if strings.Contains(got.Body, s) {
+					t.Errorf("Body %s\ncontains %s", got.Body, s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Package replyparse splits inbound email bodies into what the sender wrote,
+// their signature and the quoted history of the thread.
+package replyparse
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Reply is an email body split into its parts. Joining them restores the body
+// up to whitespace.
+type Reply struct {
+	// Body is the new content written by the sender.
+	Body      string
+	Signature string
+	// Quoted is the quoted history, starting at its quote header if any.
+	Quoted string
+}
+
+var (
+	// onWrote matches the quote headers of Gmail, Apple Mail and Yahoo, e.g.
+	// "On Nov 3, 2023, at 16:01, ben@domain.com wrote:".
+	onWrote      = regexp.MustCompile(`(?i)^\s*on\b.{5,300}\bwrote:\s*$`)
+	emailAddress = regexp.MustCompile(`[^\s<>@]+@[^\s<>@]+\.[^\s<>@]+`)
+	// originalMessage matches the separators of Outlook and Yahoo.
+	originalMessage = regexp.MustCompile(`(?i)^\s*-{2,}\s*original message\s*-{2,}\s*$`)
+	// outlookRule precedes the From/Sent header block of Outlook.
+	outlookRule  = regexp.MustCompile(`^\s*_{10,}\s*$`)
+	headerFrom   = regexp.MustCompile(`(?i)^\s*\*?from:\*?\s`)
+	headerSentAt = regexp.MustCompile(`(?i)^\s*\*?(sent|date):\*?\s`)
+	// mobileFooter matches the default signatures of mobile mail apps.
+	mobileFooter = regexp.MustCompile(
+		`(?i)^\s*(sent from (my \S.*|yahoo mail.*|mail for windows.*|outlook for (ios|android).*)` +
+			`|get outlook for (ios|android).*)$`,
+	)
+)
+
+// ParseText splits a text/plain body.
+func ParseText(text string) Reply {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	quoteAt := quoteStart(lines)
+	body, quoted := lines[:quoteAt], lines[quoteAt:]
+	sigAt := signatureStart(body)
+	body, sig := body[:sigAt], body[sigAt:]
+
+	return Reply{
+		Body:      strings.TrimSpace(strings.Join(body, "\n")),
+		Signature: strings.TrimSpace(strings.Join(sig, "\n")),
+		Quoted:    strings.TrimSpace(strings.Join(quoted, "\n")),
+	}
+}
+
+// quoteStart returns the index of the first line of the quoted history, or len(lines).
+func quoteStart(lines []string) int {
+	for i, line := range lines {
+		switch {
+		case onWrote.MatchString(line) && quotesFollow(lines, i, i+1):
+			return i
+		case i+1 < len(lines) && onWrote.MatchString(line+" "+lines[i+1]) &&
+			strings.HasPrefix(strings.TrimSpace(line), "On ") && quotesFollow(lines, i, i+2):
+			// Gmail wraps long headers
+			return i
+		case originalMessage.MatchString(line):
+			return i
+		case headerFrom.MatchString(line) && outlookHeaders(lines[i+1:]):
+			if j := prevNonBlank(lines, i); j >= 0 && outlookRule.MatchString(lines[j]) {
+				return j
+			}
+			return i
+		}
+	}
+
+	// a trailing block of "> " lines without a header
+	start := len(lines)
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, ">") {
+			break
+		}
+		start = i
+	}
+	return start
+}
+
+// quotesFollow reports whether the "On … wrote:" header lines[i:j] introduces quoted
+// history rather than being new content like "On Monday Sarah wrote:". Mail clients
+// follow it with "> " lines or a header block, or name the quoted sender's address.
+func quotesFollow(lines []string, i, j int) bool {
+	if emailAddress.MatchString(strings.Join(lines[i:j], " ")) {
+		return true
+	}
+	if k := nextNonBlank(lines, j); k >= 0 {
+		line := strings.TrimSpace(lines[k])
+		return strings.HasPrefix(line, ">") || headerFrom.MatchString(line)
+	}
+	return false
+}
+
+// outlookHeaders reports whether the lines following a From: header are a reply header block.
+func outlookHeaders(lines []string) bool {
+	for i := 0; i < len(lines) && i < 3; i++ {
+		if headerSentAt.MatchString(lines[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureStart returns the index of the first line of the signature, or len(lines).
+func signatureStart(lines []string) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		// "-- " is the standard delimiter, often stripped of its space
+		if strings.TrimRight(lines[i], " \t") == "--" {
+			return i
+		}
+	}
+	if j := prevNonBlank(lines, len(lines)); j >= 0 && mobileFooter.MatchString(lines[j]) {
+		return j
+	}
+	return len(lines)
+}
+
+func nextNonBlank(lines []string, i int) int {
+	for j := i; j < len(lines); j++ {
+		if strings.TrimSpace(lines[j]) != "" {
+			return j
+		}
+	}
+	return -1
+}
+
+func prevNonBlank(lines []string, i int) int {
+	for j := i - 1; j >= 0; j-- {
+		if strings.TrimSpace(lines[j]) != "" {
+			return j
+		}
+	}
+	return -1
+}
@@ -0,0 +1,98 @@
+package emailsvc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc/sanitize"
+	"github.com/jhillyerd/enmime"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sanitizeHTML applies the inbound HTML policy to env, keeping cid: references
+// to its inline parts since they're forwarded along.
+func sanitizeHTML(cfg backend.Config, env *enmime.Envelope) error {
+	if env.HTML == "" {
+		return nil
+	}
+	inlines := make(map[string]bool)
+	for _, p := range env.Inlines {
+		inlines[p.ContentID] = true
+	}
+	policy := sanitize.Policy{
+		CID: func(contentId string) string {
+			if !inlines[contentId] {
+				return ""
+			}
+			return "cid:" + contentId
+		},
+	}
+	if cfg.Email.ImageProxy != "" && cfg.Email.ImageProxySecret != "" {
+		policy.ImageProxy = func(src string) string {
+			return proxyImageURL(cfg, src)
+		}
+	}
+	sanitized, err := policy.HTML(env.HTML)
+	if err != nil {
+		return err
+	}
+	env.HTML = sanitized
+	return nil
+}
+
+// proxyImageURL returns the URL of the image proxy fetching src, signed so the proxy
+// only fetches images of forwarded emails rather than any URL it's given.
+func proxyImageURL(cfg backend.Config, src string) string {
+	h := hmac.New(sha256.New, []byte(cfg.Email.ImageProxySecret))
+	h.Write([]byte(src))
+	sig := base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	return cfg.Email.ImageProxy + url.QueryEscape(src) + "&sig=" + sig
+}
+
+// linkInlines rewrites cid: references of email to signed download links of its stored
+// inline attachments, so they're displayed outside of the email. Emails are stored with
+// their cid: references and linked when read, since the links expire.
+func linkInlines(
+	cfg backend.Config,
+	threadId primitive.ObjectID,
+	email Email,
+	now time.Time,
+) Email {
+	if cfg.Email.LinkOut.Secret == "" {
+		return email
+	}
+	digests := make(map[string]string)
+	for _, a := range email.Attachments {
+		if a.Inline && a.ContentId != "" && a.Sha256 != "" {
+			digests[a.ContentId] = a.Sha256
+		}
+	}
+	if len(digests) == 0 {
+		return email
+	}
+
+	policy := sanitize.Policy{
+		// remote images were handled when the email was sanitized
+		ImageProxy: func(src string) string { return src },
+		CID: func(contentId string) string {
+			digest, ok := digests[contentId]
+			if !ok {
+				return ""
+			}
+			return AttachmentURL(cfg, threadId, digest, now)
+		},
+	}
+	for _, h := range []*string{&email.HTML, &email.ReplyHTML} {
+		if *h == "" {
+			continue
+		}
+		if linked, err := policy.HTML(*h); err == nil {
+			*h = linked
+		}
+	}
+	return email
+}
@@ -0,0 +1,228 @@
+// Package sanitize applies an allowlist policy to untrusted email HTML.
+package sanitize
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Policy configures how resources of sanitized HTML are loaded. The zero Policy
+// removes every image that isn't embedded in the HTML.
+type Policy struct {
+	// ImageProxy returns the URL a remote image is loaded through, or "" to remove it.
+	// Remote images are removed if nil.
+	ImageProxy func(src string) string
+	// CID returns the URL of an inline part by Content-ID, or "" to remove references to it.
+	// cid: references are removed if nil.
+	CID func(contentId string) string
+}
+
+// dropped elements are removed along with their content.
+var dropped = map[atom.Atom]bool{
+	atom.Applet:   true,
+	atom.Audio:    true,
+	atom.Base:     true,
+	atom.Button:   true,
+	atom.Canvas:   true,
+	atom.Embed:    true,
+	atom.Form:     true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Head:     true,
+	atom.Iframe:   true,
+	atom.Input:    true,
+	atom.Link:     true,
+	atom.Math:     true,
+	atom.Meta:     true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Style:    true,
+	atom.Svg:      true,
+	atom.Template: true,
+	atom.Textarea: true,
+	atom.Title:    true,
+	atom.Video:    true,
+}
+
+// allowed elements are kept with their allowed attributes. Others are replaced by their content.
+var allowed = map[atom.Atom]bool{
+	atom.A: true, atom.Abbr: true, atom.B: true, atom.Blockquote: true, atom.Br: true,
+	atom.Caption: true, atom.Center: true, atom.Cite: true, atom.Code: true, atom.Col: true,
+	atom.Colgroup: true, atom.Dd: true, atom.Del: true, atom.Div: true, atom.Dl: true,
+	atom.Dt: true, atom.Em: true, atom.Font: true, atom.H1: true, atom.H2: true,
+	atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true, atom.Hr: true,
+	atom.I: true, atom.Img: true, atom.Ins: true, atom.Li: true, atom.Ol: true,
+	atom.P: true, atom.Pre: true, atom.Q: true, atom.S: true, atom.Small: true,
+	atom.Span: true, atom.Strike: true, atom.Strong: true, atom.Sub: true, atom.Sup: true,
+	atom.Table: true, atom.Tbody: true, atom.Td: true, atom.Tfoot: true, atom.Th: true,
+	atom.Thead: true, atom.Tr: true, atom.U: true, atom.Ul: true,
+}
+
+// allowedAttrs are kept on every allowed element. Links and sources are handled apart.
+var allowedAttrs = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "class": true, "color": true, "colspan": true, "dir": true,
+	"face": true, "height": true, "lang": true, "rowspan": true, "size": true,
+	"style": true, "title": true, "valign": true, "width": true,
+}
+
+var (
+	// embeddedImage matches data: URLs of raster images, which load nothing remotely.
+	embeddedImage = regexp.MustCompile(`(?i)^data:image/(png|gif|jpeg|webp);base64,`)
+	// unsafeStyle matches declarations loading resources or running code.
+	unsafeStyle = regexp.MustCompile(`(?i)url\s*\(|expression\s*\(|javascript:|behavior|binding|@import|\\|position\s*:`)
+)
+
+// HTML returns the contents of the <body> of s keeping only allowed elements and attributes.
+func (p Policy) HTML(s string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		return "", err
+	}
+	body := findBody(doc)
+	if body == nil {
+		return "", nil
+	}
+	p.sanitizeChildren(body)
+
+	var sb strings.Builder
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&sb, c); err != nil {
+			return "", err
+		}
+	}
+	return sb.String(), nil
+}
+
+func (p Policy) sanitizeChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch c.Type {
+		case html.TextNode:
+		case html.ElementNode:
+			p.sanitizeChildren(c)
+			switch {
+			case dropped[c.DataAtom]:
+				n.RemoveChild(c)
+			case !allowed[c.DataAtom]:
+				unwrap(c)
+			case !p.sanitizeAttrs(c):
+				n.RemoveChild(c)
+			}
+		default:
+			// comments, including conditional comments
+			n.RemoveChild(c)
+		}
+		c = next
+	}
+}
+
+// sanitizeAttrs filters the attributes of n, returning false if n should be removed.
+func (p Policy) sanitizeAttrs(n *html.Node) bool {
+	var attrs []html.Attribute
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		switch {
+		case a.Namespace != "":
+		case key == "href" && n.DataAtom == atom.A:
+			if safeLink(a.Val) {
+				attrs = append(attrs, html.Attribute{Key: "href", Val: a.Val})
+			}
+		case key == "src" && n.DataAtom == atom.Img:
+			if src := p.imageSrc(a.Val); src != "" {
+				attrs = append(attrs, html.Attribute{Key: "src", Val: src})
+			}
+		case key == "style":
+			if style := sanitizeStyle(a.Val); style != "" {
+				attrs = append(attrs, html.Attribute{Key: "style", Val: style})
+			}
+		case allowedAttrs[key]:
+			attrs = append(attrs, html.Attribute{Key: key, Val: a.Val})
+		}
+	}
+	n.Attr = attrs
+
+	switch n.DataAtom {
+	case atom.Img:
+		for _, a := range attrs {
+			if a.Key == "src" {
+				return true
+			}
+		}
+		return false
+	case atom.A:
+		n.Attr = append(n.Attr,
+			html.Attribute{Key: "target", Val: "_blank"},
+			html.Attribute{Key: "rel", Val: "noopener noreferrer nofollow"},
+		)
+	}
+	return true
+}
+
+func (p Policy) imageSrc(src string) string {
+	src = strings.TrimSpace(src)
+	lower := strings.ToLower(src)
+	switch {
+	case strings.HasPrefix(lower, "cid:"):
+		if p.CID == nil {
+			return ""
+		}
+		return p.CID(strings.Trim(src[len("cid:"):], "<>"))
+	case strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://"):
+		if p.ImageProxy == nil {
+			return ""
+		}
+		return p.ImageProxy(src)
+	case embeddedImage.MatchString(src):
+		return src
+	}
+	return ""
+}
+
+func safeLink(href string) bool {
+	lower := strings.ToLower(strings.TrimSpace(href))
+	return strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "http://") ||
+		strings.HasPrefix(lower, "mailto:") ||
+		strings.HasPrefix(lower, "#")
+}
+
+func sanitizeStyle(style string) string {
+	var decls []string
+	for _, decl := range strings.Split(style, ";") {
+		decl = strings.TrimSpace(decl)
+		if decl == "" || unsafeStyle.MatchString(decl) {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	return strings.Join(decls, "; ")
+}
+
+// unwrap replaces n by its children.
+func unwrap(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		n.RemoveChild(c)
+		n.Parent.InsertBefore(c, n)
+		c = next
+	}
+	n.Parent.RemoveChild(n)
+}
+
+func findBody(n *html.Node) *html.Node {
+	if n.DataAtom == atom.Body {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if body := findBody(c); body != nil {
+			return body
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package sanitize_test
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc/sanitize"
+)
+
+func TestPolicyHTML(t *testing.T) {
+	proxy := sanitize.Policy{
+		ImageProxy: func(src string) string {
+			return "https://proxy.domain.com/?url=" + url.QueryEscape(src)
+		},
+		CID: func(contentId string) string {
+			if contentId == "logo" {
+				return "https://api.domain.com/logo"
+			}
+			return ""
+		},
+	}
+	tests := []struct {
+		name   string
+		policy sanitize.Policy
+		html   string
+		want   string
+	}{
+		{
+			name: "scripts and event handlers",
+			html: `<html><head><script>alert(1)</script><style>p{}</style></head><body onload="x()"><p onclick="x()" class="a">Hi<script>alert(2)</script></p><iframe src="https://evil.com"></iframe></body></html>`,
+			want: `<p class="a">Hi</p>`,
+		},
+		{
+			name: "links",
+			html: `<a href="javascript:alert(1)">x</a><a href="https://domain.com" target="_self">y</a>`,
+			want: `<a target="_blank" rel="noopener noreferrer nofollow">x</a><a href="https://domain.com" target="_blank" rel="noopener noreferrer nofollow">y</a>`,
+		},
+		{
+			name: "remote images and styles are removed",
+			html: `<div style="color: red; background-image: url(https://t.co/p.gif)" background="https://t.co/b.gif"><img src="https://t.co/pixel.gif" width="1"><img src="cid:logo"></div>`,
+			want: `<div style="color: red"></div>`,
+		},
+		{
+			name:   "images are proxied and cid rewritten",
+			policy: proxy,
+			html:   `<img src="https://t.co/a.png?x=1"><img src="cid:logo"><img src="cid:missing"><img src="data:image/png;base64,iVBORw0KGgo=">`,
+			want:   `<img src="https://proxy.domain.com/?url=https%3A%2F%2Ft.co%2Fa.png%3Fx%3D1"/><img src="https://api.domain.com/logo"/><img src="data:image/png;base64,iVBORw0KGgo="/>`,
+		},
+		{
+			name: "unknown elements are unwrapped and comments removed",
+			html: `<o:p>kept</o:p><!--[if mso]><v:rect/><![endif]--><custom><b>bold</b></custom><svg><script>x</script></svg>`,
+			want: `kept<b>bold</b>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.HTML(tt.html)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package emailsvc
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// ResolveStrategy reports which header resolved an EmailThread.
+type ResolveStrategy string
+
+const (
+	ResolvedByReplyAddress ResolveStrategy = "replyAddress"
+	ResolvedByInReplyTo    ResolveStrategy = "inReplyTo"
+	ResolvedByReferences   ResolveStrategy = "references"
+	ResolvedBySubject      ResolveStrategy = "subject"
+)
+
+// ThreadResolveTerms are the inbound email headers used to resolve its EmailThread.
+type ThreadResolveTerms struct {
+	// Recipients are checked for a reply address, see ReplyAddress.
+	Recipients []string `json:"recipients,omitempty"`
+	InReplyTo  string   `json:"inReplyTo,omitempty"`
+	References []string `json:"references,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	From       string   `json:"from,omitempty"`
+}
+
+type ThreadResolution struct {
+	Thread   EmailThread     `json:"thread"`
+	Strategy ResolveStrategy `json:"strategy"`
+}
+
+// NewThreadResolveTerms extracts ThreadResolveTerms from the headers of env.
+func NewThreadResolveTerms(env *enmime.Envelope) ThreadResolveTerms {
+	terms := ThreadResolveTerms{
+		InReplyTo:  strings.TrimSpace(env.GetHeader("In-Reply-To")),
+		References: strings.Fields(env.GetHeader("References")),
+		Subject:    env.GetHeader("Subject"),
+	}
+	if addr, err := mail.ParseAddress(env.GetHeader("From")); err == nil {
+		terms.From = addr.Address
+	}
+	for _, h := range []string{"Delivered-To", "To", "Cc"} {
+		addrs, _ := env.AddressList(h)
+		for _, addr := range addrs {
+			terms.Recipients = append(terms.Recipients, addr.Address)
+		}
+	}
+	return terms
+}
+
+var subjectPrefixRegex = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv|antw)(\[\d+\])?\s*:\s*)+`)
+
+// NormalizeSubject strips reply and forward prefixes such as "Re:", "Fwd:" and "AW:"
+// and collapses whitespace.
+func NormalizeSubject(subject string) string {
+	subject = subjectPrefixRegex.ReplaceAllString(subject, "")
+	return strings.Join(strings.Fields(subject), " ")
+}
+
+// searchOrder lists the Message-Ids to search for, In-Reply-To first
+// followed by References newest first.
+func (t ThreadResolveTerms) searchOrder() []ThreadSearchTerms {
+	var res []ThreadSearchTerms
+	seen := make(map[string]bool)
+	if t.InReplyTo != "" {
+		seen[t.InReplyTo] = true
+		res = append(res, ThreadSearchTerms{EmailMessageId: t.InReplyTo})
+	}
+	for i := len(t.References) - 1; i >= 0; i-- {
+		ref := t.References[i]
+		if ref == "" || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		res = append(res, ThreadSearchTerms{EmailMessageId: ref})
+	}
+	return res
+}
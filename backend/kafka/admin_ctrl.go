@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/rs/zerolog/log"
+)
+
+type AdminController interface {
+	ReplayDeadLetters(http.ResponseWriter, *http.Request)
+	PauseTopics(http.ResponseWriter, *http.Request)
+	ResumeTopics(http.ResponseWriter, *http.Request)
+	ConsumerHealth(http.ResponseWriter, *http.Request)
+}
+
+var _ AdminController = (*adminController)(nil)
+
+type adminController struct {
+	cfg backend.Config
+	cl  KafkaConsumerClient
+}
+
+func NewAdminController(cfg backend.Config, cl KafkaConsumerClient) *adminController {
+	return &adminController{
+		cfg: cfg,
+		cl:  cl,
+	}
+}
+
+type ReplayDeadLettersReq struct {
+	Topic string `json:"topic,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+type ReplayDeadLettersResp struct {
+	Replayed int `json:"replayed"`
+}
+
+func (ctrl *adminController) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	// decode request
+	var req ReplayDeadLettersReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "provide ReplayDeadLettersReq", http.StatusBadRequest)
+		return
+	}
+	if req.Topic == "" {
+		req.Topic = ctrl.cfg.Kafka.Topics.InboundEmailsDLQ
+	}
+	if req.Limit <= 0 {
+		req.Limit = 100
+	}
+
+	//
+	replayed, err := ReplayDeadLetters(
+		r.Context(),
+		ctrl.cfg.Kafka,
+		req.Topic,
+		fmt.Sprintf("%s-%s", ctrl.cfg.Kafka.User, "dlq-replay"),
+		req.Limit,
+	)
+	if err != nil {
+		log.Error().Err(err).Int("replayed", replayed).Msg("failed ReplayDeadLetters")
+		http.Error(w, "failed ReplayDeadLetters: "+err.Error(), 500)
+		return
+	}
+	log.Info().Str("topic", req.Topic).Int("replayed", replayed).Msg("replayed dead letters")
+
+	//
+	data, err := json.Marshal(ReplayDeadLettersResp{Replayed: replayed})
+	if err != nil {
+		http.Error(w, "failed Marshal: "+err.Error(), 500)
+		return
+	}
+
+	//
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
+
+type TopicsReq struct {
+	Topics []string `json:"topics"`
+}
+
+func (ctrl *adminController) PauseTopics(w http.ResponseWriter, r *http.Request) {
+	// decode request
+	var req TopicsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Topics) == 0 {
+		http.Error(w, "provide TopicsReq", http.StatusBadRequest)
+		return
+	}
+
+	//
+	ctrl.cl.PauseTopics(req.Topics...)
+	ctrl.ConsumerHealth(w, r)
+}
+
+func (ctrl *adminController) ResumeTopics(w http.ResponseWriter, r *http.Request) {
+	// decode request
+	var req TopicsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Topics) == 0 {
+		http.Error(w, "provide TopicsReq", http.StatusBadRequest)
+		return
+	}
+
+	//
+	ctrl.cl.ResumeTopics(req.Topics...)
+	ctrl.ConsumerHealth(w, r)
+}
+
+// ConsumerHealth responds with the ConsumerHealth and 503 if the consumer is unhealthy.
+func (ctrl *adminController) ConsumerHealth(w http.ResponseWriter, r *http.Request) {
+	health := ctrl.cl.Health()
+
+	//
+	data, err := json.Marshal(health)
+	if err != nil {
+		http.Error(w, "failed Marshal: "+err.Error(), 500)
+		return
+	}
+
+	//
+	w.Header().Add("Content-Type", "application/json")
+	if !health.Healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+}
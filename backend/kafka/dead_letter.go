@@ -0,0 +1,125 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// replayIdleTimeout ends a replay once no records are fetched for as long after joining the group.
+const replayIdleTimeout = 5 * time.Second
+
+// replayJoinTimeout bounds joining the replay consumer group.
+const replayJoinTimeout = 30 * time.Second
+
+// ReplayDeadLetters moves up to limit records from dlqTopic back to their
+// original topic. Replayed records are committed under groupId so they are
+// only replayed once. Records dead-lettered again during the replay are left
+// for the next one.
+func ReplayDeadLetters(
+	ctx context.Context,
+	cfg backend.KafkaConfig,
+	dlqTopic string,
+	groupId string,
+	limit int,
+) (int, error) {
+	if dlqTopic == "" {
+		return 0, errors.New("missing required dlqTopic")
+	}
+	assigned := make(chan struct{})
+	var assignOnce sync.Once
+	cl, err := newClient(
+		ctx,
+		cfg,
+		kgo.ConsumeTopics(dlqTopic),
+		kgo.ConsumerGroup(groupId),
+		kgo.DisableAutoCommit(),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.OnPartitionsAssigned(func(context.Context, *kgo.Client, map[string][]int32) {
+			assignOnce.Do(func() { close(assigned) })
+		}),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cl.Close()
+
+	ends, err := listOffsets(ctx, cl, dlqTopic, nil, endOffset)
+	if err != nil {
+		return 0, err
+	}
+	// the idle timeout only applies once fetching, not while joining the group
+	select {
+	case <-assigned:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(replayJoinTimeout):
+		return 0, fmt.Errorf("timed out joining consumer group %s", groupId)
+	}
+
+	replayed := 0
+	for replayed < limit {
+		pollCtx, pollCanc := context.WithTimeout(ctx, replayIdleTimeout)
+		fetches := cl.PollRecords(pollCtx, limit-replayed)
+		pollCanc()
+		for _, fe := range fetches.Errors() {
+			if !errors.Is(fe.Err, context.DeadlineExceeded) {
+				return replayed, fe.Err
+			}
+		}
+		var recs []*kgo.Record
+		for _, rec := range fetches.Records() {
+			if rec.Offset < ends[rec.Partition] {
+				recs = append(recs, rec)
+			}
+		}
+		if len(recs) == 0 {
+			break
+		}
+
+		out := make([]*kgo.Record, 0, len(recs))
+		for _, rec := range recs {
+			out = append(out, replayRecord(rec))
+		}
+		if err := cl.ProduceSync(ctx, out...).FirstErr(); err != nil {
+			return replayed, err
+		}
+		if err := cl.CommitRecords(ctx, recs...); err != nil {
+			return replayed, err
+		}
+		replayed += len(recs)
+	}
+	return replayed, ctx.Err()
+}
+
+// failureHeaders are set by RetryingRecordHandler on retried and dead-lettered records.
+var failureHeaders = map[string]bool{
+	HeaderRetryCount:        true,
+	HeaderRetryAt:           true,
+	HeaderOriginalTopic:     true,
+	HeaderOriginalPartition: true,
+	HeaderOriginalOffset:    true,
+	HeaderError:             true,
+	HeaderStatusCode:        true,
+	HeaderFailedAt:          true,
+}
+
+// replayRecord copies a dead-lettered record to its original topic without failure headers.
+func replayRecord(rec *kgo.Record) *kgo.Record {
+	out := &kgo.Record{
+		Topic: header(rec, HeaderOriginalTopic),
+		Key:   rec.Key,
+		Value: rec.Value,
+	}
+	for _, h := range rec.Headers {
+		if !failureHeaders[h.Key] {
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	return out
+}
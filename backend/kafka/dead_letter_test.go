@@ -0,0 +1,38 @@
+package kafka
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestReplayRecord(t *testing.T) {
+	rec := &kgo.Record{
+		Topic:     "inboundEmails",
+		Partition: 2,
+		Offset:    7,
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+		Headers: []kgo.RecordHeader{
+			{Key: "x-request-id", Value: []byte("abc")},
+			{Key: "traceparent", Value: []byte("00-1-2-01")},
+		},
+	}
+	retried := failedRecord(rec, "inboundEmails.retry", errors.New("timeout"))
+	setHeader(retried, HeaderRetryCount, "1")
+	dead := failedRecord(retried, "inboundEmails.dlq", errors.New("bad request"))
+
+	if id := SourceId(dead); id != "inboundEmails/2/7" || id != SourceId(rec) {
+		t.Errorf("got source id %s, want inboundEmails/2/7", id)
+	}
+
+	got := replayRecord(dead)
+	if got.Topic != "inboundEmails" || string(got.Key) != "key" || string(got.Value) != "value" {
+		t.Fatalf("got %+v", got)
+	}
+	if !reflect.DeepEqual(got.Headers, rec.Headers) {
+		t.Errorf("headers %v, want %v", got.Headers, rec.Headers)
+	}
+}
@@ -0,0 +1,138 @@
+package kafka
+
+import (
+	"errors"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/httputil"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// RecordHandler processes a record. The returned error decides its Disposition:
+// nil acks the record, errors wrapped with RetryRecord, DeadLetterRecord or
+// PausePartition get that disposition and other errors are retried if IsRetryable
+// and dead-lettered otherwise.
+type RecordHandler func(*kgo.Record) error
+
+type Disposition int
+
+const (
+	// Ack commits the record.
+	Ack Disposition = iota
+	// Retry redelivers the record after an exponential backoff without committing it.
+	Retry
+	// DeadLetter commits the record without redelivery so the partition moves on.
+	DeadLetter
+	// Pause stops fetching the partition for a duration before redelivering the record.
+	Pause
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case Ack:
+		return "ack"
+	case Retry:
+		return "retry"
+	case DeadLetter:
+		return "dead-letter"
+	case Pause:
+		return "pause"
+	default:
+		return "unknown"
+	}
+}
+
+const defaultPause = 30 * time.Second
+
+// redeliveryBackoff is the backoff between in-place retries of a record.
+var redeliveryBackoff = httputil.ExponentialBackoffConfigs{
+	Interval: 500 * time.Millisecond,
+	Max:      30 * time.Second,
+	Rate:     2,
+}
+
+type dispositionErr struct {
+	err         error
+	disposition Disposition
+	pause       time.Duration
+}
+
+func (e *dispositionErr) Error() string {
+	return e.err.Error()
+}
+
+func (e *dispositionErr) Unwrap() error {
+	return e.err
+}
+
+// RetryRecord marks err to redeliver the record regardless of IsRetryable.
+func RetryRecord(err error) error {
+	return &dispositionErr{err: err, disposition: Retry}
+}
+
+// DeadLetterRecord marks err as permanent so the record is committed and skipped.
+func DeadLetterRecord(err error) error {
+	return &dispositionErr{err: err, disposition: DeadLetter}
+}
+
+// PausePartition marks err to pause fetching the partition for d before
+// redelivering the record. Zero d pauses for 30s.
+func PausePartition(err error, d time.Duration) error {
+	if d <= 0 {
+		d = defaultPause
+	}
+	return &dispositionErr{err: err, disposition: Pause, pause: d}
+}
+
+// DispositionOf returns the Disposition of a RecordHandler error.
+func DispositionOf(err error) Disposition {
+	if err == nil {
+		return Ack
+	}
+	var dErr *dispositionErr
+	if errors.As(err, &dErr) {
+		return dErr.disposition
+	}
+	if IsRetryable(err) {
+		return Retry
+	}
+	return DeadLetter
+}
+
+// handleResult logs the outcome of the attempt (starting at 0) of handling rec
+// and reports whether rec can be committed or else how long to wait before redelivering it.
+func handleResult(rec *kgo.Record, err error, attempt int) (commit bool, wait time.Duration) {
+	d := DispositionOf(err)
+	switch d {
+	case Ack:
+		return true, 0
+	case DeadLetter:
+		log.Error().Err(err).
+			Str("topic", rec.Topic).
+			Int32("partition", rec.Partition).
+			Int64("offset", rec.Offset).
+			Msg("skipping dead-lettered record")
+		return true, 0
+	case Pause:
+		var dErr *dispositionErr
+		errors.As(err, &dErr)
+		wait = dErr.pause
+		log.Info().Err(err).
+			Str("topic", rec.Topic).
+			Int32("partition", rec.Partition).
+			Int64("offset", rec.Offset).
+			Dur("pause", wait).
+			Msg("pausing partition")
+	default:
+		wait = httputil.ExponentialBackoff(redeliveryBackoff, attempt)
+		log.Warn().Err(err).
+			Str("topic", rec.Topic).
+			Int32("partition", rec.Partition).
+			Int64("offset", rec.Offset).
+			Int("attempt", attempt+1).
+			Dur("backoff", wait).
+			Msg("redelivering record")
+	}
+	return false, wait
+}
@@ -0,0 +1,160 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/httputil"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type ConsumerStatus string
+
+const (
+	ConsumerStarting ConsumerStatus = "starting"
+	ConsumerPolling  ConsumerStatus = "polling"
+	// ConsumerRetrying is backing off after retryable fetch errors.
+	ConsumerRetrying ConsumerStatus = "retrying"
+	ConsumerStopped  ConsumerStatus = "stopped"
+	// ConsumerFailed stopped polling after a fatal fetch error.
+	ConsumerFailed ConsumerStatus = "failed"
+)
+
+// ConsumerHealth is a snapshot of the state of a KafkaConsumerClient.
+type ConsumerHealth struct {
+	Status             ConsumerStatus `json:"status"`
+	LastPollAt         time.Time      `json:"lastPollAt,omitempty"`
+	LastError          string         `json:"lastError,omitempty"`
+	ConsecutiveErrors  int            `json:"consecutiveErrors,omitempty"`
+	AssignedPartitions int            `json:"assignedPartitions"`
+	PausedTopics       []string       `json:"pausedTopics,omitempty"`
+}
+
+// maxPollAge is how long since its last poll a polling consumer is considered wedged.
+// Polls return at least every pollTimeout, so only a blocked poll loop exceeds it.
+const maxPollAge = time.Minute
+
+// pollTimeout bounds polls of idle topics so LastPollAt keeps advancing.
+const pollTimeout = 10 * time.Second
+
+func (h ConsumerHealth) Healthy() bool {
+	switch h.Status {
+	case ConsumerStarting:
+		return true
+	case ConsumerPolling:
+		return time.Since(h.LastPollAt) < maxPollAge
+	default:
+		return false
+	}
+}
+
+// fetchBackoff is the backoff between polls after consecutive retryable fetch errors.
+var fetchBackoff = httputil.ExponentialBackoffConfigs{
+	Interval: time.Second,
+	Max:      time.Minute,
+	Rate:     2,
+}
+
+// isFatalFetchErr reports whether err cannot be recovered by polling again,
+// like authorization and authentication errors.
+func isFatalFetchErr(err error) bool {
+	var kErr *kerr.Error
+	return errors.As(err, &kErr) && !kErr.Retriable
+}
+
+func isClosedErr(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, kgo.ErrClientClosed)
+}
+
+// consumerState tracks the ConsumerHealth and paused topics of a consumer.
+type consumerState struct {
+	mu       sync.Mutex
+	health   ConsumerHealth
+	assigned int
+	paused   map[string]bool
+}
+
+func newConsumerState() *consumerState {
+	return &consumerState{
+		health: ConsumerHealth{Status: ConsumerStarting},
+		paused: make(map[string]bool),
+	}
+}
+
+func (s *consumerState) polled() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.Status = ConsumerPolling
+	s.health.LastPollAt = time.Now()
+	s.health.ConsecutiveErrors = 0
+}
+
+// fetchFailed records a retryable fetch error and returns the number of consecutive errors.
+func (s *consumerState) fetchFailed(err error) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.Status = ConsumerRetrying
+	s.health.LastPollAt = time.Now()
+	s.health.LastError = err.Error()
+	s.health.ConsecutiveErrors++
+	return s.health.ConsecutiveErrors
+}
+
+func (s *consumerState) stop(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health.Status = ConsumerStopped
+	if err != nil {
+		s.health.Status = ConsumerFailed
+		s.health.LastError = err.Error()
+	}
+}
+
+func (s *consumerState) addAssigned(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assigned += n
+}
+
+func (s *consumerState) setAssigned(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.assigned = n
+}
+
+func (s *consumerState) setPaused(paused bool, topics ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range topics {
+		if paused {
+			s.paused[t] = true
+		} else {
+			delete(s.paused, t)
+		}
+	}
+}
+
+func (s *consumerState) isPaused(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[topic]
+}
+
+func (s *consumerState) snapshot() ConsumerHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.health
+	h.AssignedPartitions = s.assigned
+	h.PausedTopics = nil
+	for t := range s.paused {
+		h.PausedTopics = append(h.PausedTopics, t)
+	}
+	sort.Strings(h.PausedTopics)
+	return h
+}
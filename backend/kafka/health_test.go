@@ -0,0 +1,24 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthy(t *testing.T) {
+	tests := []struct {
+		health ConsumerHealth
+		want   bool
+	}{
+		{ConsumerHealth{Status: ConsumerStarting}, true},
+		{ConsumerHealth{Status: ConsumerPolling, LastPollAt: time.Now()}, true},
+		{ConsumerHealth{Status: ConsumerPolling, LastPollAt: time.Now().Add(-2 * maxPollAge)}, false},
+		{ConsumerHealth{Status: ConsumerRetrying, LastPollAt: time.Now()}, false},
+		{ConsumerHealth{Status: ConsumerFailed}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.health.Healthy(); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.health, got, tt.want)
+		}
+	}
+}
@@ -2,23 +2,32 @@ package kafka
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
-	"net"
+	"fmt"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/httputil"
 	"github.com/rs/zerolog/log"
 	"github.com/twmb/franz-go/pkg/kgo"
-	"github.com/twmb/franz-go/pkg/sasl/scram"
 )
 
 type KafkaConsumerClient interface {
-	SetRecordHandler(string, func(*kgo.Record)) error
-	Poll(context.Context)
+	// SetRecordHandler consumes topic with recordHandler. Records are committed
+	// once recordHandler acks or dead-letters them, see RecordHandler.
+	SetRecordHandler(string, RecordHandler) error
+	// SetKeyFunc orders records of topic by keyFn instead of RecordKey.
+	SetKeyFunc(topic string, keyFn KeyFunc)
+	// Poll consumes until ctx is done or the client is shut down. Retryable fetch
+	// errors are retried with backoff and fatal ones are returned.
+	Poll(context.Context) error
+	// PauseTopics stops fetching topics until ResumeTopics.
+	PauseTopics(...string)
+	ResumeTopics(...string)
+	Health() ConsumerHealth
 	Shutdown()
 }
 
@@ -28,79 +37,119 @@ func NewSplitConsumerClient(
 	groupId string,
 ) *splitConsumerClient {
 	s := &splitConsumerClient{
+		groupId:        groupId,
 		consumers:      make(map[tp]*pConsumer),
-		recordHandlers: make(map[string]func(*kgo.Record)),
+		recordHandlers: make(map[string]RecordHandler),
+		keyFns:         make(map[string]KeyFunc),
+		maxPollRecords: cfg.MaxPollRecords,
+		state:          newConsumerState(),
+	}
+	if cfg.Workers > 1 {
+		s.workers = make(chan struct{}, cfg.Workers)
+	}
+	if s.maxPollRecords <= 0 {
+		s.maxPollRecords = 10000
 	}
 
-	tlsDialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: 10 * time.Second}}
-	opts := []kgo.Opt{
-		kgo.SeedBrokers(strings.Split(cfg.Brokers, ",")...),
-		kgo.SASL(scram.Sha512(func(context.Context) (scram.Auth, error) {
-			return scram.Auth{
-				User: cfg.User,
-				Pass: cfg.Password,
-			}, nil
-		})),
-		kgo.Dialer(tlsDialer.DialContext),
-		kgo.WithLogger(kgo.BasicLogger(os.Stdout, kgo.LogLevel(cfg.LogLevel), nil)),
-		kgo.DisableIdempotentWrite(),
+	s.cl = NewClient(
+		ctx,
+		cfg,
 		kgo.OnPartitionsAssigned(s.assigned),
 		kgo.OnPartitionsRevoked(s.revoked),
 		kgo.OnPartitionsLost(s.lost),
 		kgo.ConsumerGroup(groupId),
 		kgo.AutoCommitMarks(),
 		kgo.BlockRebalanceOnPoll(),
+	)
+
+	return s
+}
+
+// NewClient constructs a kgo.Client with the connection configuration shared by
+// consumers and producers. Additional opts are appended to the defaults.
+func NewClient(ctx context.Context, cfg backend.KafkaConfig, opts ...kgo.Opt) *kgo.Client {
+	cl, err := newClient(ctx, cfg, opts...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed creating kafka client")
+	}
+	return cl
+}
+
+func newClient(ctx context.Context, cfg backend.KafkaConfig, opts ...kgo.Opt) (*kgo.Client, error) {
+	secOpts, err := securityOpts(cfg)
+	if err != nil {
+		return nil, err
 	}
+	opts = append(append([]kgo.Opt{
+		kgo.SeedBrokers(strings.Split(cfg.Brokers, ",")...),
+		kgo.WithLogger(kgo.BasicLogger(os.Stdout, kgo.LogLevel(cfg.LogLevel), nil)),
+		kgo.DisableIdempotentWrite(),
+	}, secOpts...), opts...)
 	cl, err := kgo.NewClient(opts...)
 	if err != nil {
-		log.Fatal().Err(err).Msg("failed creating kafka client")
+		return nil, err
 	}
 	if err = cl.Ping(ctx); err != nil {
-		log.Fatal().Err(err).Msg("failed pinging kafka client")
+		cl.Close()
+		return nil, err
 	}
 
-	s.cl = cl
-
-	return s
+	return cl, nil
 }
 
 func (s *splitConsumerClient) SetRecordHandler(
 	topic string,
-	recordHandler func(*kgo.Record),
+	recordHandler RecordHandler,
 ) error {
 	if topic == "" {
 		return errors.New("missing required topic")
 	}
-	s.recordHandlers[topic] = recordHandler
+	s.recordHandlers[topic] = instrument(topic, recordHandler)
 	s.cl.AddConsumeTopics(topic)
 	return nil
 }
 
-func (s *splitConsumerClient) Poll(ctx context.Context) {
+func (s *splitConsumerClient) SetKeyFunc(topic string, keyFn KeyFunc) {
+	s.keyFns[topic] = keyFn
+}
+
+func (s *splitConsumerClient) Poll(ctx context.Context) error {
+	var lastLag time.Time
 	for {
 		// PollRecords is strongly recommended when using
 		// BlockRebalanceOnPoll. You can tune how many records to
 		// process at once (upper bound -- could all be on one
 		// partition), ensuring that your processor loops complete fast
 		// enough to not block a rebalance too long.
-		fetches := s.cl.PollRecords(ctx, 10000)
-		if fetches.IsClientClosed() {
-			return
-		}
-		if fetches.IsClientClosed() {
+		pollCtx, pollCanc := context.WithTimeout(ctx, pollTimeout)
+		fetches := s.cl.PollRecords(pollCtx, s.maxPollRecords)
+		pollCanc()
+		if fetches.IsClientClosed() || ctx.Err() != nil {
 			log.Info().Msg("kafka client closed")
-			return
+			s.state.stop(nil)
+			return nil
 		}
-		if errs := fetches.Errors(); len(errs) > 0 {
-			// Note: you can delete this block, which will result
-			// in these errors being sent to the partition
-			// consumers, and then you can handle the errors there.
-			log.Error().
-				Interface("errors", errs).
-				Msg("failed PollFetches")
-			return
+		var fetchErr error
+		for _, fe := range fetches.Errors() {
+			if isClosedErr(fe.Err) {
+				continue
+			}
+			if isFatalFetchErr(fe.Err) {
+				s.cl.AllowRebalance()
+				err := fmt.Errorf("failed fetching %s[%d]: %w", fe.Topic, fe.Partition, fe.Err)
+				s.state.stop(err)
+				return err
+			}
+			log.Warn().Err(fe.Err).
+				Str("topic", fe.Topic).
+				Int32("partition", fe.Partition).
+				Msg("failed fetch")
+			fetchErr = fe.Err
 		}
 		fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+			if len(p.Records) == 0 {
+				return
+			}
 			tp := tp{p.Topic, p.Partition}
 
 			// Since we are using BlockRebalanceOnPoll, we can be
@@ -113,17 +162,56 @@ func (s *splitConsumerClient) Poll(ctx context.Context) {
 			// and be deleted before re-allowing polling.
 			s.consumers[tp].recs <- p
 		})
+		// consumers only change while rebalancing, so report before allowing it
+		if time.Since(lastLag) >= lagInterval {
+			s.reportLag(ctx)
+			lastLag = time.Now()
+		}
 		s.cl.AllowRebalance()
+
+		if fetchErr == nil {
+			s.state.polled()
+			continue
+		}
+		backoff := httputil.ExponentialBackoff(fetchBackoff, s.state.fetchFailed(fetchErr)-1)
+		log.Warn().Dur("backoff", backoff).Msg("backing off fetches")
+		select {
+		case <-ctx.Done():
+			s.state.stop(nil)
+			return nil
+		case <-time.After(backoff):
+		}
 	}
 }
 
+func (s *splitConsumerClient) PauseTopics(topics ...string) {
+	s.cl.PauseFetchTopics(topics...)
+	s.state.setPaused(true, topics...)
+	log.Info().Strs("topics", topics).Msg("paused topics")
+}
+
+func (s *splitConsumerClient) ResumeTopics(topics ...string) {
+	s.cl.ResumeFetchTopics(topics...)
+	s.state.setPaused(false, topics...)
+	log.Info().Strs("topics", topics).Msg("resumed topics")
+}
+
+func (s *splitConsumerClient) Health() ConsumerHealth {
+	return s.state.snapshot()
+}
+
 func (s *splitConsumerClient) Shutdown() {
 	s.cl.CloseAllowingRebalance()
 }
 
 type splitConsumerClient struct {
+	groupId        string
 	consumers      map[tp]*pConsumer
-	recordHandlers map[string]func(*kgo.Record)
+	recordHandlers map[string]RecordHandler
+	keyFns         map[string]KeyFunc
+	workers        chan struct{}
+	maxPollRecords int
+	state          *consumerState
 	cl             *kgo.Client
 }
 
@@ -137,15 +225,23 @@ type pConsumer struct {
 	topic     string
 	partition int32
 
-	recordHandler func(*kgo.Record)
+	recordHandler RecordHandler
+	// dispatcher runs records concurrently ordered per key. Records are handled serially if nil.
+	dispatcher *orderedDispatcher
 
 	quit chan struct{}
 	done chan struct{}
 	recs chan kgo.FetchTopicPartition
+
+	pauseMu sync.Mutex
+	pauses  int
 }
 
 func (pc *pConsumer) consume() {
 	defer close(pc.done)
+	if pc.dispatcher != nil {
+		defer pc.dispatcher.wait()
+	}
 	log.Info().
 		Str("topic", pc.topic).
 		Int32("partition", pc.partition).
@@ -159,17 +255,80 @@ func (pc *pConsumer) consume() {
 		case <-pc.quit:
 			return
 		case p := <-pc.recs:
-			p.EachRecord(pc.recordHandler)
-			pc.cl.MarkCommitRecords(p.Records...)
+			for _, rec := range p.Records {
+				if pc.dispatcher != nil {
+					if !pc.dispatcher.dispatch(rec) {
+						return
+					}
+					continue
+				}
+				if !pc.handle(rec) {
+					return
+				}
+				pc.cl.MarkCommitRecords(rec)
+			}
 		}
 	}
 }
 
+// handle calls recordHandler until rec can be committed, pausing fetches of the
+// partition while waiting to redeliver it. It reports false if the consumer quit first.
+func (pc *pConsumer) handle(rec *kgo.Record) bool {
+	for attempt := 0; ; attempt++ {
+		commit, wait := pc.attempt(rec, attempt)
+		if commit {
+			return true
+		}
+		if !pc.await(wait) {
+			return false
+		}
+	}
+}
+
+// attempt calls recordHandler and reports whether rec can be committed
+// or else how long to wait before redelivering it.
+func (pc *pConsumer) attempt(rec *kgo.Record, attempt int) (bool, time.Duration) {
+	return handleResult(rec, pc.recordHandler(rec), attempt)
+}
+
+// await pauses fetches of the partition for wait. It reports false if the consumer quit first.
+func (pc *pConsumer) await(wait time.Duration) bool {
+	pc.pause()
+	defer pc.resume()
+	select {
+	case <-pc.quit:
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// pause and resume count the records awaiting redelivery, so concurrent
+// keys keep the partition paused until the last of them resumes it.
+func (pc *pConsumer) pause() {
+	pc.pauseMu.Lock()
+	defer pc.pauseMu.Unlock()
+	if pc.pauses == 0 {
+		pc.cl.PauseFetchPartitions(map[string][]int32{pc.topic: {pc.partition}})
+	}
+	pc.pauses++
+}
+
+func (pc *pConsumer) resume() {
+	pc.pauseMu.Lock()
+	defer pc.pauseMu.Unlock()
+	pc.pauses--
+	if pc.pauses == 0 {
+		pc.cl.ResumeFetchPartitions(map[string][]int32{pc.topic: {pc.partition}})
+	}
+}
+
 func (s *splitConsumerClient) assigned(
 	_ context.Context,
 	cl *kgo.Client,
 	assigned map[string][]int32,
 ) {
+	countRebalance(s.groupId, "assigned")
 	for topic, partitions := range assigned {
 		for _, partition := range partitions {
 			pc := &pConsumer{
@@ -183,7 +342,18 @@ func (s *splitConsumerClient) assigned(
 				done: make(chan struct{}),
 				recs: make(chan kgo.FetchTopicPartition, 5),
 			}
+			if s.workers != nil {
+				pc.dispatcher = newOrderedDispatcher(
+					s.workers,
+					pc.quit,
+					s.keyFns[topic],
+					pc.attempt,
+					pc.await,
+					func(rec *kgo.Record) { cl.MarkCommitRecords(rec) },
+				)
+			}
 			s.consumers[tp{topic, partition}] = pc
+			s.state.addAssigned(1)
 			go pc.consume()
 		}
 	}
@@ -194,6 +364,8 @@ func (s *splitConsumerClient) revoked(
 	cl *kgo.Client,
 	revoked map[string][]int32,
 ) {
+	countRebalance(s.groupId, "revoked")
+	deleteLag(s.groupId, revoked)
 	s.killConsumers(revoked)
 	if err := cl.CommitMarkedOffsets(ctx); err != nil {
 		log.Error().Err(err).Msg("failed revoke commit")
@@ -201,6 +373,8 @@ func (s *splitConsumerClient) revoked(
 }
 
 func (s *splitConsumerClient) lost(_ context.Context, cl *kgo.Client, lost map[string][]int32) {
+	countRebalance(s.groupId, "lost")
+	deleteLag(s.groupId, lost)
 	s.killConsumers(lost)
 	// Losing means we cannot commit: an error happened.
 }
@@ -212,8 +386,12 @@ func (s *splitConsumerClient) killConsumers(lost map[string][]int32) {
 	for topic, partitions := range lost {
 		for _, partition := range partitions {
 			tp := tp{topic, partition}
-			pc := s.consumers[tp]
+			pc, ok := s.consumers[tp]
+			if !ok {
+				continue
+			}
 			delete(s.consumers, tp)
+			s.state.addAssigned(-1)
 			close(pc.quit)
 			wg.Add(1)
 			go func() { <-pc.done; wg.Done() }()
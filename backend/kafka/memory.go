@@ -0,0 +1,384 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// MemoryBroker is an in-process message broker with topics, partitions,
+// consumer groups, offset commits and rebalances. It backs KafkaConsumerClient
+// and KafkaProducerClient for tests and local development without a Kafka cluster.
+type MemoryBroker struct {
+	mu         sync.Mutex
+	partitions int
+	topics     map[string][][]*kgo.Record
+	groups     map[string]*memoryGroup
+	roundRobin int
+
+	// notify is closed and replaced whenever records are produced or groups rebalance.
+	notify chan struct{}
+}
+
+type memoryGroup struct {
+	id      string
+	commits map[tp]int64
+	members []*memoryConsumerClient
+}
+
+// NewMemoryBroker constructs a MemoryBroker creating topics with the given number of partitions.
+func NewMemoryBroker(partitions int) *MemoryBroker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBroker{
+		partitions: partitions,
+		topics:     make(map[string][][]*kgo.Record),
+		groups:     make(map[string]*memoryGroup),
+		notify:     make(chan struct{}),
+	}
+}
+
+// NewConsumerClient constructs a consumer that joins groupId once a record handler is set.
+func (b *MemoryBroker) NewConsumerClient(groupId string) *memoryConsumerClient {
+	return &memoryConsumerClient{
+		b:        b,
+		groupId:  groupId,
+		handlers: make(map[string]RecordHandler),
+		assigned: make(map[tp]bool),
+		retries:  make(map[tp]memoryRetry),
+		state:    newConsumerState(),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (b *MemoryBroker) NewProducerClient() *memoryProducerClient {
+	return &memoryProducerClient{b: b}
+}
+
+// CommittedOffset returns the next offset groupId will consume from the partition.
+func (b *MemoryBroker) CommittedOffset(groupId, topic string, partition int32) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.groups[groupId]
+	if !ok {
+		return 0
+	}
+	return g.commits[tp{topic, partition}]
+}
+
+// topic returns the partitions of topic, creating it if needed. b.mu must be held.
+func (b *MemoryBroker) topic(name string) [][]*kgo.Record {
+	partitions, ok := b.topics[name]
+	if !ok {
+		partitions = make([][]*kgo.Record, b.partitions)
+		b.topics[name] = partitions
+		for _, g := range b.groups {
+			b.rebalance(g)
+		}
+	}
+	return partitions
+}
+
+// rebalance assigns the partitions of every topic round robin to the group members
+// subscribed to it, in join order. b.mu must be held.
+func (b *MemoryBroker) rebalance(g *memoryGroup) {
+	topics := make(map[string]bool)
+	for _, m := range g.members {
+		m.assigned = make(map[tp]bool)
+		for t := range m.handlers {
+			topics[t] = true
+		}
+	}
+	for t := range topics {
+		var subscribers []*memoryConsumerClient
+		for _, m := range g.members {
+			if _, ok := m.handlers[t]; ok {
+				subscribers = append(subscribers, m)
+			}
+		}
+		for p := range b.topic(t) {
+			subscribers[p%len(subscribers)].assigned[tp{t, int32(p)}] = true
+		}
+	}
+	for _, m := range g.members {
+		m.state.setAssigned(len(m.assigned))
+	}
+	countRebalance(g.id, "assigned")
+	log.Debug().Str("group", g.id).Int("members", len(g.members)).Msg("rebalanced memory group")
+	b.broadcast()
+}
+
+// broadcast wakes up polling consumers. b.mu must be held.
+func (b *MemoryBroker) broadcast() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+func (b *MemoryBroker) produce(rec *kgo.Record) error {
+	if rec.Topic == "" {
+		return errors.New("missing required topic")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	partitions := b.topic(rec.Topic)
+	var p int
+	if len(rec.Key) > 0 {
+		h := fnv.New32a()
+		h.Write(rec.Key)
+		p = int(h.Sum32() % uint32(len(partitions)))
+	} else {
+		p = b.roundRobin % len(partitions)
+		b.roundRobin++
+	}
+
+	stored := *rec
+	stored.Partition = int32(p)
+	stored.Offset = int64(len(partitions[p]))
+	if stored.Timestamp.IsZero() {
+		stored.Timestamp = time.Now()
+	}
+	partitions[p] = append(partitions[p], &stored)
+	rec.Partition, rec.Offset, rec.Timestamp = stored.Partition, stored.Offset, stored.Timestamp
+
+	b.broadcast()
+	return nil
+}
+
+var _ KafkaConsumerClient = (*memoryConsumerClient)(nil)
+
+type memoryConsumerClient struct {
+	b       *MemoryBroker
+	groupId string
+	joined  bool
+
+	// guarded by b.mu
+	handlers map[string]RecordHandler
+	assigned map[tp]bool
+
+	// retries are the partitions waiting to redeliver a record, only used by Poll.
+	retries map[tp]memoryRetry
+	state   *consumerState
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *memoryConsumerClient) SetRecordHandler(
+	topic string,
+	recordHandler RecordHandler,
+) error {
+	if topic == "" {
+		return errors.New("missing required topic")
+	}
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+
+	c.handlers[topic] = instrument(topic, recordHandler)
+	c.b.topic(topic)
+	g, ok := c.b.groups[c.groupId]
+	if !ok {
+		g = &memoryGroup{id: c.groupId, commits: make(map[tp]int64)}
+		c.b.groups[c.groupId] = g
+	}
+	if !c.joined {
+		c.joined = true
+		g.members = append(g.members, c)
+	}
+	c.b.rebalance(g)
+	return nil
+}
+
+// SetKeyFunc is a no-op since records are handled serially.
+func (c *memoryConsumerClient) SetKeyFunc(string, KeyFunc) {}
+
+// Poll processes records of assigned partitions from their committed offsets,
+// committing each record once its handler acks or dead-letters it. Partitions
+// waiting to redeliver a record are skipped until it is due.
+func (c *memoryConsumerClient) Poll(ctx context.Context) error {
+	defer c.state.stop(nil)
+	for {
+		work, due, wait := c.pending()
+		c.state.polled()
+		if len(work) == 0 {
+			var timer <-chan time.Time
+			if !due.IsZero() {
+				timer = time.After(time.Until(due))
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-c.closed:
+				return nil
+			case <-wait:
+			case <-timer:
+			case <-time.After(pollTimeout):
+			}
+			continue
+		}
+		for _, w := range work {
+			for _, rec := range w.recs {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-c.closed:
+					return nil
+				default:
+				}
+				handler, ok := c.owner(w.tp)
+				if !ok {
+					// revoked by a rebalance
+					break
+				}
+				retry := c.retries[w.tp]
+				commit, backoff := handleResult(rec, handler(rec), retry.attempt)
+				if !commit {
+					c.retries[w.tp] = memoryRetry{attempt: retry.attempt + 1, due: time.Now().Add(backoff)}
+					break
+				}
+				delete(c.retries, w.tp)
+				c.commit(w.tp, rec.Offset+1)
+			}
+		}
+	}
+}
+
+type memoryRetry struct {
+	attempt int
+	due     time.Time
+}
+
+type memoryWork struct {
+	tp   tp
+	recs []*kgo.Record
+}
+
+// pending returns the uncommitted records of assigned partitions that are not paused
+// or waiting to redeliver a record, when the next redelivery is due and the channel notifying
+// of new records or rebalances.
+func (c *memoryConsumerClient) pending() ([]memoryWork, time.Time, chan struct{}) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	g := c.b.groups[c.groupId]
+	var work []memoryWork
+	var due time.Time
+	if g != nil {
+		for tp := range c.assigned {
+			partition := c.b.topics[tp.t][tp.p]
+			setLag(c.groupId, tp.t, tp.p, int64(len(partition))-g.commits[tp])
+			if c.state.isPaused(tp.t) {
+				continue
+			}
+			if retry, ok := c.retries[tp]; ok && time.Now().Before(retry.due) {
+				if due.IsZero() || retry.due.Before(due) {
+					due = retry.due
+				}
+				continue
+			}
+			if next := g.commits[tp]; next < int64(len(partition)) {
+				work = append(work, memoryWork{tp: tp, recs: partition[next:]})
+			}
+		}
+	}
+	sort.Slice(work, func(i, j int) bool {
+		if work[i].tp.t != work[j].tp.t {
+			return work[i].tp.t < work[j].tp.t
+		}
+		return work[i].tp.p < work[j].tp.p
+	})
+	return work, due, c.b.notify
+}
+
+func (c *memoryConsumerClient) owner(tp tp) (RecordHandler, bool) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if !c.assigned[tp] {
+		return nil, false
+	}
+	return c.handlers[tp.t], true
+}
+
+// commit advances the committed offset if the partition is still assigned.
+func (c *memoryConsumerClient) commit(tp tp, offset int64) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if g := c.b.groups[c.groupId]; g != nil && c.assigned[tp] && offset > g.commits[tp] {
+		g.commits[tp] = offset
+	}
+}
+
+// Shutdown leaves the group, rebalancing its partitions to the remaining members.
+func (c *memoryConsumerClient) Shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.b.mu.Lock()
+		defer c.b.mu.Unlock()
+		g := c.b.groups[c.groupId]
+		if g == nil {
+			return
+		}
+		for i, m := range g.members {
+			if m == c {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				break
+			}
+		}
+		c.assigned = make(map[tp]bool)
+		c.state.setAssigned(0)
+		c.b.rebalance(g)
+	})
+}
+
+func (c *memoryConsumerClient) PauseTopics(topics ...string) {
+	c.state.setPaused(true, topics...)
+}
+
+func (c *memoryConsumerClient) ResumeTopics(topics ...string) {
+	c.state.setPaused(false, topics...)
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	c.b.broadcast()
+}
+
+func (c *memoryConsumerClient) Health() ConsumerHealth {
+	return c.state.snapshot()
+}
+
+var _ KafkaProducerClient = (*memoryProducerClient)(nil)
+
+type memoryProducerClient struct {
+	b *MemoryBroker
+}
+
+func (p *memoryProducerClient) ProduceSync(_ context.Context, recs ...*kgo.Record) error {
+	for _, rec := range recs {
+		if err := p.b.produce(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *memoryProducerClient) Produce(
+	_ context.Context,
+	rec *kgo.Record,
+	promise func(*kgo.Record, error),
+) {
+	err := p.b.produce(rec)
+	if promise != nil {
+		promise(rec, err)
+	}
+}
+
+func (p *memoryProducerClient) Flush(context.Context) error {
+	return nil
+}
+
+func (p *memoryProducerClient) Shutdown() {}
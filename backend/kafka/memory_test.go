@@ -0,0 +1,176 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	const (
+		topic   = "topic"
+		groupId = "group"
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := kafka.NewMemoryBroker(2)
+	producer := broker.NewProducerClient()
+
+	var mu sync.Mutex
+	consumed := make(map[string][]string)
+	handler := func(member string) kafka.RecordHandler {
+		return func(rec *kgo.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			consumed[member] = append(consumed[member], string(rec.Value))
+			return nil
+		}
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		var n int
+		for _, values := range consumed {
+			n += len(values)
+		}
+		return n
+	}
+	waitFor := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for count() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d records, got %d", n, count())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	produce := func(from, to int) {
+		for i := from; i < to; i++ {
+			rec := kafka.NewRecord(topic, fmt.Sprintf("key-%d", i), []byte(fmt.Sprint(i)))
+			if err := producer.ProduceSync(ctx, rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// two members split the partitions
+	a := broker.NewConsumerClient(groupId)
+	b := broker.NewConsumerClient(groupId)
+	if err := a.SetRecordHandler(topic, handler("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetRecordHandler(topic, handler("b")); err != nil {
+		t.Fatal(err)
+	}
+	go a.Poll(ctx)
+	go b.Poll(ctx)
+	produce(0, 10)
+	waitFor(10)
+	mu.Lock()
+	if len(consumed["a"]) == 0 || len(consumed["b"]) == 0 {
+		t.Fatalf("expected both members to consume, got %v", consumed)
+	}
+	mu.Unlock()
+
+	// leaving rebalances partitions to the remaining member
+	b.Shutdown()
+	produce(10, 20)
+	waitFor(20)
+	mu.Lock()
+	seen := make(map[string]bool)
+	for _, v := range append(consumed["a"], consumed["b"]...) {
+		seen[v] = true
+	}
+	if len(seen) != 20 {
+		t.Fatalf("expected all 20 records consumed, got %d", len(seen))
+	}
+	mu.Unlock()
+
+	// paused topics are not consumed until resumed
+	a.PauseTopics(topic)
+	if h := a.Health(); len(h.PausedTopics) != 1 || h.AssignedPartitions != 2 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	produce(20, 25)
+	time.Sleep(20 * time.Millisecond)
+	if n := count(); n != 20 {
+		t.Fatalf("expected paused topic not to be consumed, got %d records", n)
+	}
+	a.ResumeTopics(topic)
+	waitFor(25)
+
+	// a new group consumes from the beginning and commits
+	c := broker.NewConsumerClient("other")
+	if err := c.SetRecordHandler(topic, handler("c")); err != nil {
+		t.Fatal(err)
+	}
+	go c.Poll(ctx)
+	waitFor(50)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var committed int64
+		for p := int32(0); p < 2; p++ {
+			committed += broker.CommittedOffset("other", topic, p)
+		}
+		if committed == 25 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 25 committed offsets, got %d", committed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryBrokerDispositions(t *testing.T) {
+	const topic = "topic"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := kafka.NewMemoryBroker(1)
+	producer := broker.NewProducerClient()
+	cl := broker.NewConsumerClient("group")
+	defer cl.Shutdown()
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	if err := cl.SetRecordHandler(topic, func(rec *kgo.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		v := string(rec.Value)
+		attempts[v]++
+		switch {
+		case v == "poison":
+			return kafka.DeadLetterRecord(errors.New("poison"))
+		case v == "flaky" && attempts[v] == 1:
+			return kafka.RetryRecord(errors.New("flaky"))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go cl.Poll(ctx)
+	for _, v := range []string{"poison", "flaky", "ok"} {
+		if err := producer.ProduceSync(ctx, kafka.NewRecord(topic, "", []byte(v))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.CommittedOffset("group", topic, 0) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 committed offsets, got %d", broker.CommittedOffset("group", topic, 0))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["poison"] != 1 || attempts["flaky"] != 2 || attempts["ok"] != 1 {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+}
@@ -0,0 +1,134 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+var (
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "kafka",
+		Name:      "consumer_lag",
+		Help:      "Records between the committed offset and the end offset of a partition.",
+	}, []string{"group", "topic", "partition"})
+	recordsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "kafka",
+		Name:      "records_handled_total",
+		Help:      "Record handler calls by disposition.",
+	}, []string{"topic", "disposition"})
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "kafka",
+		Name:      "handler_duration_seconds",
+		Help:      "Record handler latency by disposition.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"topic", "disposition"})
+	handlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "kafka",
+		Name:      "handler_errors_total",
+		Help:      "Record handler errors by status code, \"none\" if not an app.Error.",
+	}, []string{"topic", "code"})
+	rebalances = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "kafka",
+		Name:      "rebalance_events_total",
+		Help:      "Partition assignments, revocations and losses by consumer group.",
+	}, []string{"group", "event"})
+)
+
+// instrument decorates handler with throughput, latency and error metrics.
+func instrument(topic string, handler RecordHandler) RecordHandler {
+	return func(rec *kgo.Record) error {
+		start := time.Now()
+		err := handler(rec)
+		d := DispositionOf(err).String()
+		recordsHandled.WithLabelValues(topic, d).Inc()
+		handlerDuration.WithLabelValues(topic, d).Observe(time.Since(start).Seconds())
+		if err != nil {
+			countHandlerError(topic, err)
+		}
+		return err
+	}
+}
+
+func countHandlerError(topic string, err error) {
+	code := "none"
+	var appErr app.Error
+	if errors.As(err, &appErr) {
+		code = strconv.Itoa(appErr.StatusCode())
+	}
+	handlerErrors.WithLabelValues(topic, code).Inc()
+}
+
+// lagInterval is the interval between lag updates of the split consumer.
+const lagInterval = 15 * time.Second
+
+// reportLag sets the lag of the assigned partitions from their end offsets and
+// the offsets marked for commit, or committed if none is marked yet. Partitions
+// are reported whether they're fetched, idle or paused.
+func (s *splitConsumerClient) reportLag(ctx context.Context) {
+	assigned := make(map[string][]int32)
+	for tp := range s.consumers {
+		assigned[tp.t] = append(assigned[tp.t], tp.p)
+	}
+	offsets := s.cl.CommittedOffsets()
+	for t, ps := range s.cl.MarkedOffsets() {
+		if offsets[t] == nil {
+			offsets[t] = make(map[int32]kgo.EpochOffset)
+		}
+		for p, o := range ps {
+			offsets[t][p] = o
+		}
+	}
+
+	listCtx, listCanc := context.WithTimeout(ctx, 5*time.Second)
+	defer listCanc()
+	for topic, partitions := range assigned {
+		ends, err := listOffsets(listCtx, s.cl, topic, partitions, endOffset)
+		if err != nil {
+			log.Warn().Err(err).Str("topic", topic).Msg("failed reporting lag")
+			continue
+		}
+		for p, lag := range partitionLags(ends, offsets[topic]) {
+			setLag(s.groupId, topic, p, lag)
+		}
+	}
+}
+
+// partitionLags returns the lag of the partitions with an end and committed offset.
+func partitionLags(ends map[int32]int64, committed map[int32]kgo.EpochOffset) map[int32]int64 {
+	lags := make(map[int32]int64, len(ends))
+	for p, end := range ends {
+		if o, ok := committed[p]; ok && o.Offset >= 0 {
+			lags[p] = end - o.Offset
+		}
+	}
+	return lags
+}
+
+func setLag(group, topic string, partition int32, lag int64) {
+	consumerLag.WithLabelValues(group, topic, strconv.Itoa(int(partition))).Set(float64(max(lag, 0)))
+}
+
+func deleteLag(group string, partitions map[string][]int32) {
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			consumerLag.DeleteLabelValues(group, topic, strconv.Itoa(int(p)))
+		}
+	}
+}
+
+func countRebalance(group, event string) {
+	rebalances.WithLabelValues(group, event).Inc()
+}
@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestPartitionLags(t *testing.T) {
+	lags := partitionLags(
+		map[int32]int64{0: 10, 1: 5, 2: 7, 3: 0},
+		map[int32]kgo.EpochOffset{
+			0: {Offset: 4},
+			1: {Offset: 5},
+			2: {Offset: -1},
+		},
+	)
+	want := map[int32]int64{0: 6, 1: 0}
+	if len(lags) != len(want) {
+		t.Fatalf("got lags %v, want %v", lags, want)
+	}
+	for p, lag := range want {
+		if lags[p] != lag {
+			t.Errorf("got lag %d of partition %d, want %d", lags[p], p, lag)
+		}
+	}
+}
+
+func TestLagOfRetryingPartition(t *testing.T) {
+	const (
+		topic   = "metrics.lag"
+		groupId = "metrics.lag.group"
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducerClient()
+	consumer := broker.NewConsumerClient(groupId)
+	defer consumer.Shutdown()
+	err := consumer.SetRecordHandler(topic, func(*kgo.Record) error {
+		return RetryRecord(errors.New("unavailable"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go consumer.Poll(ctx)
+
+	lag := consumerLag.WithLabelValues(groupId, topic, "0")
+	for i := 1; i <= 2; i++ {
+		// the partition waits to redeliver the first record while lag keeps up
+		if err := producer.ProduceSync(ctx, NewRecord(topic, "key", []byte("value"))); err != nil {
+			t.Fatal(err)
+		}
+		waitForGauge(t, func() float64 { return testutil.ToFloat64(lag) }, float64(i))
+	}
+}
+
+func TestHandlerErrorsOfRoutedRecords(t *testing.T) {
+	const topic = "metrics.errors"
+	ctx := context.Background()
+	broker := NewMemoryBroker(1)
+	producer := broker.NewProducerClient()
+	handler := RetryingRecordHandler(ctx, producer, RetryPolicy{
+		RetryTopic:      topic + ".retry",
+		DeadLetterTopic: topic + ".dlq",
+	}, func(*kgo.Record) error {
+		return app.NewErr(503, "Service Unavailable", "unavailable")
+	})
+
+	errs := handlerErrors.WithLabelValues(topic, "503")
+	before := testutil.ToFloat64(errs)
+	rec := NewRecord(topic, "key", []byte("value"))
+	if err := handler(rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(errs) - before; got != 1 {
+		t.Errorf("got %v handler errors, want 1", got)
+	}
+	if broker.topics[topic+".retry"] == nil {
+		t.Error("record not routed to retry topic")
+	}
+}
+
+func waitForGauge(t *testing.T, value func() float64, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for value() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v, got %v", want, value())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
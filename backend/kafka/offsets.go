@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// ListOffsets timestamps of the end and start offsets of partitions.
+const (
+	endOffset   int64 = -1
+	startOffset int64 = -2
+)
+
+// listOffsets returns the offsets of partitions of topic at timestamp, either a Unix
+// milli timestamp, endOffset or startOffset. Timestamps past the last record of a
+// partition return -1. If partitions is empty, every partition of topic is listed.
+func listOffsets(
+	ctx context.Context,
+	cl *kgo.Client,
+	topic string,
+	partitions []int32,
+	timestamp int64,
+) (map[int32]int64, error) {
+	if len(partitions) == 0 {
+		var err error
+		if partitions, err = topicPartitions(ctx, cl, topic); err != nil {
+			return nil, err
+		}
+	}
+
+	req := kmsg.NewPtrListOffsetsRequest()
+	rt := kmsg.NewListOffsetsRequestTopic()
+	rt.Topic = topic
+	for _, p := range partitions {
+		rp := kmsg.NewListOffsetsRequestTopicPartition()
+		rp.Partition = p
+		rp.Timestamp = timestamp
+		rt.Partitions = append(rt.Partitions, rp)
+	}
+	req.Topics = append(req.Topics, rt)
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing offsets of %s: %w", topic, err)
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, t := range resp.Topics {
+		for _, p := range t.Partitions {
+			if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return nil, fmt.Errorf("failed listing offsets of %s[%d]: %w", topic, p.Partition, err)
+			}
+			offsets[p.Partition] = p.Offset
+		}
+	}
+	return offsets, nil
+}
+
+func topicPartitions(ctx context.Context, cl *kgo.Client, topic string) ([]int32, error) {
+	req := kmsg.NewPtrMetadataRequest()
+	rt := kmsg.NewMetadataRequestTopic()
+	rt.Topic = kmsg.StringPtr(topic)
+	req.Topics = append(req.Topics, rt)
+	resp, err := req.RequestWith(ctx, cl)
+	if err != nil {
+		return nil, fmt.Errorf("failed metadata of %s: %w", topic, err)
+	}
+	if len(resp.Topics) != 1 {
+		return nil, fmt.Errorf("missing metadata of %s", topic)
+	}
+	if err := kerr.ErrorForCode(resp.Topics[0].ErrorCode); err != nil {
+		return nil, fmt.Errorf("failed metadata of %s: %w", topic, err)
+	}
+	partitions := make([]int32, 0, len(resp.Topics[0].Partitions))
+	for _, p := range resp.Topics[0].Partitions {
+		partitions = append(partitions, p.Partition)
+	}
+	return partitions, nil
+}
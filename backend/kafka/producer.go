@@ -0,0 +1,73 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type KafkaProducerClient interface {
+	// ProduceSync produces recs and waits until all are acknowledged.
+	ProduceSync(context.Context, ...*kgo.Record) error
+	// Produce produces rec asynchronously. promise is called once rec is acknowledged or failed.
+	Produce(ctx context.Context, rec *kgo.Record, promise func(*kgo.Record, error))
+	// Flush waits until all buffered records are acknowledged.
+	Flush(context.Context) error
+	Shutdown()
+}
+
+var _ KafkaProducerClient = (*producerClient)(nil)
+
+type producerClient struct {
+	cl *kgo.Client
+}
+
+// NewProducerClient constructs a KafkaProducerClient sharing the connection
+// configuration of NewSplitConsumerClient. Records with the same key are
+// produced to the same partition.
+func NewProducerClient(ctx context.Context, cfg backend.KafkaConfig) *producerClient {
+	return &producerClient{
+		cl: NewClient(ctx, cfg, kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil))),
+	}
+}
+
+// NewRecord constructs a record for topic partitioned by key.
+func NewRecord(topic, key string, value []byte) *kgo.Record {
+	rec := &kgo.Record{
+		Topic: topic,
+		Value: value,
+	}
+	if key != "" {
+		rec.Key = []byte(key)
+	}
+	return rec
+}
+
+func (p *producerClient) ProduceSync(ctx context.Context, recs ...*kgo.Record) error {
+	return p.cl.ProduceSync(ctx, recs...).FirstErr()
+}
+
+func (p *producerClient) Produce(
+	ctx context.Context,
+	rec *kgo.Record,
+	promise func(*kgo.Record, error),
+) {
+	p.cl.Produce(ctx, rec, promise)
+}
+
+func (p *producerClient) Flush(ctx context.Context) error {
+	return p.cl.Flush(ctx)
+}
+
+// Shutdown flushes buffered records before closing the client.
+func (p *producerClient) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.cl.Flush(ctx); err != nil {
+		log.Error().Err(err).Msg("failed producer flush")
+	}
+	p.cl.Close()
+}
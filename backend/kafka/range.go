@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// RangeQuery selects records of a topic partition by offset and timestamp.
+// Zero values are unbounded.
+type RangeQuery struct {
+	Topic     string
+	Partition int32
+	// FromOffset is inclusive and ToOffset exclusive.
+	FromOffset, ToOffset int64
+	// Since is inclusive and Until exclusive.
+	Since, Until time.Time
+}
+
+// startOffset seeks to Since if set. Records preceding FromOffset are skipped by contains.
+func (q RangeQuery) startOffset() kgo.Offset {
+	if !q.Since.IsZero() {
+		return kgo.NewOffset().AfterMilli(q.Since.UnixMilli())
+	}
+	return kgo.NewOffset().At(q.FromOffset)
+}
+
+// contains reports whether rec is in the range, given it precedes the stop offset.
+// Timestamps aren't ordered by offset, so records are filtered by them rather than
+// stopping at the first record at Until.
+func (q RangeQuery) contains(rec *kgo.Record) bool {
+	return rec.Offset >= q.FromOffset &&
+		(q.Since.IsZero() || !rec.Timestamp.Before(q.Since)) &&
+		(q.Until.IsZero() || rec.Timestamp.Before(q.Until))
+}
+
+// stopOffset returns the exclusive end offset of the range given the end offset
+// of the partition and the first offset at Until, -1 if no record is.
+func (q RangeQuery) stopOffset(end, untilOffset int64) int64 {
+	if !q.Until.IsZero() && untilOffset >= 0 && untilOffset < end {
+		end = untilOffset
+	}
+	if q.ToOffset > 0 && q.ToOffset < end {
+		end = q.ToOffset
+	}
+	return end
+}
+
+// ReadRange calls fn with the records of q in offset order until the range or the
+// partition, as of the call, is exhausted. The range ends at the first offset with
+// a timestamp at Until, as listed by the broker. It returns the number of records
+// read and stops at the first error of fn, or with an error if no records are
+// fetched for 5s before the range is exhausted. Offsets are not committed.
+func ReadRange(
+	ctx context.Context,
+	cfg backend.KafkaConfig,
+	q RangeQuery,
+	fn func(*kgo.Record) error,
+) (int, error) {
+	if q.Topic == "" {
+		return 0, errors.New("missing required topic")
+	}
+	cl, err := newClient(
+		ctx,
+		cfg,
+		kgo.ConsumePartitions(map[string]map[int32]kgo.Offset{
+			q.Topic: {q.Partition: q.startOffset()},
+		}),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer cl.Close()
+
+	partitions := []int32{q.Partition}
+	ends, err := listOffsets(ctx, cl, q.Topic, partitions, endOffset)
+	if err != nil {
+		return 0, err
+	}
+	untilOffset := int64(-1)
+	if !q.Until.IsZero() {
+		untils, err := listOffsets(ctx, cl, q.Topic, partitions, q.Until.UnixMilli())
+		if err != nil {
+			return 0, err
+		}
+		untilOffset = untils[q.Partition]
+	}
+	stop := q.stopOffset(ends[q.Partition], untilOffset)
+	if q.FromOffset >= stop {
+		return 0, nil
+	}
+
+	read := 0
+	next := q.FromOffset
+	for {
+		pollCtx, pollCanc := context.WithTimeout(ctx, 5*time.Second)
+		fetches := cl.PollFetches(pollCtx)
+		pollCanc()
+		for _, fe := range fetches.Errors() {
+			if !errors.Is(fe.Err, context.DeadlineExceeded) {
+				return read, fe.Err
+			}
+		}
+		if fetches.NumRecords() == 0 {
+			if err := ctx.Err(); err != nil {
+				return read, err
+			}
+			// the range isn't exhausted, so don't report it as read
+			return read, fmt.Errorf("timed out reading %s[%d] at offset %d before stop offset %d",
+				q.Topic, q.Partition, next, stop)
+		}
+
+		for _, p := range fetches {
+			for _, t := range p.Topics {
+				for _, part := range t.Partitions {
+					for _, rec := range part.Records {
+						if rec.Offset >= stop {
+							return read, nil
+						}
+						if !q.contains(rec) {
+							continue
+						}
+						if err := fn(rec); err != nil {
+							return read, err
+						}
+						read++
+					}
+					if n := len(part.Records); n > 0 {
+						next = part.Records[n-1].Offset + 1
+					}
+					if next >= stop {
+						return read, nil
+					}
+				}
+			}
+		}
+	}
+}
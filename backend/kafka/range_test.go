@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestRangeQuery(t *testing.T) {
+	now := time.Now()
+	q := RangeQuery{FromOffset: 2, Since: now.Add(-time.Hour), Until: now}
+
+	tests := []struct {
+		name string
+		rec  *kgo.Record
+		want bool
+	}{
+		{name: "in range", rec: &kgo.Record{Offset: 2, Timestamp: now.Add(-time.Minute)}, want: true},
+		{name: "at since", rec: &kgo.Record{Offset: 3, Timestamp: q.Since}, want: true},
+		{name: "before from offset", rec: &kgo.Record{Offset: 1, Timestamp: now.Add(-time.Minute)}},
+		{name: "before since", rec: &kgo.Record{Offset: 4, Timestamp: now.Add(-2 * time.Hour)}},
+		{name: "at until", rec: &kgo.Record{Offset: 5, Timestamp: now}},
+		{name: "after until", rec: &kgo.Record{Offset: 6, Timestamp: now.Add(time.Minute)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := q.contains(tt.rec); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeQueryStopOffset(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		q           RangeQuery
+		untilOffset int64
+		want        int64
+	}{
+		{name: "unbounded", q: RangeQuery{}, untilOffset: -1, want: 10},
+		{name: "to offset", q: RangeQuery{ToOffset: 5}, untilOffset: -1, want: 5},
+		{name: "to offset past end", q: RangeQuery{ToOffset: 20}, untilOffset: -1, want: 10},
+		{name: "until", q: RangeQuery{Until: now}, untilOffset: 7, want: 7},
+		{name: "until past last record", q: RangeQuery{Until: now}, untilOffset: -1, want: 10},
+		{name: "to offset before until", q: RangeQuery{ToOffset: 3, Until: now}, untilOffset: 7, want: 3},
+		{name: "until before to offset", q: RangeQuery{ToOffset: 8, Until: now}, untilOffset: 7, want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.stopOffset(10, tt.untilOffset); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/httputil"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Record headers set on retried and dead-lettered records.
+const (
+	HeaderRetryCount        = "x-retry-count"
+	HeaderRetryAt           = "x-retry-at"
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+	HeaderStatusCode        = "x-status-code"
+	HeaderFailedAt          = "x-failed-at"
+)
+
+// RetryPolicy routes failed records to RetryTopic with exponential backoff
+// until MaxRetries is exhausted and to DeadLetterTopic afterwards or on permanent errors.
+type RetryPolicy struct {
+	RetryTopic      string
+	DeadLetterTopic string
+	// MaxRetries defaults to 5, a negative value dead-letters without retrying.
+	MaxRetries int
+	Backoff    httputil.ExponentialBackoffConfigs
+}
+
+// IsRetryable classifies handler errors. Timeouts and app.Errors with 5xx, 408 and 429
+// status codes are retryable. Anything else, like parse errors, is permanent.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var appErr app.Error
+	if errors.As(err, &appErr) {
+		code := appErr.StatusCode()
+		return code >= 500 || code == 408 || code == 429
+	}
+	return false
+}
+
+// RetryingRecordHandler decorates handler to route failed records according to policy.
+// The returned record handler must be set on both the source topic and policy.RetryTopic.
+// Partitions of the retry topic are paused until the HeaderRetryAt of their next record.
+// Records are only committed once routed, so failing to produce them redelivers them.
+func RetryingRecordHandler(
+	ctx context.Context,
+	producer KafkaProducerClient,
+	policy RetryPolicy,
+	handler RecordHandler,
+) RecordHandler {
+	// set defaults
+	if policy.MaxRetries == 0 {
+		policy.MaxRetries = 5
+	}
+	if policy.Backoff.Interval == 0 {
+		policy.Backoff.Interval = 10 * time.Second
+	}
+	if policy.Backoff.Max == 0 {
+		policy.Backoff.Max = time.Hour
+	}
+	if policy.Backoff.Rate == 0 {
+		policy.Backoff.Rate = 3
+	}
+
+	return func(rec *kgo.Record) error {
+		retryCount := 0
+		if rec.Topic == policy.RetryTopic {
+			retryCount, _ = strconv.Atoi(header(rec, HeaderRetryCount))
+			if wait := untilRetryAt(rec); wait > 0 {
+				return PausePartition(errors.New("retry not due"), wait)
+			}
+		}
+
+		err := handler(rec)
+		if err == nil {
+			return nil
+		}
+
+		var out *kgo.Record
+		d := DispositionOf(err)
+		if d == Pause {
+			return err
+		} else if d == Retry && policy.RetryTopic != "" && retryCount < policy.MaxRetries {
+			backoff := httputil.ExponentialBackoff(policy.Backoff, retryCount)
+			out = failedRecord(rec, policy.RetryTopic, err)
+			setHeader(out, HeaderRetryCount, strconv.Itoa(retryCount+1))
+			setHeader(out, HeaderRetryAt, strconv.FormatInt(time.Now().Add(backoff).UnixMilli(), 10))
+			log.Warn().Err(err).
+				Str("topic", rec.Topic).
+				Int64("offset", rec.Offset).
+				Int("retry", retryCount+1).
+				Dur("backoff", backoff).
+				Msg("retrying record")
+		} else if policy.DeadLetterTopic != "" {
+			out = failedRecord(rec, policy.DeadLetterTopic, err)
+			log.Error().Err(err).
+				Str("topic", rec.Topic).
+				Int64("offset", rec.Offset).
+				Int("retries", retryCount).
+				Msg("dead-lettering record")
+		} else {
+			return DeadLetterRecord(err)
+		}
+
+		if err := producer.ProduceSync(ctx, out); err != nil {
+			log.Error().Err(err).
+				Str("topic", out.Topic).
+				Str("originalTopic", header(out, HeaderOriginalTopic)).
+				Str("originalOffset", header(out, HeaderOriginalOffset)).
+				Msg("failed producing failed record")
+			return RetryRecord(err)
+		}
+		// routed records are acked, so count the failure here
+		countHandlerError(rec.Topic, err)
+		return nil
+	}
+}
+
+// failedRecord copies rec to topic with error metadata headers. The original
+// topic, partition and offset are kept from the first failure.
+func failedRecord(rec *kgo.Record, topic string, err error) *kgo.Record {
+	out := &kgo.Record{
+		Topic:   topic,
+		Key:     rec.Key,
+		Value:   rec.Value,
+		Headers: append([]kgo.RecordHeader(nil), rec.Headers...),
+	}
+	if header(out, HeaderOriginalTopic) == "" {
+		setHeader(out, HeaderOriginalTopic, rec.Topic)
+		setHeader(out, HeaderOriginalPartition, strconv.Itoa(int(rec.Partition)))
+		setHeader(out, HeaderOriginalOffset, strconv.FormatInt(rec.Offset, 10))
+	}
+	setHeader(out, HeaderError, err.Error())
+	var appErr app.Error
+	if errors.As(err, &appErr) {
+		setHeader(out, HeaderStatusCode, strconv.Itoa(appErr.StatusCode()))
+	}
+	setHeader(out, HeaderFailedAt, time.Now().UTC().Format(time.RFC3339))
+	return out
+}
+
+// SourceId identifies the record rec was first consumed as, following it through
+// the retry and dead letter topics, as "topic/partition/offset".
+func SourceId(rec *kgo.Record) string {
+	if topic := header(rec, HeaderOriginalTopic); topic != "" {
+		return topic + "/" + header(rec, HeaderOriginalPartition) + "/" + header(rec, HeaderOriginalOffset)
+	}
+	return rec.Topic + "/" + strconv.Itoa(int(rec.Partition)) + "/" + strconv.FormatInt(rec.Offset, 10)
+}
+
+// untilRetryAt returns how long until the record is due.
+func untilRetryAt(rec *kgo.Record) time.Duration {
+	retryAt, err := strconv.ParseInt(header(rec, HeaderRetryAt), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.UnixMilli(retryAt))
+}
+
+func header(rec *kgo.Record, key string) string {
+	for _, h := range rec.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func setHeader(rec *kgo.Record, key, value string) {
+	for i, h := range rec.Headers {
+		if h.Key == key {
+			rec.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	rec.Headers = append(rec.Headers, kgo.RecordHeader{Key: key, Value: []byte(value)})
+}
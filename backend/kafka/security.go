@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// Security protocols of KafkaConfig.SecurityProtocol.
+const (
+	ProtocolPlaintext     = "PLAINTEXT"
+	ProtocolSSL           = "SSL"
+	ProtocolSaslPlaintext = "SASL_PLAINTEXT"
+	ProtocolSaslSSL       = "SASL_SSL"
+)
+
+// SASL mechanisms of KafkaConfig.SaslMechanism.
+const (
+	MechanismPlain       = "PLAIN"
+	MechanismScramSha256 = "SCRAM-SHA-256"
+	MechanismScramSha512 = "SCRAM-SHA-512"
+)
+
+// securityOpts returns the dialer and SASL opts described by cfg.
+func securityOpts(cfg backend.KafkaConfig) ([]kgo.Opt, error) {
+	protocol := strings.ToUpper(cfg.SecurityProtocol)
+	if protocol == "" {
+		protocol = ProtocolSaslSSL
+	}
+
+	var useTLS, useSASL bool
+	switch protocol {
+	case ProtocolPlaintext:
+	case ProtocolSSL:
+		useTLS = true
+	case ProtocolSaslPlaintext:
+		useSASL = true
+	case ProtocolSaslSSL:
+		useTLS, useSASL = true, true
+	default:
+		return nil, fmt.Errorf("unknown kafka security protocol %s", cfg.SecurityProtocol)
+	}
+	if !useTLS && (cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "") {
+		return nil, fmt.Errorf("kafka TLS files require security protocol %s or %s", ProtocolSSL, ProtocolSaslSSL)
+	}
+
+	netDialer := &net.Dialer{Timeout: 10 * time.Second}
+	var opts []kgo.Opt
+	if useTLS {
+		tlsCfg, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		tlsDialer := &tls.Dialer{NetDialer: netDialer, Config: tlsCfg}
+		opts = append(opts, kgo.Dialer(tlsDialer.DialContext))
+	} else {
+		opts = append(opts, kgo.Dialer(netDialer.DialContext))
+	}
+	if useSASL {
+		mechanism, err := saslMechanism(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	return opts, nil
+}
+
+func tlsConfig(cfg backend.KafkaConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		ca, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in kafka CA file %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("kafka client certificate requires both CertFile and KeyFile")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading kafka client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func saslMechanism(cfg backend.KafkaConfig) (sasl.Mechanism, error) {
+	if cfg.User == "" {
+		return nil, errors.New("kafka SASL requires User and Password")
+	}
+	scramAuth := func(context.Context) (scram.Auth, error) {
+		return scram.Auth{
+			User: cfg.User,
+			Pass: cfg.Password,
+		}, nil
+	}
+	switch strings.ToUpper(cfg.SaslMechanism) {
+	case MechanismScramSha512, "":
+		return scram.Sha512(scramAuth), nil
+	case MechanismScramSha256:
+		return scram.Sha256(scramAuth), nil
+	case MechanismPlain:
+		return plain.Auth{
+			User: cfg.User,
+			Pass: cfg.Password,
+		}.AsMechanism(), nil
+	default:
+		return nil, fmt.Errorf("unknown kafka SASL mechanism %s", cfg.SaslMechanism)
+	}
+}
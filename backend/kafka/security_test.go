@@ -0,0 +1,166 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+)
+
+func TestSecurityOpts(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+	badFile := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  backend.KafkaConfig
+		// opts is the number of opts, a dialer and a SASL mechanism if any
+		opts      int
+		mechanism string
+		// tls checks the TLS config of the SSL protocols
+		tls bool
+		err string
+	}{
+		{name: "default", cfg: backend.KafkaConfig{User: "u"}, opts: 2, mechanism: "SCRAM-SHA-512"},
+		{name: "plaintext", cfg: backend.KafkaConfig{SecurityProtocol: "plaintext"}, opts: 1},
+		{name: "ssl", cfg: backend.KafkaConfig{SecurityProtocol: "SSL"}, opts: 1, tls: true},
+		{
+			name: "ssl with ca and client cert",
+			cfg: backend.KafkaConfig{
+				SecurityProtocol: "SSL",
+				CAFile:           certFile,
+				CertFile:         certFile,
+				KeyFile:          keyFile,
+			},
+			opts: 1,
+			tls:  true,
+		},
+		{
+			name:      "sasl plaintext plain",
+			cfg:       backend.KafkaConfig{SecurityProtocol: "SASL_PLAINTEXT", SaslMechanism: "PLAIN", User: "u"},
+			opts:      2,
+			mechanism: "PLAIN",
+		},
+		{
+			name:      "sasl plaintext scram-sha-256",
+			cfg:       backend.KafkaConfig{SecurityProtocol: "SASL_PLAINTEXT", SaslMechanism: "scram-sha-256", User: "u"},
+			opts:      2,
+			mechanism: "SCRAM-SHA-256",
+		},
+		{
+			name:      "sasl ssl scram-sha-512",
+			cfg:       backend.KafkaConfig{SecurityProtocol: "SASL_SSL", SaslMechanism: "SCRAM-SHA-512", User: "u"},
+			opts:      2,
+			mechanism: "SCRAM-SHA-512",
+			tls:       true,
+		},
+		{
+			name:      "sasl ssl plain with ca",
+			cfg:       backend.KafkaConfig{SaslMechanism: "PLAIN", User: "u", CAFile: certFile},
+			opts:      2,
+			mechanism: "PLAIN",
+			tls:       true,
+		},
+		{name: "unknown protocol", cfg: backend.KafkaConfig{SecurityProtocol: "TLS"}, err: "unknown kafka security protocol"},
+		{name: "unknown mechanism", cfg: backend.KafkaConfig{SaslMechanism: "GSSAPI", User: "u"}, err: "unknown kafka SASL mechanism"},
+		{name: "sasl without user", cfg: backend.KafkaConfig{SecurityProtocol: "SASL_PLAINTEXT"}, err: "requires User"},
+		{
+			name: "tls files without tls",
+			cfg:  backend.KafkaConfig{SecurityProtocol: "SASL_PLAINTEXT", User: "u", CAFile: certFile},
+			err:  "require security protocol",
+		},
+		{name: "missing ca", cfg: backend.KafkaConfig{SecurityProtocol: "SSL", CAFile: filepath.Join(dir, "missing.pem")}, err: "failed reading kafka CA file"},
+		{name: "invalid ca", cfg: backend.KafkaConfig{SecurityProtocol: "SSL", CAFile: badFile}, err: "no certificates found"},
+		{name: "cert without key", cfg: backend.KafkaConfig{SecurityProtocol: "SSL", CertFile: certFile}, err: "requires both CertFile and KeyFile"},
+		{
+			name: "invalid key",
+			cfg:  backend.KafkaConfig{SecurityProtocol: "SSL", CertFile: certFile, KeyFile: badFile},
+			err:  "failed loading kafka client certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := securityOpts(tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(opts) != tt.opts {
+				t.Errorf("got %d opts, want %d", len(opts), tt.opts)
+			}
+			if tt.mechanism != "" {
+				m, err := saslMechanism(tt.cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m.Name() != tt.mechanism {
+					t.Errorf("got mechanism %s, want %s", m.Name(), tt.mechanism)
+				}
+			}
+			if tt.tls {
+				tlsCfg, err := tlsConfig(tt.cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if (tlsCfg.RootCAs != nil) != (tt.cfg.CAFile != "") ||
+					(len(tlsCfg.Certificates) == 1) != (tt.cfg.CertFile != "") {
+					t.Errorf("unexpected TLS config %+v", tlsCfg)
+				}
+			}
+		})
+	}
+}
+
+// writeCert writes a self-signed certificate and its key to dir.
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
@@ -0,0 +1,161 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KeyFunc returns the ordering key of a record. With KafkaConfig.Workers > 1,
+// records of a partition sharing a key are handled in offset order while records
+// with different keys are handled concurrently.
+type KeyFunc func(*kgo.Record) string
+
+// RecordKey is the default KeyFunc ordering records by their Kafka key.
+func RecordKey(rec *kgo.Record) string {
+	return string(rec.Key)
+}
+
+// maxInflightRecords bounds the records of a partition dispatched but not yet committed.
+const maxInflightRecords = 1000
+
+// orderedDispatcher runs the records of a partition on a shared worker pool,
+// ordered per key. Records are committed up to the last of the contiguous
+// completed records, in dispatch order.
+type orderedDispatcher struct {
+	workers chan struct{} // shared by all partitions of the client
+	window  chan struct{}
+	quit    <-chan struct{}
+	keyFn   KeyFunc
+	// attempt handles a record, see pConsumer.attempt, and await waits to redeliver it.
+	attempt func(rec *kgo.Record, attempt int) (commit bool, wait time.Duration)
+	await   func(time.Duration) bool
+	commit  func(*kgo.Record)
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	inflight  []*inflightRecord
+	lastByKey map[string]*inflightRecord
+}
+
+type inflightRecord struct {
+	rec       *kgo.Record
+	key       string
+	done      chan struct{}
+	completed bool
+}
+
+func newOrderedDispatcher(
+	workers chan struct{},
+	quit <-chan struct{},
+	keyFn KeyFunc,
+	attempt func(*kgo.Record, int) (bool, time.Duration),
+	await func(time.Duration) bool,
+	commit func(*kgo.Record),
+) *orderedDispatcher {
+	if keyFn == nil {
+		keyFn = RecordKey
+	}
+	return &orderedDispatcher{
+		workers:   workers,
+		window:    make(chan struct{}, maxInflightRecords),
+		quit:      quit,
+		keyFn:     keyFn,
+		attempt:   attempt,
+		await:     await,
+		commit:    commit,
+		lastByKey: make(map[string]*inflightRecord),
+	}
+}
+
+// dispatch schedules rec after the previous record with its key. It blocks while
+// maxInflightRecords are uncommitted and reports false if quit first.
+func (d *orderedDispatcher) dispatch(rec *kgo.Record) bool {
+	select {
+	case d.window <- struct{}{}:
+	case <-d.quit:
+		return false
+	}
+	r := &inflightRecord{
+		rec:  rec,
+		key:  d.keyFn(rec),
+		done: make(chan struct{}),
+	}
+	d.mu.Lock()
+	prev := d.lastByKey[r.key]
+	d.lastByKey[r.key] = r
+	d.inflight = append(d.inflight, r)
+	d.mu.Unlock()
+
+	d.wg.Add(1)
+	go d.run(r, prev)
+	return true
+}
+
+func (d *orderedDispatcher) run(r, prev *inflightRecord) {
+	defer d.wg.Done()
+	defer close(r.done)
+	if prev != nil {
+		<-prev.done
+	}
+	// prev is only done without completing once quit
+	for attempt := 0; ; attempt++ {
+		commit, wait, ok := d.work(r.rec, attempt)
+		if !ok {
+			return
+		}
+		if commit {
+			d.complete(r)
+			return
+		}
+		// waiting to redeliver doesn't hold a worker
+		if !d.await(wait) {
+			return
+		}
+	}
+}
+
+// work runs an attempt of rec on a worker. It reports false if quit first.
+func (d *orderedDispatcher) work(rec *kgo.Record, attempt int) (bool, time.Duration, bool) {
+	select {
+	case <-d.quit:
+		return false, 0, false
+	case d.workers <- struct{}{}:
+	}
+	defer func() { <-d.workers }()
+	select {
+	case <-d.quit:
+		return false, 0, false
+	default:
+	}
+	commit, wait := d.attempt(rec, attempt)
+	return commit, wait, true
+}
+
+func (d *orderedDispatcher) complete(r *inflightRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r.completed = true
+	if d.lastByKey[r.key] == r {
+		delete(d.lastByKey, r.key)
+	}
+
+	var n int
+	for n < len(d.inflight) && d.inflight[n].completed {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	d.commit(d.inflight[n-1].rec)
+	d.inflight = d.inflight[n:]
+	for i := 0; i < n; i++ {
+		<-d.window
+	}
+}
+
+// wait blocks until all dispatched records are handled or abandoned after quit.
+func (d *orderedDispatcher) wait() {
+	d.wg.Wait()
+}
@@ -0,0 +1,131 @@
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestOrderedDispatcher(t *testing.T) {
+	const records = 40
+	quit := make(chan struct{})
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	handled := make(map[string][]int64)
+	var commits []int64
+	d := newOrderedDispatcher(
+		make(chan struct{}, 4),
+		quit,
+		nil,
+		func(rec *kgo.Record, _ int) (bool, time.Duration) {
+			if rec.Offset == 1 {
+				// hold the second record while the other keys proceed
+				<-release
+			}
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			handled[string(rec.Key)] = append(handled[string(rec.Key)], rec.Offset)
+			return true, 0
+		},
+		func(time.Duration) bool { return true },
+		func(rec *kgo.Record) {
+			mu.Lock()
+			defer mu.Unlock()
+			commits = append(commits, rec.Offset)
+		},
+	)
+	for i := 0; i < records; i++ {
+		rec := &kgo.Record{Key: []byte(fmt.Sprintf("key-%d", i%4)), Offset: int64(i)}
+		if !d.dispatch(rec) {
+			t.Fatal("unexpected quit")
+		}
+	}
+
+	// other keys complete, but commits can't pass the held record
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(handled["key-0"]) + len(handled["key-2"]) + len(handled["key-3"])
+		mu.Unlock()
+		if n == 30 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for other keys, handled %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	if len(handled["key-1"]) != 0 {
+		t.Fatalf("expected key-1 to wait for the held record, got %v", handled["key-1"])
+	}
+	if len(commits) > 0 && commits[len(commits)-1] > 0 {
+		t.Fatalf("expected commits not to pass offset 0, got %v", commits)
+	}
+	mu.Unlock()
+
+	close(release)
+	d.wait()
+	for key, offsets := range handled {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Fatalf("%s handled out of order: %v", key, offsets)
+			}
+		}
+	}
+	if len(commits) == 0 || commits[len(commits)-1] != records-1 {
+		t.Fatalf("expected last commit %d, got %v", records-1, commits)
+	}
+	for i := 1; i < len(commits); i++ {
+		if commits[i] <= commits[i-1] {
+			t.Fatalf("commits moved backwards: %v", commits)
+		}
+	}
+}
+
+func TestOrderedDispatcherReleasesWorkers(t *testing.T) {
+	quit := make(chan struct{})
+	waiting := make(chan struct{})
+	redeliver := make(chan struct{})
+	handled := make(chan int64, 2)
+	d := newOrderedDispatcher(
+		make(chan struct{}, 1),
+		quit,
+		nil,
+		func(rec *kgo.Record, attempt int) (bool, time.Duration) {
+			if rec.Offset == 0 && attempt == 0 {
+				return false, time.Hour
+			}
+			handled <- rec.Offset
+			return true, 0
+		},
+		func(time.Duration) bool {
+			close(waiting)
+			<-redeliver
+			return true
+		},
+		func(*kgo.Record) {},
+	)
+	d.dispatch(&kgo.Record{Key: []byte("a"), Offset: 0})
+	<-waiting
+	// the only worker is free while offset 0 awaits redelivery
+	d.dispatch(&kgo.Record{Key: []byte("b"), Offset: 1})
+	select {
+	case offset := <-handled:
+		if offset != 1 {
+			t.Fatalf("handled %d first", offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out, worker held while awaiting redelivery")
+	}
+	close(redeliver)
+	if offset := <-handled; offset != 0 {
+		t.Fatalf("redelivered %d", offset)
+	}
+	d.wait()
+}
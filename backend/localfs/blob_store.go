@@ -0,0 +1,92 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/rs/zerolog/log"
+)
+
+var _ emailsvc.BlobStore = (*blobStore)(nil)
+
+var digestPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type blobStore struct {
+	dir string
+}
+
+// BlobStoreFromConfig constructs the BlobStore configured by cfg, or nil if it has no Dir.
+func BlobStoreFromConfig(cfg backend.BlobStoreConfig) emailsvc.BlobStore {
+	if cfg.Dir == "" {
+		return nil
+	}
+	return NewBlobStore(cfg.Dir)
+}
+
+// NewBlobStore constructs a BlobStore keeping blobs as files in dir,
+// sharded by the first two characters of their digest.
+func NewBlobStore(dir string) *blobStore {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal().Err(err).Str("dir", dir).Msg("failed creating blob store dir")
+	}
+	return &blobStore{
+		dir: dir,
+	}
+}
+
+func (s *blobStore) PutBlob(_ context.Context, content []byte) (string, app.Error) {
+	const op = "blobStore.PutBlob"
+	digest := emailsvc.BlobDigest(content)
+	path := s.path(digest)
+	if _, err := os.Stat(path); err == nil {
+		return digest, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", app.FromErr(err, fmt.Sprintf("%s: MkdirAll", op))
+	}
+
+	// write to a temp file first so readers never see partial blobs
+	f, err := os.CreateTemp(filepath.Dir(path), digest+".*.tmp")
+	if err != nil {
+		return "", app.FromErr(err, fmt.Sprintf("%s: CreateTemp", op))
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return "", app.FromErr(err, fmt.Sprintf("%s: Write", op))
+	}
+	if err := f.Close(); err != nil {
+		return "", app.FromErr(err, fmt.Sprintf("%s: Close", op))
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", app.FromErr(err, fmt.Sprintf("%s: Rename", op))
+	}
+	return digest, nil
+}
+
+func (s *blobStore) OpenBlob(_ context.Context, digest string) (io.ReadCloser, app.Error) {
+	const op = "blobStore.OpenBlob"
+	if !digestPattern.MatchString(digest) {
+		return nil, app.NewErr(http.StatusNotFound, "", op+": invalid digest")
+	}
+	f, err := os.Open(s.path(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, app.NewErr(http.StatusNotFound, "", op)
+	} else if err != nil {
+		return nil, app.FromErr(err, op)
+	}
+	return f, nil
+}
+
+func (s *blobStore) path(digest string) string {
+	return filepath.Join(s.dir, digest[:2], digest)
+}
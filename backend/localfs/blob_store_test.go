@@ -0,0 +1,50 @@
+package localfs_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/localfs"
+)
+
+func TestBlobStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := localfs.NewBlobStore(dir)
+
+	content := []byte("hello, world")
+	digest, err := s.PutBlob(ctx, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != emailsvc.BlobDigest(content) {
+		t.Fatalf("got digest %s", digest)
+	}
+	if again, err := s.PutBlob(ctx, content); err != nil || again != digest {
+		t.Fatalf("got %s, %v", again, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, digest[:2]))
+	if len(entries) != 1 {
+		t.Fatalf("got %d files, want 1", len(entries))
+	}
+
+	r, err := s.OpenBlob(ctx, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, _ := io.ReadAll(r)
+	if string(got) != string(content) {
+		t.Fatalf("got %q", got)
+	}
+
+	for _, d := range []string{emailsvc.BlobDigest([]byte("missing")), "../../etc/passwd"} {
+		if _, err := s.OpenBlob(ctx, d); err == nil || err.StatusCode() != 404 {
+			t.Errorf("OpenBlob(%q) got %v, want 404", d, err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package mailcapture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+)
+
+// InboxController serves captured emails as HTML, in the style of MailHog.
+type InboxController interface {
+	Inbox(http.ResponseWriter, *http.Request)
+	Message(http.ResponseWriter, *http.Request)
+	MessageHTML(http.ResponseWriter, *http.Request)
+	Part(http.ResponseWriter, *http.Request)
+	Reply(http.ResponseWriter, *http.Request)
+}
+
+var _ InboxController = (*inboxController)(nil)
+
+type inboxController struct {
+	cfg     backend.Config
+	capture Capture
+	service emailsvc.EmailService
+}
+
+// NewInboxController constructs an InboxController replying to captured emails
+// by forwarding them as inbound emails through service.
+func NewInboxController(
+	cfg backend.Config,
+	capture Capture,
+	service emailsvc.EmailService,
+) *inboxController {
+	return &inboxController{
+		cfg:     cfg,
+		capture: capture,
+		service: service,
+	}
+}
+
+type inboxRow struct {
+	Message
+	From, To, Subject string
+}
+
+func (ctrl *inboxController) Inbox(w http.ResponseWriter, r *http.Request) {
+	msgs, err := ctrl.capture.Messages()
+	if err != nil {
+		http.Error(w, "failed Messages: "+err.Error(), 500)
+		return
+	}
+
+	//
+	rows := make([]inboxRow, 0, len(msgs))
+	for _, msg := range msgs {
+		env, err := enmime.ReadEnvelope(bytes.NewReader(msg.Raw))
+		if err != nil {
+			log.Warn().Err(err).Str("id", msg.Id).Msg("skipping unparsable captured email")
+			continue
+		}
+		rows = append(rows, inboxRow{
+			Message: msg,
+			From:    env.GetHeader("From"),
+			To:      env.GetHeader("To"),
+			Subject: env.GetHeader("Subject"),
+		})
+	}
+
+	//
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := inboxTmpl.Execute(w, rows); err != nil {
+		log.Error().Err(err).Msg("failed executing inbox template")
+	}
+}
+
+type header struct {
+	Key, Value string
+}
+
+type part struct {
+	Index       int
+	FileName    string
+	ContentType string
+	Size        int
+	Inline      bool
+}
+
+type messageView struct {
+	Id         string
+	Subject    string
+	Headers    []header
+	Text       string
+	HasHTML    bool
+	Parts      []part
+	Recipients []string
+}
+
+func (ctrl *inboxController) Message(w http.ResponseWriter, r *http.Request) {
+	msg, env, ok := ctrl.envelope(w, r)
+	if !ok {
+		return
+	}
+
+	//
+	view := messageView{
+		Id:         msg.Id,
+		Subject:    env.GetHeader("Subject"),
+		Text:       env.Text,
+		HasHTML:    env.HTML != "",
+		Recipients: recipients(env),
+	}
+	keys := env.GetHeaderKeys()
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range env.GetHeaderValues(k) {
+			view.Headers = append(view.Headers, header{Key: k, Value: v})
+		}
+	}
+	for i, p := range parts(env) {
+		view.Parts = append(view.Parts, part{
+			Index:       i,
+			FileName:    p.FileName,
+			ContentType: p.ContentType,
+			Size:        len(p.Content),
+			Inline:      p.Disposition == "inline",
+		})
+	}
+
+	//
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := messageTmpl.Execute(w, view); err != nil {
+		log.Error().Err(err).Msg("failed executing message template")
+	}
+}
+
+// MessageHTML serves the HTML body sandboxed, with cid: references pointing to its parts.
+func (ctrl *inboxController) MessageHTML(w http.ResponseWriter, r *http.Request) {
+	msg, env, ok := ctrl.envelope(w, r)
+	if !ok {
+		return
+	}
+
+	//
+	html := env.HTML
+	for i, p := range parts(env) {
+		if p.ContentID != "" {
+			html = strings.ReplaceAll(html, "cid:"+p.ContentID, fmt.Sprintf("/dev/mail/%s/parts/%d", msg.Id, i))
+		}
+	}
+
+	//
+	w.Header().Add("Content-Security-Policy", "sandbox")
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(html))
+}
+
+func (ctrl *inboxController) Part(w http.ResponseWriter, r *http.Request) {
+	_, env, ok := ctrl.envelope(w, r)
+	if !ok {
+		return
+	}
+	ps := parts(env)
+	i, err := strconv.Atoi(r.PathValue("part"))
+	if err != nil || i < 0 || i >= len(ps) {
+		http.Error(w, "part not found", http.StatusNotFound)
+		return
+	}
+
+	// parts are untrusted, so only images are shown inline and nothing runs
+	p := ps[i]
+	disposition := "attachment"
+	if p.Disposition == "inline" && strings.HasPrefix(p.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Add("Content-Security-Policy", "sandbox")
+	w.Header().Add("X-Content-Type-Options", "nosniff")
+	w.Header().Add("Content-Type", p.ContentType)
+	w.Header().Add("Content-Disposition",
+		mime.FormatMediaType(disposition, map[string]string{"filename": p.FileName}))
+	w.Write(p.Content)
+}
+
+// Reply forwards a threaded reply to a captured email from one of its recipients
+// as if it was received by the inbound SMTP server.
+func (ctrl *inboxController) Reply(w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin reply", http.StatusForbidden)
+		return
+	}
+	_, env, ok := ctrl.envelope(w, r)
+	if !ok {
+		return
+	}
+
+	// decode form
+	from, err := mail.ParseAddress(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "provide from address", http.StatusBadRequest)
+		return
+	}
+	inbound, err := NewReply(env, *from, r.FormValue("text"), time.Now())
+	if err != nil {
+		http.Error(w, "failed NewReply: "+err.Error(), 500)
+		return
+	}
+
+	//
+	if err := ctrl.service.ForwardInboundEmail(r.Context(), ctrl.capture, inbound); err != nil {
+		http.Error(w, "failed ForwardInboundEmail: "+err.Error(), err.StatusCode())
+		return
+	}
+	log.Info().Str("from", from.Address).Str("messageId", inbound.GetHeader("Message-Id")).Msg("injected reply")
+
+	//
+	http.Redirect(w, r, "/dev/mail", http.StatusSeeOther)
+}
+
+// LocalOnly serves next to clients on the loopback interface only, since the inbox
+// isn't authenticated. Proxied requests and Hosts other than loopback ones, as sent
+// by DNS rebinding pages, are forbidden.
+func LocalOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !isLoopback(remote) || !isLoopback(hostname(r.Host)) ||
+			r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("Forwarded") != "" {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+// sameOrigin reports whether r was sent by a page of the inbox rather than
+// forged by another site, judging by its Sec-Fetch-Site or else Origin header.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// envelope reads the captured email of the id path value, writing an error if it fails.
+func (ctrl *inboxController) envelope(
+	w http.ResponseWriter,
+	r *http.Request,
+) (Message, *enmime.Envelope, bool) {
+	msg, err := ctrl.capture.Message(r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "message not found", http.StatusNotFound)
+		return Message{}, nil, false
+	} else if err != nil {
+		http.Error(w, "failed Message: "+err.Error(), 500)
+		return Message{}, nil, false
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(msg.Raw))
+	if err != nil {
+		http.Error(w, "failed ReadEnvelope: "+err.Error(), 500)
+		return Message{}, nil, false
+	}
+	return msg, env, true
+}
+
+// NewReply builds the reply of from to env, threaded by In-Reply-To and References
+// and addressed to its Reply-To or else its sender.
+func NewReply(env *enmime.Envelope, from mail.Address, text string, now time.Time) (*enmime.Envelope, error) {
+	toHeader := env.GetHeader("Reply-To")
+	if toHeader == "" {
+		toHeader = env.GetHeader("From")
+	}
+	to, err := mail.ParseAddressList(toHeader)
+	if err != nil {
+		return nil, err
+	}
+	var toAddrs []mail.Address
+	for _, addr := range to {
+		toAddrs = append(toAddrs, *addr)
+	}
+	messageId := strings.TrimSpace(env.GetHeader("Message-Id"))
+	references := strings.TrimSpace(env.GetHeader("References") + " " + messageId)
+	_, domain, _ := strings.Cut(from.Address, "@")
+
+	var quoted strings.Builder
+	fmt.Fprintf(&quoted, "%s\r\n\r\nOn %s, %s wrote:\r\n", text, now.Format(time.RFC1123Z), env.GetHeader("From"))
+	for _, line := range strings.Split(strings.TrimRight(env.Text, "\r\n"), "\n") {
+		fmt.Fprintf(&quoted, "> %s\r\n", strings.TrimRight(line, "\r"))
+	}
+
+	root, err := enmime.Builder().
+		From(from.Name, from.Address).
+		ToAddrs(toAddrs).
+		Subject("Re: "+emailsvc.NormalizeSubject(env.GetHeader("Subject"))).
+		Date(now).
+		Header("Message-Id", emailsvc.NewMessageId(domain)).
+		Header("In-Reply-To", messageId).
+		Header("References", references).
+		Text([]byte(quoted.String())).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return enmime.ReadEnvelope(&buf)
+}
+
+// recipients returns the addresses an email could be replied from.
+func recipients(env *enmime.Envelope) []string {
+	var res []string
+	for _, h := range []string{"To", "Cc"} {
+		if env.GetHeader(h) == "" {
+			continue
+		}
+		addrs, err := env.AddressList(h)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			res = append(res, addr.String())
+		}
+	}
+	return res
+}
+
+func parts(env *enmime.Envelope) []*enmime.Part {
+	return append(slices.Clone(env.Attachments), env.Inlines...)
+}
@@ -0,0 +1,243 @@
+package mailcapture
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+)
+
+// Capture is a Mailer keeping outbound emails instead of sending them.
+type Capture interface {
+	emailsvc.Mailer
+	// Messages returns the captured emails newest first.
+	Messages() ([]Message, error)
+	Message(id string) (Message, error)
+}
+
+// Message is a captured email.
+type Message struct {
+	// Id identifies the Message in inbox URLs.
+	Id         string
+	MessageId  string
+	Raw        []byte
+	CapturedAt time.Time
+}
+
+var ErrNotFound = errors.New("message not found")
+
+const idSuffixLen = 4
+
+var _ Capture = (*captureMailer)(nil)
+
+type captureMailer struct {
+	dir         string
+	domain      string
+	maxMessages int
+	mu          sync.Mutex
+	msgs        []Message
+}
+
+// NewMailer constructs a Mailer capturing emails in cfg.MailCapture.Dir, or in memory if unset.
+func NewMailer(cfg backend.Config) *captureMailer {
+	if cfg.MailCapture.Dir != "" {
+		if err := os.MkdirAll(cfg.MailCapture.Dir, 0o755); err != nil {
+			log.Fatal().Err(err).Str("dir", cfg.MailCapture.Dir).Msg("failed creating MailCapture.Dir")
+		}
+	}
+	maxMessages := cfg.MailCapture.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = 500
+	}
+	return &captureMailer{
+		dir:         cfg.MailCapture.Dir,
+		domain:      cfg.Domain,
+		maxMessages: maxMessages,
+	}
+}
+
+func (m *captureMailer) Send(
+	_ context.Context,
+	payload enmime.Envelope,
+) (emailsvc.SendResult, app.Error) {
+	const op = "captureMailer.Send"
+	messageId := strings.TrimSpace(payload.GetHeader("Message-Id"))
+	if messageId == "" {
+		messageId = emailsvc.NewMessageId(m.domain)
+	}
+	var rcpts []string
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		if payload.GetHeader(h) == "" {
+			continue
+		}
+		addrs, err := payload.AddressList(h)
+		if err != nil {
+			return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: AddressList", op))
+		}
+		for _, addr := range addrs {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	if len(rcpts) == 0 {
+		return emailsvc.SendResult{}, app.NewErr(http.StatusBadRequest, "", op+": no recipients")
+	}
+	raw, err := emailsvc.EncodeEnvelope(payload, messageId)
+	if err != nil {
+		return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: EncodeEnvelope", op))
+	}
+
+	msg, err := m.store(messageId, raw)
+	if err != nil {
+		return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: store", op))
+	}
+	log.Info().
+		Str("mailer", "capture").
+		Str("id", msg.Id).
+		Str("messageId", messageId).
+		Strs("rcpts", rcpts).
+		Msg("captured msg")
+
+	return emailsvc.SendResult{
+		Provider:          "capture",
+		ProviderMessageId: messageId,
+		MessageId:         messageId,
+		Accepted:          rcpts,
+	}, nil
+}
+
+// GetEmail returns the Message-Id of a captured email, which is also its ProviderMessageId.
+func (m *captureMailer) GetEmail(_ context.Context, messageId string) (emailsvc.Email, app.Error) {
+	return emailsvc.Email{MessageId: messageId}, nil
+}
+
+func (m *captureMailer) store(messageId string, raw []byte) (Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	// the random suffix keeps processes sharing Dir from overwriting each other's emails
+	suffix := make([]byte, idSuffixLen)
+	rand.Read(suffix)
+	msg := Message{
+		Id:         strconv.FormatInt(now.UnixNano(), 10) + "-" + hex.EncodeToString(suffix),
+		MessageId:  messageId,
+		Raw:        raw,
+		CapturedAt: now,
+	}
+	if m.dir != "" {
+		if err := os.WriteFile(filepath.Join(m.dir, msg.Id+".eml"), raw, 0o644); err != nil {
+			return msg, err
+		}
+		m.prune()
+		return msg, nil
+	}
+	m.msgs = append(m.msgs, msg)
+	if len(m.msgs) > m.maxMessages {
+		m.msgs = slices.Delete(m.msgs, 0, len(m.msgs)-m.maxMessages)
+	}
+	return msg, nil
+}
+
+// prune removes the oldest emails of Dir beyond maxMessages.
+func (m *captureMailer) prune() {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		log.Error().Err(err).Str("dir", m.dir).Msg("failed pruning captured emails")
+		return
+	}
+	entries = slices.DeleteFunc(entries, func(e os.DirEntry) bool {
+		return !strings.HasSuffix(e.Name(), ".eml")
+	})
+	// ids sort by capture time
+	for _, e := range entries[:max(len(entries)-m.maxMessages, 0)] {
+		err := os.Remove(filepath.Join(m.dir, e.Name()))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Str("file", e.Name()).Msg("failed pruning captured email")
+		}
+	}
+}
+
+func (m *captureMailer) Messages() ([]Message, error) {
+	if m.dir == "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		res := slices.Clone(m.msgs)
+		slices.Reverse(res)
+		return res, nil
+	}
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []Message
+	for i := len(entries) - 1; i >= 0; i-- {
+		id, ok := strings.CutSuffix(entries[i].Name(), ".eml")
+		if !ok {
+			continue
+		}
+		msg, err := m.Message(id)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (m *captureMailer) Message(id string) (Message, error) {
+	if m.dir == "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, msg := range m.msgs {
+			if msg.Id == id {
+				return msg, nil
+			}
+		}
+		return Message{}, ErrNotFound
+	}
+
+	nanos, err := parseId(id)
+	if err != nil {
+		return Message{}, ErrNotFound
+	}
+	raw, err := os.ReadFile(filepath.Join(m.dir, id+".eml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return Message{}, ErrNotFound
+	} else if err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		Id:         id,
+		Raw:        raw,
+		CapturedAt: time.Unix(0, nanos),
+	}
+	if hdr, err := mail.ReadMessage(strings.NewReader(string(raw))); err == nil {
+		msg.MessageId = hdr.Header.Get("Message-Id")
+	}
+	return msg, nil
+}
+
+// parseId returns the capture time of the id "<unix nanos>-<hex suffix>".
+func parseId(id string) (int64, error) {
+	nanos, suffix, _ := strings.Cut(id, "-")
+	if b, err := hex.DecodeString(suffix); err != nil || len(b) != idSuffixLen {
+		return 0, fmt.Errorf("invalid id %q", id)
+	}
+	return strconv.ParseInt(nanos, 10, 64)
+}
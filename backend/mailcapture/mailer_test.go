@@ -0,0 +1,234 @@
+package mailcapture_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailcapture"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+type testService struct {
+	emailsvc.EmailService
+	inbound *enmime.Envelope
+}
+
+func (s *testService) ForwardInboundEmail(
+	_ context.Context,
+	_ emailsvc.Mailer,
+	inbound *enmime.Envelope,
+) app.Error {
+	s.inbound = inbound
+	return nil
+}
+
+func TestCaptureInbox(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		cfg := backend.Config{
+			Domain:      "domain.com",
+			MailCapture: backend.MailCaptureConfig{Dir: dir},
+		}
+		m := mailcapture.NewMailer(cfg)
+		svc := &testService{}
+		ctrl := mailcapture.NewInboxController(cfg, m, svc)
+
+		// send
+		root, err := enmime.Builder().
+			From("Ben", "thread@domain.com").
+			To("Ben N", "ben@yahoo.com").
+			Subject("hello").
+			Header("References", "<root@yahoo.com>").
+			Text([]byte("line 1\nline 2")).
+			HTML([]byte(`<p>hi <img src="cid:logo"></p>`)).
+			AddInline([]byte("png"), "image/png", "logo.png", "logo").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := root.Encode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		env, err := enmime.ReadEnvelope(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, appErr := m.Send(context.Background(), *env)
+		if appErr != nil {
+			t.Fatal(appErr)
+		}
+		if !strings.HasSuffix(res.MessageId, "@domain.com>") || len(res.Accepted) != 1 {
+			t.Fatalf("got %+v", res)
+		}
+		msgs, err := m.Messages()
+		if err != nil || len(msgs) != 1 || msgs[0].MessageId != res.MessageId {
+			t.Fatalf("got %+v, %v", msgs, err)
+		}
+		id := msgs[0].Id
+
+		// inbox
+		w := httptest.NewRecorder()
+		ctrl.Inbox(w, httptest.NewRequest("GET", "/dev/mail", nil))
+		if !strings.Contains(w.Body.String(), "/dev/mail/"+id) {
+			t.Fatalf("inbox missing message: %s", w.Body)
+		}
+
+		// html
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/dev/mail/"+id+"/html", nil)
+		r.SetPathValue("id", id)
+		ctrl.MessageHTML(w, r)
+		if w.Header().Get("Content-Security-Policy") != "sandbox" ||
+			!strings.Contains(w.Body.String(), "/dev/mail/"+id+"/parts/0") {
+			t.Fatalf("got %v %s", w.Header(), w.Body)
+		}
+
+		// part
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/dev/mail/"+id+"/parts/0", nil)
+		r.SetPathValue("id", id)
+		r.SetPathValue("part", "0")
+		ctrl.Part(w, r)
+		if w.Body.String() != "png" || w.Header().Get("Content-Type") != "image/png" ||
+			w.Header().Get("Content-Security-Policy") != "sandbox" ||
+			w.Header().Get("X-Content-Type-Options") != "nosniff" ||
+			!strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline") {
+			t.Fatalf("got %v %s", w.Header(), w.Body)
+		}
+
+		// cross-site reply
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("POST", "/dev/mail/"+id+"/reply", strings.NewReader("from=ben@yahoo.com"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "https://attacker.com")
+		r.SetPathValue("id", id)
+		ctrl.Reply(w, r)
+		if w.Code != http.StatusForbidden || svc.inbound != nil {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+
+		// reply
+		w = httptest.NewRecorder()
+		form := url.Values{"from": {"Ben N <ben@yahoo.com>"}, "text": {"hey"}}
+		r = httptest.NewRequest("POST", "/dev/mail/"+id+"/reply", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("id", id)
+		ctrl.Reply(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		inbound := svc.inbound
+		if inbound.GetHeader("In-Reply-To") != res.MessageId {
+			t.Errorf("In-Reply-To %q", inbound.GetHeader("In-Reply-To"))
+		}
+		if inbound.GetHeader("References") != "<root@yahoo.com> "+res.MessageId {
+			t.Errorf("References %q", inbound.GetHeader("References"))
+		}
+		if inbound.GetHeader("Subject") != "Re: hello" {
+			t.Errorf("Subject %q", inbound.GetHeader("Subject"))
+		}
+		if !strings.HasSuffix(inbound.GetHeader("Message-Id"), "@yahoo.com>") {
+			t.Errorf("Message-Id %q", inbound.GetHeader("Message-Id"))
+		}
+		if to, _ := inbound.AddressList("To"); len(to) != 1 || to[0].Address != "thread@domain.com" {
+			t.Errorf("To %v", to)
+		}
+		if !strings.Contains(inbound.Text, "hey") || !strings.Contains(inbound.Text, "> line 2") {
+			t.Errorf("Text %q", inbound.Text)
+		}
+
+		// not found
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/dev/mail/missing", nil)
+		r.SetPathValue("id", "missing")
+		ctrl.Message(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("got %d", w.Code)
+		}
+	}
+}
+
+func TestLocalOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		host       string
+		header     http.Header
+		want       int
+	}{
+		{name: "loopback", remoteAddr: "127.0.0.1:5000", host: "localhost:8080", want: http.StatusOK},
+		{name: "loopback ipv6", remoteAddr: "[::1]:5000", host: "[::1]:8080", want: http.StatusOK},
+		{name: "remote", remoteAddr: "10.0.0.2:5000", host: "localhost:8080", want: http.StatusForbidden},
+		{name: "rebound host", remoteAddr: "127.0.0.1:5000", host: "attacker.com:8080", want: http.StatusForbidden},
+		{
+			name:       "proxied",
+			remoteAddr: "127.0.0.1:5000",
+			host:       "localhost:8080",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.2"}},
+			want:       http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/dev/mail", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Host = tt.host
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			mailcapture.LocalOnly(func(http.ResponseWriter, *http.Request) {})(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaptureDirPrune(t *testing.T) {
+	dir := t.TempDir()
+	cfg := backend.Config{
+		Domain:      "domain.com",
+		MailCapture: backend.MailCaptureConfig{Dir: dir, MaxMessages: 2},
+	}
+	// processes sharing Dir
+	a, b := mailcapture.NewMailer(cfg), mailcapture.NewMailer(cfg)
+	var sent []string
+	for _, m := range []mailcapture.Capture{a, b, a} {
+		env, err := enmime.ReadEnvelope(strings.NewReader(
+			"From: thread@domain.com\r\nTo: ben@yahoo.com\r\n\r\nhi\r\n",
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, appErr := m.Send(context.Background(), *env)
+		if appErr != nil {
+			t.Fatal(appErr)
+		}
+		sent = append(sent, res.MessageId)
+	}
+
+	msgs, err := b.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].MessageId != sent[2] || msgs[1].MessageId != sent[1] {
+		t.Fatalf("got %+v, want the last 2 of %v", msgs, sent)
+	}
+	if _, err := a.Message("../" + msgs[0].Id); err != mailcapture.ErrNotFound {
+		t.Errorf("got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,77 @@
+package mailcapture
+
+import "html/template"
+
+const layout = `{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - opendoorchat mail</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .4em .6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+td.key { color: #666; white-space: nowrap; width: 1%; }
+pre { white-space: pre-wrap; background: #f6f6f6; padding: 1em; }
+iframe { width: 100%; height: 30em; border: 1px solid #ddd; }
+textarea { width: 100%; height: 8em; }
+</style>
+</head>
+<body>
+<h2><a href="/dev/mail">Inbox</a></h2>
+{{end}}`
+
+var inboxTmpl = template.Must(template.New("inbox").Parse(layout + `{{template "head" "Inbox"}}
+{{if .}}
+<table>
+<tr><th>Captured</th><th>From</th><th>To</th><th>Subject</th></tr>
+{{range .}}
+<tr>
+<td>{{.CapturedAt.Format "Jan 2 15:04:05"}}</td>
+<td>{{.From}}</td>
+<td>{{.To}}</td>
+<td><a href="/dev/mail/{{.Id}}">{{or .Subject "(no subject)"}}</a></td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No emails captured yet.</p>
+{{end}}
+</body>
+</html>`))
+
+var messageTmpl = template.Must(template.New("message").Parse(layout + `{{template "head" .Subject}}
+<h3>{{or .Subject "(no subject)"}}</h3>
+<table>
+{{range .Headers}}<tr><td class="key">{{.Key}}</td><td>{{.Value}}</td></tr>
+{{end}}
+</table>
+{{if .HasHTML}}
+<h4>HTML</h4>
+<iframe sandbox src="/dev/mail/{{.Id}}/html"></iframe>
+{{end}}
+{{if .Text}}
+<h4>Text</h4>
+<pre>{{.Text}}</pre>
+{{end}}
+{{if .Parts}}
+<h4>Attachments</h4>
+<ul>
+{{range .Parts}}<li><a href="/dev/mail/{{$.Id}}/parts/{{.Index}}">{{or .FileName "(unnamed)"}}</a> {{.ContentType}}, {{.Size}} bytes{{if .Inline}}, inline{{end}}</li>
+{{end}}
+</ul>
+{{end}}
+<h4>Reply</h4>
+<form method="post" action="/dev/mail/{{.Id}}/reply">
+<p>
+From
+<select name="from">
+{{range .Recipients}}<option>{{.}}</option>
+{{end}}
+</select>
+</p>
+<textarea name="text" placeholder="Reply text"></textarea>
+<p><button type="submit">Send reply</button></p>
+</form>
+</body>
+</html>`))
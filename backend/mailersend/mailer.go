@@ -2,9 +2,9 @@ package mailersend
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"math"
-	"net/http"
 	"net/mail"
 	"time"
 
@@ -28,28 +28,40 @@ func NewMailer(apiKey string) mailerSendMailer {
 	}
 }
 
+// Send sends the envelope through the MailerSend API. The API assigns its own Message-Id,
+// so SendResult.MessageId is left empty and the envelope's is not sent.
 func (mailer mailerSendMailer) Send(
 	ctx context.Context,
 	payload enmime.Envelope,
-) (*http.Response, app.Error) {
+) (emailsvc.SendResult, app.Error) {
 	const op = "mailerSendMailer.Send"
 	from, err := mail.ParseAddress(payload.GetHeader("From"))
 	if err != nil {
-		return nil, app.FromErr(err, fmt.Sprintf("%s: ParseAddress", op))
+		return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: ParseAddress", op))
 	}
 
 	var rcpts []mailersend.Recipient
+	var accepted []string
 	toAddrs, err := mail.ParseAddressList(payload.GetHeader("To"))
 	if err != nil {
-		return nil, app.FromErr(err, fmt.Sprintf("%s: ParseAddressList", op))
+		return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: ParseAddressList", op))
 	}
 	for _, addr := range toAddrs {
 		rcpts = append(rcpts, mailersend.Recipient{Name: addr.Name, Email: addr.Address})
+		accepted = append(accepted, addr.Address)
 	}
 
 	msg := mailer.client.Email.NewMessage()
 	msg.SetFrom(mailersend.Recipient{Name: from.Name, Email: from.Address})
 	msg.SetRecipients(rcpts)
+	if h := payload.GetHeader("Reply-To"); h != "" {
+		// the API takes a single Reply-To address
+		replyTo, err := mail.ParseAddress(h)
+		if err != nil {
+			return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: ParseAddress Reply-To", op))
+		}
+		msg.SetReplyTo(mailersend.Recipient{Name: replyTo.Name, Email: replyTo.Address})
+	}
 	msg.SetSubject(payload.GetHeader("Subject"))
 	msg.SetHTML(payload.HTML)
 	msg.SetText(payload.Text)
@@ -57,24 +69,53 @@ func (mailer mailerSendMailer) Send(
 	if len(inReplyTo) > 2 {
 		msg.SetInReplyTo(inReplyTo[1 : len(inReplyTo)-1])
 	}
+	for _, p := range payload.Attachments {
+		msg.AddAttachment(mailersend.Attachment{
+			Content:     base64.StdEncoding.EncodeToString(p.Content),
+			Filename:    p.FileName,
+			Disposition: mailersend.DispositionAttachment,
+		})
+	}
+	for _, p := range payload.Inlines {
+		// the id is referenced by cid: in the HTML
+		msg.AddAttachment(mailersend.Attachment{
+			Content:     base64.StdEncoding.EncodeToString(p.Content),
+			Filename:    p.FileName,
+			Disposition: mailersend.DispositionInline,
+			ID:          p.ContentID,
+		})
+	}
 	// TODO msg.SetTags(tags)
-	// TODO msg.Attachments()
 	// TODO msg.TemplateID()
 	log.Debug().
 		Str("mailer", "mailerSend").
-		Interface("msg", msg).
+		Str("subject", payload.GetHeader("Subject")).
+		Int("attachments", len(msg.Attachments)).
 		Msg("sending msg")
 
 	resp, err := mailer.client.Email.Send(ctx, msg)
 	if err != nil {
-		e := app.FromErr(err, fmt.Sprintf("%s: mailerSend.EmailService.Send", op))
+		var e app.Error
+		if resp != nil && resp.Response != nil {
+			e = app.NewErr(resp.StatusCode, resp.Status, fmt.Sprintf("%s: %s", op, err))
+		} else {
+			e = app.FromErr(err, fmt.Sprintf("%s: mailerSend.EmailService.Send", op))
+		}
 		log.Error().Err(e).Send()
-		return nil, e
+		return emailsvc.SendResult{}, e
 	}
 
-	return resp.Response, nil
+	// the API accepts all or none of the recipients
+	return emailsvc.SendResult{
+		Provider:          "mailersend",
+		ProviderMessageId: resp.Header.Get("X-Message-Id"),
+		Accepted:          accepted,
+	}, nil
 }
 
+// GetEmail looks up the Message-Id MailerSend assigned to a sent message,
+// which it doesn't return from Send nor accept from the envelope.
+// The message may take a few seconds to become visible, so lookups are retried until ctx is done.
 func (mailer mailerSendMailer) GetEmail(
 	ctx context.Context,
 	mailerMsgId string,
@@ -93,9 +134,16 @@ func (mailer mailerSendMailer) GetEmail(
 			return emailsvc.Email{}, app.NewErr(resp.StatusCode, resp.Status, "")
 		}
 		if len(root.Data.Emails) == 0 {
+			if i == 2 {
+				break
+			}
 			backoff := time.Duration(math.Pow(6.0, float64(i))) * time.Second
 			log.Debug().Int("retry", i).Dur("backoff", backoff).Msg("GetEmail: not found")
-			time.Sleep(backoff)
+			select {
+			case <-ctx.Done():
+				return emailsvc.Email{}, app.FromErr(ctx.Err(), op)
+			case <-time.After(backoff):
+			}
 			continue
 		}
 		return emailsvc.Email{
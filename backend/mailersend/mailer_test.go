@@ -0,0 +1,76 @@
+package mailersend
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/jhillyerd/enmime"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestSendReplyTo(t *testing.T) {
+	var payload struct {
+		ReplyTo struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"reply_to"`
+		InReplyTo string `json:"in_reply_to"`
+	}
+	mailer := NewMailer("key")
+	mailer.client.SetClient(&http.Client{
+		Transport: roundTripper(func(r *http.Request) (*http.Response, error) {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				t.Error(err)
+			}
+			return &http.Response{
+				StatusCode: http.StatusAccepted,
+				Status:     "202 Accepted",
+				Header:     http.Header{"X-Message-Id": {"msgId"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+				Request:    r,
+			}, nil
+		}),
+	})
+
+	cfg := backend.Config{Domain: "domain.com"}
+	cfg.Email.ReplySecret = "secret"
+	replyTo := emailsvc.ReplyAddress(cfg, primitive.NewObjectID(), time.Now())
+	env, err := enmime.ReadEnvelope(strings.NewReader(
+		"From: John Smith <mailer@domain.com>\r\n" +
+			"To: Ben N <ben@yahoo.com>\r\n" +
+			"Reply-To: <" + replyTo + ">\r\n" +
+			"In-Reply-To: <first@domain.com>\r\n" +
+			"Subject: Re: subject\r\n" +
+			"\r\n" +
+			"Hello, world!\r\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, appErr := mailer.Send(context.Background(), *env)
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	if res.ProviderMessageId != "msgId" {
+		t.Errorf("ProviderMessageId %q", res.ProviderMessageId)
+	}
+	if payload.ReplyTo.Email != replyTo {
+		t.Errorf("reply_to %+v", payload.ReplyTo)
+	}
+	if payload.InReplyTo != "first@domain.com" {
+		t.Errorf("in_reply_to %q", payload.InReplyTo)
+	}
+}
@@ -0,0 +1,77 @@
+package mailrouter
+
+import (
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	// circuitHalfOpen allows a single trial send after the cooldown.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker opens after threshold consecutive failures and skips its Mailer
+// until cooldown has passed.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     circuitState
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether a send may be attempted at now.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// a trial is in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// success closes the circuit and returns the resulting state.
+func (b *breaker) success() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = circuitClosed
+	b.failures = 0
+	return b.state
+}
+
+// failure records a failed send and returns the resulting state.
+func (b *breaker) failure(now time.Time) circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openUntil = now.Add(b.cooldown)
+	}
+	return b.state
+}
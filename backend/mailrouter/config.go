@@ -0,0 +1,58 @@
+package mailrouter
+
+import (
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailcapture"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailersend"
+	"github.com/benjamonnguyen/opendoorchat/backend/smtp"
+	"github.com/rs/zerolog/log"
+)
+
+// FromConfig constructs the Mailer configured by cfg, routing across cfg.MailerRouter.Routes
+// if set or else cfg.Mailer, and a func closing it.
+func FromConfig(cfg backend.Config) (emailsvc.Mailer, func()) {
+	if len(cfg.MailerRouter.Routes) == 0 {
+		return provider(cfg, cfg.Mailer)
+	}
+	var routes []Route
+	for _, rc := range cfg.MailerRouter.Routes {
+		routeCfg := cfg
+		if rc.MailerSendApiKey != "" {
+			routeCfg.MailerSendApiKey = rc.MailerSendApiKey
+		}
+		if rc.Smtp != nil {
+			routeCfg.Smtp = *rc.Smtp
+		}
+		name := rc.Name
+		if name == "" {
+			name = rc.Provider
+		}
+		m, closeMailer := provider(routeCfg, rc.Provider)
+		routes = append(routes, Route{
+			Name:     name,
+			Mailer:   m,
+			Priority: rc.Priority,
+			Weight:   rc.Weight,
+			Close:    closeMailer,
+		})
+	}
+	r := NewMailer(cfg.MailerRouter, routes...)
+	return r, r.Close
+}
+
+func provider(cfg backend.Config, name string) (emailsvc.Mailer, func()) {
+	switch name {
+	case "smtp":
+		m := smtp.NewMailer(cfg)
+		return m, m.Close
+	case "capture":
+		log.Warn().Msg("capturing outbound emails instead of sending them")
+		return mailcapture.NewMailer(cfg), func() {}
+	case "mailersend", "":
+		return mailersend.NewMailer(cfg.MailerSendApiKey), func() {}
+	default:
+		log.Fatal().Str("mailer", name).Msg("unknown Mailer")
+		return nil, nil
+	}
+}
@@ -0,0 +1,29 @@
+package mailrouter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	circuitOpenGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "mailer",
+		Name:      "circuit_open",
+		Help:      "1 if the circuit of a Mailer is open or half-open, else 0.",
+	}, []string{"provider"})
+	sends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "opendoorchat",
+		Subsystem: "mailer",
+		Name:      "sends_total",
+		Help:      "Send attempts by Mailer and result, one of \"ok\", \"failover\" or \"error\".",
+	}, []string{"provider", "result"})
+)
+
+func setCircuit(provider string, state circuitState) {
+	v := 0.0
+	if state != circuitClosed {
+		v = 1
+	}
+	circuitOpenGauge.WithLabelValues(provider).Set(v)
+}
@@ -0,0 +1,190 @@
+package mailrouter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+)
+
+// Route is a Mailer of the router, see backend.MailerRouteConfig.
+type Route struct {
+	Name     string
+	Mailer   emailsvc.Mailer
+	Priority int
+	Weight   int
+	// Close, if set, is called when the router is closed.
+	Close func()
+}
+
+type route struct {
+	Route
+	breaker *breaker
+}
+
+var _ emailsvc.Mailer = (*router)(nil)
+
+type router struct {
+	routes []*route
+	now    func() time.Time
+}
+
+// NewMailer constructs a Mailer sending through the first healthy route,
+// failing over to the next on retryable errors.
+// ProviderMessageIds are prefixed with the route Name so GetEmail reaches the Mailer that sent.
+func NewMailer(cfg backend.MailerRouterConfig, routes ...Route) *router {
+	threshold := cfg.FailureThreshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+	cooldown := cfg.Cooldown
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	r := &router{now: time.Now}
+	seen := make(map[string]bool)
+	for _, rt := range routes {
+		if rt.Name == "" || strings.Contains(rt.Name, "/") || seen[rt.Name] {
+			log.Fatal().Str("name", rt.Name).Msg("invalid or duplicate mailer route name")
+		}
+		seen[rt.Name] = true
+		if rt.Weight <= 0 {
+			rt.Weight = 1
+		}
+		r.routes = append(r.routes, &route{
+			Route:   rt,
+			breaker: &breaker{threshold: threshold, cooldown: cooldown},
+		})
+		setCircuit(rt.Name, circuitClosed)
+	}
+	slices.SortStableFunc(r.routes, func(a, b *route) int {
+		return a.Priority - b.Priority
+	})
+	return r
+}
+
+// Send tries routes by priority, skipping those with an open circuit.
+// A failover may deliver twice if the failed Mailer did send, though with the same Message-Id.
+func (r *router) Send(
+	ctx context.Context,
+	payload enmime.Envelope,
+) (emailsvc.SendResult, app.Error) {
+	const op = "router.Send"
+	var lastErr app.Error
+	for _, rt := range r.candidates() {
+		if !rt.breaker.allow(r.now()) {
+			continue
+		}
+		res, err := rt.Mailer.Send(ctx, payload)
+		if err == nil && len(res.Accepted) == 0 && res.Retryable {
+			err = app.NewErr(http.StatusServiceUnavailable, "no recipients accepted", op)
+		}
+		if err != nil && emailsvc.RetryableStatus(err.StatusCode()) {
+			state := rt.breaker.failure(r.now())
+			setCircuit(rt.Name, state)
+			sends.WithLabelValues(rt.Name, "failover").Inc()
+			log.Warn().
+				Err(err).
+				Str("provider", rt.Name).
+				Str("circuit", state.String()).
+				Msg("failing over mailer")
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		// the Mailer is up even if it refused the payload
+		setCircuit(rt.Name, rt.breaker.success())
+		if err != nil {
+			sends.WithLabelValues(rt.Name, "error").Inc()
+			return emailsvc.SendResult{}, app.FromErr(err, op)
+		}
+		sends.WithLabelValues(rt.Name, "ok").Inc()
+		res.Provider = rt.Name
+		res.ProviderMessageId = rt.Name + "/" + res.ProviderMessageId
+		return res, nil
+	}
+
+	if lastErr == nil {
+		return emailsvc.SendResult{}, app.NewErr(http.StatusServiceUnavailable, "no healthy mailer", op)
+	}
+	return emailsvc.SendResult{}, app.FromErr(lastErr, op)
+}
+
+// GetEmail looks up the Email with the route that sent it.
+func (r *router) GetEmail(ctx context.Context, providerMessageId string) (emailsvc.Email, app.Error) {
+	const op = "router.GetEmail"
+	name, id, _ := strings.Cut(providerMessageId, "/")
+	for _, rt := range r.routes {
+		if rt.Name == name {
+			email, err := rt.Mailer.GetEmail(ctx, id)
+			if err != nil {
+				return emailsvc.Email{}, app.FromErr(err, op)
+			}
+			return email, nil
+		}
+	}
+	return emailsvc.Email{}, app.NewErr(
+		http.StatusNotFound,
+		"",
+		fmt.Sprintf("%s: unknown provider %q", op, name),
+	)
+}
+
+// Close closes the routed Mailers.
+func (r *router) Close() {
+	for _, rt := range r.routes {
+		if rt.Route.Close != nil {
+			rt.Route.Close()
+		}
+	}
+}
+
+// candidates returns the routes by priority, shuffled by weight within a priority.
+func (r *router) candidates() []*route {
+	res := make([]*route, 0, len(r.routes))
+	for i := 0; i < len(r.routes); {
+		j := i
+		for j < len(r.routes) && r.routes[j].Priority == r.routes[i].Priority {
+			j++
+		}
+		res = append(res, weightedShuffle(r.routes[i:j])...)
+		i = j
+	}
+	return res
+}
+
+func weightedShuffle(routes []*route) []*route {
+	if len(routes) == 1 {
+		return routes
+	}
+	remaining := slices.Clone(routes)
+	res := make([]*route, 0, len(routes))
+	for len(remaining) > 0 {
+		total := 0
+		for _, rt := range remaining {
+			total += rt.Weight
+		}
+		n := rand.Intn(total)
+		for i, rt := range remaining {
+			if n < rt.Weight {
+				res = append(res, rt)
+				remaining = slices.Delete(remaining, i, i+1)
+				break
+			}
+			n -= rt.Weight
+		}
+	}
+	return res
+}
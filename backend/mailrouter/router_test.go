@@ -0,0 +1,155 @@
+package mailrouter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/jhillyerd/enmime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+func TestRouter(t *testing.T) {
+	primary := &fakeMailer{name: "primary"}
+	secondary := &fakeMailer{name: "secondary"}
+	r := NewMailer(
+		backend.MailerRouterConfig{FailureThreshold: 2, Cooldown: time.Minute},
+		Route{Name: "secondary", Mailer: secondary, Priority: 1},
+		Route{Name: "primary", Mailer: primary},
+	)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	send := func() emailsvc.SendResult {
+		t.Helper()
+		res, err := r.Send(context.Background(), enmime.Envelope{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// healthy primary
+	if res := send(); res.Provider != "primary" || res.ProviderMessageId != "primary/1" {
+		t.Fatalf("unexpected result %#v", res)
+	}
+
+	// fail over until the circuit opens
+	primary.errs = []app.Error{
+		app.NewErr(503, "", ""),
+		app.NewErr(429, "", ""),
+	}
+	for i := 0; i < 3; i++ {
+		if res := send(); res.Provider != "secondary" {
+			t.Fatalf("expected failover, got %#v", res)
+		}
+	}
+	if v := testutil.ToFloat64(circuitOpenGauge.WithLabelValues("primary")); v != 1 {
+		t.Fatalf("expected open circuit gauge, got %v", v)
+	}
+	if primary.calls != 3 {
+		t.Fatalf("expected open circuit to skip primary, got %d calls", primary.calls)
+	}
+
+	// a trial send after the cooldown closes the circuit
+	now = now.Add(time.Minute)
+	if res := send(); res.Provider != "primary" {
+		t.Fatalf("expected trial send, got %#v", res)
+	}
+	if r.routes[0].breaker.state != circuitClosed {
+		t.Fatalf("expected closed circuit, got %s", r.routes[0].breaker.state)
+	}
+	if v := testutil.ToFloat64(circuitOpenGauge.WithLabelValues("primary")); v != 0 {
+		t.Fatalf("expected closed circuit gauge, got %v", v)
+	}
+
+	// non-retryable errors don't fail over
+	primary.errs = []app.Error{app.NewErr(422, "", "")}
+	if _, err := r.Send(context.Background(), enmime.Envelope{}); err == nil || err.StatusCode() != 422 {
+		t.Fatalf("expected 422, got %v", err)
+	}
+	if secondary.calls != 3 {
+		t.Fatalf("expected no failover, got %d secondary calls", secondary.calls)
+	}
+
+	// lookups reach the sending Mailer
+	email, err := r.GetEmail(context.Background(), "secondary/2")
+	if err != nil || email.MessageId != "<secondary-2>" {
+		t.Fatalf("unexpected GetEmail %#v, %v", email, err)
+	}
+	if _, err := r.GetEmail(context.Background(), "unknown/2"); err == nil || err.StatusCode() != 404 {
+		t.Fatalf("expected 404, got %v", err)
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	m, closeMailer := FromConfig(backend.Config{
+		Domain: "domain.com",
+		MailerRouter: backend.MailerRouterConfig{
+			Routes: []backend.MailerRouteConfig{
+				{Name: "relay-a", Provider: "smtp", Smtp: &backend.SmtpConfig{Addr: "a.domain.com:587"}},
+				{Name: "relay-b", Provider: "smtp", Smtp: &backend.SmtpConfig{Addr: "b.domain.com:587"}, Priority: 1},
+				{Provider: "capture", Priority: 2},
+			},
+		},
+	})
+	defer closeMailer()
+	var names []string
+	for _, rt := range m.(*router).routes {
+		names = append(names, rt.Name)
+		if rt.Route.Close == nil {
+			t.Errorf("route %s has no closer", rt.Name)
+		}
+	}
+	if fmt.Sprint(names) != "[relay-a relay-b capture]" {
+		t.Fatalf("unexpected routes %v", names)
+	}
+}
+
+func TestWeightedShuffle(t *testing.T) {
+	heavy := &route{Route: Route{Name: "heavy", Weight: 9}}
+	light := &route{Route: Route{Name: "light", Weight: 1}}
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		res := weightedShuffle([]*route{heavy, light})
+		if len(res) != 2 {
+			t.Fatalf("expected 2 routes, got %d", len(res))
+		}
+		first[res[0].Name]++
+	}
+	if first["heavy"] < 800 || first["light"] == 0 {
+		t.Fatalf("unexpected distribution %v", first)
+	}
+}
+
+type fakeMailer struct {
+	name  string
+	errs  []app.Error
+	calls int
+}
+
+func (m *fakeMailer) Send(context.Context, enmime.Envelope) (emailsvc.SendResult, app.Error) {
+	m.calls++
+	if len(m.errs) > 0 {
+		err := m.errs[0]
+		m.errs = m.errs[1:]
+		return emailsvc.SendResult{}, err
+	}
+	return emailsvc.SendResult{
+		Provider:          m.name,
+		ProviderMessageId: fmt.Sprint(m.calls),
+		Accepted:          []string{"ben@yahoo.com"},
+	}, nil
+}
+
+func (m *fakeMailer) GetEmail(_ context.Context, id string) (emailsvc.Email, app.Error) {
+	return emailsvc.Email{MessageId: fmt.Sprintf("<%s-%s>", m.name, id)}, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"regexp"
+	"strings"
 	"time"
 
 	app "github.com/benjamonnguyen/opendoorchat"
@@ -16,10 +18,15 @@ import (
 )
 
 // Ensure interface is implemented
-var _ emailsvc.EmailRepo = (*mongoEmailRepo)(nil)
+var (
+	_ emailsvc.EmailRepo  = (*mongoEmailRepo)(nil)
+	_ emailsvc.OutboxRepo = (*mongoEmailRepo)(nil)
+)
 
 type mongoEmailRepo struct {
-	emailThreadsCollection *mongo.Collection
+	emailThreadsCollection  *mongo.Collection
+	inboundEmailsCollection *mongo.Collection
+	outboxCollection        *mongo.Collection
 }
 
 func NewEmailRepo(cfg backend.Config, cl *mongo.Client) *mongoEmailRepo {
@@ -27,9 +34,41 @@ func NewEmailRepo(cfg backend.Config, cl *mongo.Client) *mongoEmailRepo {
 	if emailThreadsCollection == nil {
 		log.Fatalln("emailThreads collection does not exist")
 	}
+	inboundEmailsCollection := cl.Database(cfg.Mongo.Database).Collection("inboundEmails")
+	if inboundEmailsCollection == nil {
+		log.Fatalln("inboundEmails collection does not exist")
+	}
+
+	// processed inbound emails are keyed by Message-Id
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := inboundEmailsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "messageId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Fatalln("failed creating inboundEmails index:", err)
+	}
+
+	// outbound emails are enqueued by key and leased by due time
+	outboxCollection := cl.Database(cfg.Mongo.Database).Collection("outbox")
+	_, err = outboxCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttemptAt", Value: 1}},
+		},
+	})
+	if err != nil {
+		log.Fatalln("failed creating outbox indexes:", err)
+	}
 
 	return &mongoEmailRepo{
-		emailThreadsCollection: emailThreadsCollection,
+		emailThreadsCollection:  emailThreadsCollection,
+		inboundEmailsCollection: inboundEmailsCollection,
+		outboxCollection:        outboxCollection,
 	}
 }
 
@@ -39,6 +78,13 @@ func (repo *mongoEmailRepo) ThreadSearch(
 ) (emailsvc.EmailThread, app.Error) {
 	const op = "mongoEmailRepo.ThreadSearch"
 	var orValues []bson.M
+	if st.ThreadId != "" {
+		id, err := primitive.ObjectIDFromHex(st.ThreadId)
+		if err != nil {
+			return emailsvc.EmailThread{}, app.NewErr(400, "invalid ThreadId", "")
+		}
+		orValues = append(orValues, bson.M{"_id": id})
+	}
 	if st.ChatId != "" {
 		id, err := primitive.ObjectIDFromHex(st.ChatId)
 		if err != nil {
@@ -49,6 +95,16 @@ func (repo *mongoEmailRepo) ThreadSearch(
 	if st.EmailMessageId != "" {
 		orValues = append(orValues, bson.M{"emails.messageId": st.EmailMessageId})
 	}
+	if st.Subject != "" && st.ParticipantEmail != "" {
+		orValues = append(orValues, bson.M{
+			"subject": primitive.Regex{
+				Pattern: fmt.Sprintf(`^\s*((re|fwd?|aw|sv|antw)(\[\d+\])?\s*:\s*)*%s\s*$`,
+					regexp.QuoteMeta(st.Subject)),
+				Options: "i",
+			},
+			"participants.email": strings.ToLower(st.ParticipantEmail),
+		})
+	}
 	res := repo.emailThreadsCollection.FindOne(ctx, bson.M{
 		"$or": orValues,
 	})
@@ -69,16 +125,160 @@ func (repo *mongoEmailRepo) AddEmail(
 ) app.Error {
 	const op = "mongoEmailRepo.AddEmail"
 	email.SentAt = time.Now()
-	res := repo.emailThreadsCollection.FindOneAndUpdate(ctx, bson.M{"_id": threadId}, bson.M{
+	// skip emails added already, e.g. when resuming an inbound email
+	res := repo.emailThreadsCollection.FindOneAndUpdate(ctx, bson.M{
+		"_id":              threadId,
+		"emails.messageId": bson.M{"$ne": email.MessageId},
+	}, bson.M{
 		"$push": bson.M{
 			"emails": email,
 		},
 	}, options.FindOneAndUpdate().SetProjection(bson.M{"_id": -1}))
-	if res.Err() != nil {
-		if res.Err() == mongo.ErrNoDocuments {
+	if res.Err() == mongo.ErrNoDocuments {
+		n, err := repo.emailThreadsCollection.CountDocuments(ctx, bson.M{"_id": threadId})
+		if err != nil {
+			return app.FromErr(err, fmt.Sprintf("%s: CountDocuments", op))
+		}
+		if n == 0 {
 			return app.NewErr(404, "", "")
 		}
+		return nil
+	} else if res.Err() != nil {
 		return app.FromErr(res.Err(), fmt.Sprintf("%s: FindOneAndUpdate", op))
 	}
 	return nil
 }
+
+func (repo *mongoEmailRepo) BeginInbound(
+	ctx context.Context,
+	messageId string,
+	threadId primitive.ObjectID,
+	now time.Time,
+	lease time.Duration,
+) (emailsvc.InboundRecord, app.Error) {
+	const op = "mongoEmailRepo.BeginInbound"
+	// matches unless another consumer holds the lease of a processing record
+	filter := bson.M{
+		"messageId": messageId,
+		"$or": []bson.M{
+			{"status": bson.M{"$ne": emailsvc.InboundProcessing}},
+			{"leasedUntil": bson.M{"$lte": now}},
+			{"leasedUntil": bson.M{"$exists": false}},
+		},
+	}
+	res := repo.inboundEmailsCollection.FindOneAndUpdate(ctx, filter, bson.M{
+		"$setOnInsert": bson.M{
+			"messageId": messageId,
+			"threadId":  threadId,
+			"status":    emailsvc.InboundProcessing,
+			"createdAt": now,
+		},
+		"$set": bson.M{
+			"leasedUntil": now.Add(lease),
+			"updatedAt":   now,
+		},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After))
+	// a leased record, or a concurrent upsert of the same messageId, fails on the unique index
+	leased := mongo.IsDuplicateKeyError(res.Err())
+	if leased {
+		res = repo.inboundEmailsCollection.FindOne(ctx, bson.M{"messageId": messageId})
+	}
+	var record emailsvc.InboundRecord
+	if err := res.Decode(&record); err != nil {
+		return emailsvc.InboundRecord{}, app.FromErr(err, fmt.Sprintf("%s: FindOneAndUpdate", op))
+	}
+	if leased && record.Status == emailsvc.InboundProcessing {
+		return emailsvc.InboundRecord{}, app.NewErr(503, "", "inbound email is being processed")
+	}
+	return record, nil
+}
+
+func (repo *mongoEmailRepo) UpdateInbound(
+	ctx context.Context,
+	record emailsvc.InboundRecord,
+) app.Error {
+	const op = "mongoEmailRepo.UpdateInbound"
+	res, err := repo.inboundEmailsCollection.UpdateOne(ctx, bson.M{"messageId": record.MessageId}, bson.M{
+		"$set": bson.M{
+			"status":      record.Status,
+			"email":       record.Email,
+			"leasedUntil": record.LeasedUntil,
+			"updatedAt":   time.Now(),
+		},
+	})
+	if err != nil {
+		return app.FromErr(err, fmt.Sprintf("%s: UpdateOne", op))
+	}
+	if res.MatchedCount == 0 {
+		return app.NewErr(404, "", "")
+	}
+	return nil
+}
+
+func (repo *mongoEmailRepo) EnqueueOutbox(
+	ctx context.Context,
+	msg emailsvc.OutboxMessage,
+) app.Error {
+	const op = "mongoEmailRepo.EnqueueOutbox"
+	_, err := repo.outboxCollection.UpdateOne(ctx, bson.M{"key": msg.Key}, bson.M{
+		"$setOnInsert": msg,
+	}, options.Update().SetUpsert(true))
+	// concurrent upserts of the same key race on the unique index
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return app.FromErr(err, fmt.Sprintf("%s: UpdateOne", op))
+	}
+	return nil
+}
+
+func (repo *mongoEmailRepo) LeaseOutbox(
+	ctx context.Context,
+	now time.Time,
+	lease time.Duration,
+) (emailsvc.OutboxMessage, app.Error) {
+	const op = "mongoEmailRepo.LeaseOutbox"
+	res := repo.outboxCollection.FindOneAndUpdate(ctx, bson.M{
+		"status": bson.M{"$in": []emailsvc.OutboxStatus{
+			emailsvc.OutboxPending,
+			emailsvc.OutboxSent,
+		}},
+		"nextAttemptAt": bson.M{"$lte": now},
+		"leasedUntil":   bson.M{"$lte": now},
+	}, bson.M{
+		"$set": bson.M{"leasedUntil": now.Add(lease)},
+	}, options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}}).
+		SetReturnDocument(options.After))
+	var msg emailsvc.OutboxMessage
+	err := res.Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return emailsvc.OutboxMessage{}, app.NewErr(404, "", "")
+	} else if err != nil {
+		return emailsvc.OutboxMessage{}, app.FromErr(err, fmt.Sprintf("%s: FindOneAndUpdate", op))
+	}
+	return msg, nil
+}
+
+func (repo *mongoEmailRepo) UpdateOutbox(
+	ctx context.Context,
+	msg emailsvc.OutboxMessage,
+) app.Error {
+	const op = "mongoEmailRepo.UpdateOutbox"
+	res, err := repo.outboxCollection.UpdateOne(ctx, bson.M{"_id": msg.Id}, bson.M{
+		"$set": bson.M{
+			"status":        msg.Status,
+			"attempts":      msg.Attempts,
+			"nextAttemptAt": msg.NextAttemptAt,
+			"leasedUntil":   time.Time{},
+			"lastError":     msg.LastError,
+			"email":         msg.Email,
+			"updatedAt":     msg.UpdatedAt,
+		},
+	})
+	if err != nil {
+		return app.FromErr(err, fmt.Sprintf("%s: UpdateOne", op))
+	}
+	if res.MatchedCount == 0 {
+		return app.NewErr(404, "", "")
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SecurityStartTLS = "starttls"
+	SecurityTLS      = "tls"
+	SecurityNone     = "none"
+)
+
+var _ emailsvc.Mailer = (*smtpMailer)(nil)
+
+type smtpMailer struct {
+	cfg    backend.SmtpConfig
+	domain string
+	host   string
+	tls    *tls.Config
+	pool   chan *conn
+}
+
+type conn struct {
+	net.Conn
+	c *netsmtp.Client
+}
+
+// NewMailer constructs an SMTP submission adapter for the Mailer interface.
+// The envelope's Message-Id is sent as is, or generated on cfg.Domain if missing,
+// so GetEmail needs no lookup.
+func NewMailer(cfg backend.Config) *smtpMailer {
+	host, _, err := net.SplitHostPort(cfg.Smtp.Addr)
+	if err != nil {
+		log.Fatal().Err(err).Str("addr", cfg.Smtp.Addr).Msg("failed parsing Smtp.Addr")
+	}
+	poolSize := cfg.Smtp.PoolSize
+	if poolSize <= 0 {
+		poolSize = 2
+	}
+	return &smtpMailer{
+		cfg:    cfg.Smtp,
+		domain: cfg.Domain,
+		host:   host,
+		tls: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: cfg.Smtp.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		},
+		pool: make(chan *conn, poolSize),
+	}
+}
+
+func (mailer *smtpMailer) Send(
+	ctx context.Context,
+	payload enmime.Envelope,
+) (emailsvc.SendResult, app.Error) {
+	const op = "smtpMailer.Send"
+	from, err := mail.ParseAddress(payload.GetHeader("From"))
+	if err != nil {
+		return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: ParseAddress", op))
+	}
+	var rcpts []string
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		addrs, err := emailsvc.AddressList(payload, h)
+		if err != nil {
+			return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: AddressList", op))
+		}
+		for _, addr := range addrs {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	if len(rcpts) == 0 {
+		return emailsvc.SendResult{}, app.NewErr(http.StatusBadRequest, "", op+": no recipients")
+	}
+
+	messageId := strings.TrimSpace(payload.GetHeader("Message-Id"))
+	if messageId == "" {
+		messageId = emailsvc.NewMessageId(mailer.domain)
+	}
+	data, err := emailsvc.EncodeEnvelope(payload, messageId)
+	if err != nil {
+		return emailsvc.SendResult{}, app.FromErr(err, fmt.Sprintf("%s: Encode", op))
+	}
+
+	cn, err := mailer.conn(ctx)
+	if err != nil {
+		e := smtpErr(err, op)
+		log.Error().Err(e).Send()
+		return emailsvc.SendResult{}, e
+	}
+	res := emailsvc.SendResult{
+		Provider:          "smtp",
+		ProviderMessageId: messageId,
+		MessageId:         messageId,
+	}
+	if err := cn.send(from.Address, rcpts, data, &res); err != nil {
+		cn.Close()
+		e := smtpErr(err, op)
+		log.Error().Err(e).Send()
+		return emailsvc.SendResult{}, e
+	}
+	mailer.release(cn)
+	log.Debug().
+		Str("mailer", "smtp").
+		Str("messageId", messageId).
+		Int("accepted", len(res.Accepted)).
+		Int("rejected", len(res.Rejected)).
+		Msg("sent msg")
+
+	return res, nil
+}
+
+// GetEmail returns the Message-Id generated by Send, which is also its ProviderMessageId.
+func (mailer *smtpMailer) GetEmail(_ context.Context, messageId string) (emailsvc.Email, app.Error) {
+	return emailsvc.Email{MessageId: messageId}, nil
+}
+
+// Close quits pooled connections.
+func (mailer *smtpMailer) Close() {
+	for {
+		select {
+		case cn := <-mailer.pool:
+			cn.c.Quit()
+		default:
+			return
+		}
+	}
+}
+
+// conn returns a healthy pooled connection or dials a new one.
+func (mailer *smtpMailer) conn(ctx context.Context) (*conn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Minute)
+	}
+	for {
+		select {
+		case cn := <-mailer.pool:
+			cn.SetDeadline(deadline)
+			if err := cn.c.Noop(); err == nil {
+				return cn, nil
+			}
+			cn.Close()
+		default:
+			return mailer.dial(ctx, deadline)
+		}
+	}
+}
+
+func (mailer *smtpMailer) dial(ctx context.Context, deadline time.Time) (*conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	var nc net.Conn
+	var err error
+	switch mailer.cfg.Security {
+	case SecurityTLS:
+		nc, err = (&tls.Dialer{NetDialer: d, Config: mailer.tls}).DialContext(ctx, "tcp", mailer.cfg.Addr)
+	case SecurityStartTLS, SecurityNone, "":
+		nc, err = d.DialContext(ctx, "tcp", mailer.cfg.Addr)
+	default:
+		return nil, fmt.Errorf("unknown Smtp.Security %s", mailer.cfg.Security)
+	}
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(deadline)
+
+	c, err := netsmtp.NewClient(nc, mailer.host)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	cn := &conn{Conn: nc, c: c}
+	if err := cn.init(mailer); err != nil {
+		cn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (cn *conn) init(mailer *smtpMailer) error {
+	if err := cn.c.Hello(mailer.domain); err != nil {
+		return err
+	}
+	if mailer.cfg.Security == SecurityStartTLS || mailer.cfg.Security == "" {
+		if ok, _ := cn.c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := cn.c.StartTLS(mailer.tls); err != nil {
+			return err
+		}
+	}
+	if mailer.cfg.Username != "" {
+		auth := netsmtp.PlainAuth("", mailer.cfg.Username, mailer.cfg.Password, mailer.host)
+		if err := cn.c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send submits data to the accepted rcpts, recording rejections in res.
+// The transaction is reset if every recipient is rejected.
+func (cn *conn) send(from string, rcpts []string, data []byte, res *emailsvc.SendResult) error {
+	if err := cn.c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		err := cn.c.Rcpt(rcpt)
+		var tpErr *textproto.Error
+		switch {
+		case err == nil:
+			res.Accepted = append(res.Accepted, rcpt)
+		case errors.As(err, &tpErr):
+			res.Rejected = append(res.Rejected, rcpt)
+			if tpErr.Code < 500 {
+				res.Retryable = true
+			}
+		default:
+			return err
+		}
+	}
+	if len(res.Accepted) == 0 {
+		return cn.c.Reset()
+	}
+	w, err := cn.c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// release returns cn to the pool or quits it if the pool is full.
+func (mailer *smtpMailer) release(cn *conn) {
+	select {
+	case mailer.pool <- cn:
+	default:
+		cn.c.Quit()
+	}
+}
+
+// smtpErr maps transient 4xx replies to 503 and permanent 5xx replies to 422.
+// Connection errors are 500.
+func smtpErr(err error, op string) app.Error {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		code := http.StatusServiceUnavailable
+		if tpErr.Code >= 500 {
+			code = http.StatusUnprocessableEntity
+		}
+		return app.NewErr(code, fmt.Sprintf("%d %s", tpErr.Code, tpErr.Msg), op)
+	}
+	return app.FromErr(err, op)
+}
@@ -0,0 +1,207 @@
+package smtp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/smtp"
+	"github.com/emersion/go-sasl"
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+func TestSmtpMailer(t *testing.T) {
+	be := &testBackend{}
+	srv := gosmtp.NewServer(be)
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	cfg := backend.Config{
+		Domain: "domain.com",
+		Smtp: backend.SmtpConfig{
+			Addr:     l.Addr().String(),
+			Security: smtp.SecurityNone,
+			Username: "user",
+			Password: "pass",
+		},
+	}
+	m := smtp.NewMailer(cfg)
+	defer m.Close()
+
+	root, err := enmime.Builder().
+		From("John Smith", "mailer@domain.com").
+		To("Ben N", "ben@yahoo.com").
+		CCAddrs([]mail.Address{{Address: "cc@yahoo.com"}, {Address: "rejected@yahoo.com"}}).
+		Subject("Re: subject").
+		Header("In-Reply-To", "<first@domain.com>").
+		Header("References", "<first@domain.com>").
+		Text([]byte("Hello, world!")).
+		HTML([]byte(`<p>Hello, <img src="cid:logo"></p>`)).
+		AddInline([]byte("png"), "image/png", "logo.png", "logo").
+		AddAttachment([]byte("pdf"), "application/pdf", "doc.pdf").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := root.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	env, err := enmime.ReadEnvelope(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bcc is a recipient but never rendered
+	if err := env.AddHeader("Bcc", "bcc@yahoo.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// two sends reuse the pooled connection
+	var messageIds []string
+	for i := 0; i < 2; i++ {
+		res, e := m.Send(context.Background(), *env)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(res.Accepted) != 3 || len(res.Rejected) != 1 || res.Retryable {
+			t.Fatalf("unexpected result %#v", res)
+		}
+		if res.MessageId != res.ProviderMessageId {
+			t.Fatalf("expected ProviderMessageId %s, got %s", res.MessageId, res.ProviderMessageId)
+		}
+		messageIds = append(messageIds, res.MessageId)
+	}
+	if messageIds[0] == messageIds[1] || !strings.HasSuffix(messageIds[0], "@domain.com>") {
+		t.Fatalf("unexpected Message-Ids %v", messageIds)
+	}
+	email, e := m.GetEmail(context.Background(), messageIds[0])
+	if e != nil || email.MessageId != messageIds[0] {
+		t.Fatalf("unexpected GetEmail %v, %v", email, e)
+	}
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if be.sessions != 1 {
+		t.Fatalf("expected 1 pooled connection, got %d", be.sessions)
+	}
+	if len(be.msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(be.msgs))
+	}
+	msg := be.msgs[0]
+	if msg.from != "mailer@domain.com" ||
+		strings.Join(msg.rcpts, ",") != "ben@yahoo.com,cc@yahoo.com,bcc@yahoo.com" {
+		t.Fatalf("unexpected envelope %s %v", msg.from, msg.rcpts)
+	}
+	got, err := enmime.ReadEnvelope(bytes.NewReader(msg.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h, want := range map[string]string{
+		"Message-Id":  messageIds[0],
+		"In-Reply-To": "<first@domain.com>",
+		"References":  "<first@domain.com>",
+		"Subject":     "Re: subject",
+		"Bcc":         "",
+	} {
+		if v := got.GetHeader(h); v != want {
+			t.Fatalf("expected %s %q, got %q", h, want, v)
+		}
+	}
+	if len(got.Attachments) != 1 || len(got.Inlines) != 1 || got.Inlines[0].ContentID != "logo" {
+		t.Fatalf("unexpected parts: %d attachments, %d inlines", len(got.Attachments), len(got.Inlines))
+	}
+}
+
+type testMsg struct {
+	from  string
+	rcpts []string
+	data  []byte
+}
+
+type testBackend struct {
+	mu       sync.Mutex
+	sessions int
+	msgs     []testMsg
+}
+
+func (be *testBackend) NewSession(*gosmtp.Conn) (gosmtp.Session, error) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	be.sessions++
+	return &testSession{be: be}, nil
+}
+
+type testSession struct {
+	be     *testBackend
+	authed bool
+	msg    testMsg
+}
+
+func (s *testSession) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s *testSession) Auth(string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(_, username, password string) error {
+		if username != "user" || password != "pass" {
+			return errors.New("invalid credentials")
+		}
+		s.authed = true
+		return nil
+	}), nil
+}
+
+func (s *testSession) Mail(from string, _ *gosmtp.MailOptions) error {
+	if !s.authed {
+		return gosmtp.ErrAuthRequired
+	}
+	s.msg.from = from
+	return nil
+}
+
+func (s *testSession) Rcpt(to string, _ *gosmtp.RcptOptions) error {
+	if strings.HasPrefix(to, "rejected@") {
+		return &gosmtp.SMTPError{Code: 550, Message: "no such user"}
+	}
+	s.msg.rcpts = append(s.msg.rcpts, to)
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = data
+	s.be.mu.Lock()
+	defer s.be.mu.Unlock()
+	s.be.msgs = append(s.be.msgs, s.msg)
+	return nil
+}
+
+func (s *testSession) Reset() {
+	s.msg = testMsg{}
+}
+
+func (s *testSession) Logout() error {
+	return nil
+}
@@ -0,0 +1,202 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/emersion/go-smtp"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ModeKafka   = "kafka"
+	ModeForward = "forward"
+
+	defaultMaxMessageBytes = 25 << 20
+	defaultMaxRecipients   = 50
+)
+
+// InboundHandler is called with every inbound email that passed gatekeeping.
+// Returning an error makes the server answer with a temporary failure so the
+// sending MTA retries later.
+type InboundHandler func(ctx context.Context, raw []byte, inbound *enmime.Envelope) error
+
+// NewServer constructs an SMTP server that accepts replies to known email threads
+// and hands them to handler. It replaces the Haraka inbound-smtp-server and its gatekeep plugin.
+func NewServer(
+	ctx context.Context,
+	cfg backend.Config,
+	svc emailsvc.EmailService,
+	handler InboundHandler,
+) *smtp.Server {
+	be := &smtpBackend{
+		ctx:     ctx,
+		cfg:     cfg,
+		svc:     svc,
+		handler: handler,
+	}
+
+	s := smtp.NewServer(be)
+	s.Addr = cfg.InboundSmtp.Addr
+	if s.Addr == "" {
+		s.Addr = ":25"
+	}
+	s.Domain = cfg.Domain
+	s.MaxMessageBytes = cfg.InboundSmtp.MaxMessageBytes
+	if s.MaxMessageBytes == 0 {
+		s.MaxMessageBytes = defaultMaxMessageBytes
+	}
+	s.MaxRecipients = cfg.InboundSmtp.MaxRecipients
+	if s.MaxRecipients == 0 {
+		s.MaxRecipients = defaultMaxRecipients
+	}
+	s.ReadTimeout = time.Minute
+	s.WriteTimeout = time.Minute
+	return s
+}
+
+type smtpBackend struct {
+	ctx     context.Context
+	cfg     backend.Config
+	svc     emailsvc.EmailService
+	handler InboundHandler
+}
+
+func (be *smtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{
+		be:         be,
+		remoteAddr: c.Conn().RemoteAddr().String(),
+	}, nil
+}
+
+type session struct {
+	be         *smtpBackend
+	remoteAddr string
+
+	from  string
+	rcpts []string
+}
+
+func (s *session) Mail(from string, _ *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+// Rcpt only accepts recipients of our own domain.
+func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         501,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Bad recipient address syntax",
+		}
+	}
+	_, domain, _ := strings.Cut(addr.Address, "@")
+	if !strings.EqualFold(domain, s.be.cfg.Domain) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Relaying denied",
+		}
+	}
+	if emailsvc.IsReplyAddress(addr.Address) {
+		if _, err := emailsvc.ParseReplyAddress(s.be.cfg, addr.Address, time.Now()); err != nil {
+			log.Debug().Err(err).Str("rcpt", addr.Address).Msg("rejected reply address")
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "Invalid or expired reply address",
+			}
+		}
+	}
+	s.rcpts = append(s.rcpts, addr.Address)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	start := time.Now()
+	// record envelope recipients like a delivering MTA would since reply
+	// addresses are not guaranteed to appear in the "To" header
+	var buf bytes.Buffer
+	for _, rcpt := range s.rcpts {
+		fmt.Fprintf(&buf, "Delivered-To: %s\r\n", rcpt)
+	}
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	raw := buf.Bytes()
+
+	inbound, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		log.Warn().Err(err).Str("remoteAddr", s.remoteAddr).Msg("failed ReadEnvelope")
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Malformed message",
+		}
+	}
+
+	if err := s.gatekeep(inbound); err != nil {
+		return err
+	}
+
+	if err := s.be.handler(s.be.ctx, raw, inbound); err != nil {
+		log.Error().Err(err).Str("remoteAddr", s.remoteAddr).Msg("failed InboundHandler")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary failure, try again later",
+		}
+	}
+
+	log.Debug().
+		Str("from", s.from).
+		Strs("rcpts", s.rcpts).
+		Str("messageId", inbound.GetHeader("Message-Id")).
+		Dur("elapsed", time.Since(start)).
+		Msg("accepted inbound email")
+	return nil
+}
+
+// gatekeep only lets through replies to server sent emails by resolving
+// their threading headers against the emailThreads collection.
+func (s *session) gatekeep(inbound *enmime.Envelope) error {
+	ctx, cancel := context.WithTimeout(s.be.ctx, s.be.cfg.ReadTimeout)
+	defer cancel()
+	_, err := s.be.svc.ResolveThread(ctx, emailsvc.NewThreadResolveTerms(inbound))
+	if err != nil {
+		if code := err.StatusCode(); code == 403 || code == 404 {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Message is not a reply to a known thread",
+			}
+		}
+		log.Error().Err(app.FromErr(err, "session.gatekeep")).Send()
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+			Message:      "Temporary failure resolving thread",
+		}
+	}
+	return nil
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
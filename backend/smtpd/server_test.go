@@ -0,0 +1,172 @@
+package smtpd_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/smtpd"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+}
+
+const message = "From: John Smith <johnsmith@yahoo.com>\r\n" +
+	"To: thread@domain.com\r\n" +
+	"Subject: Re: subject\r\n" +
+	"Message-Id: <reply@yahoo.com>\r\n" +
+	"In-Reply-To: <first@domain.com>\r\n" +
+	"\r\n" +
+	"Hello, world!\r\n"
+
+func TestServer(t *testing.T) {
+	cfg := backend.Config{
+		Domain:      "domain.com",
+		ReadTimeout: time.Second,
+	}
+	cfg.Email.ReplySecret = "secret"
+	cfg.Email.ReplyTokenTTL = time.Hour
+	svc := &testService{}
+	var (
+		mu       sync.Mutex
+		received [][]byte
+	)
+	handler := func(_ context.Context, raw []byte, _ *enmime.Envelope) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, raw)
+		return nil
+	}
+	addr := serve(t, cfg, svc, handler)
+
+	t.Run("relay denied", func(t *testing.T) {
+		c := dial(t, addr)
+		defer c.Close()
+		if err := c.Mail("johnsmith@yahoo.com"); err != nil {
+			t.Fatal(err)
+		}
+		assertCode(t, c.Rcpt("ben@yahoo.com"), 550)
+	})
+
+	t.Run("reply addresses", func(t *testing.T) {
+		threadId := primitive.NewObjectID()
+		valid := emailsvc.ReplyAddress(cfg, threadId, time.Now())
+		expired := emailsvc.ReplyAddress(cfg, threadId, time.Now().Add(-2*time.Hour))
+		forged := []byte(valid)
+		forged[len("reply+")] ^= 1
+
+		c := dial(t, addr)
+		defer c.Close()
+		if err := c.Mail("johnsmith@yahoo.com"); err != nil {
+			t.Fatal(err)
+		}
+		assertCode(t, c.Rcpt(expired), 550)
+		assertCode(t, c.Rcpt(string(forged)), 550)
+		if err := c.Rcpt(valid); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("delivered to", func(t *testing.T) {
+		if err := send(addr, "thread@domain.com", message); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(received) != 1 {
+			t.Fatalf("got %d emails, want 1", len(received))
+		}
+		if !strings.HasPrefix(string(received[0]), "Delivered-To: thread@domain.com\r\nFrom: ") {
+			t.Errorf("got %q", received[0])
+		}
+	})
+
+	t.Run("gatekeep", func(t *testing.T) {
+		tests := []struct {
+			name string
+			err  app.Error
+			code int
+		}{
+			{name: "unknown thread", err: app.NewErr(404, "", ""), code: 550},
+			{name: "forbidden", err: app.NewErr(403, "", ""), code: 550},
+			{name: "unavailable", err: app.NewErr(503, "", ""), code: 451},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				svc.setErr(tt.err)
+				defer svc.setErr(nil)
+				assertCode(t, send(addr, "thread@domain.com", message), tt.code)
+			})
+		}
+	})
+}
+
+func serve(t *testing.T, cfg backend.Config, svc emailsvc.EmailService, handler smtpd.InboundHandler) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := smtpd.NewServer(context.Background(), cfg, svc, handler)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *smtp.Client {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func send(addr, rcpt, msg string) error {
+	return smtp.SendMail(addr, nil, "johnsmith@yahoo.com", []string{rcpt}, []byte(msg))
+}
+
+func assertCode(t *testing.T, err error, code int) {
+	t.Helper()
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != code {
+		t.Errorf("got error %v, want code %d", err, code)
+	}
+}
+
+type testService struct {
+	emailsvc.EmailService
+	mu  sync.Mutex
+	err app.Error
+}
+
+func (s *testService) setErr(err app.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *testService) ResolveThread(
+	context.Context,
+	emailsvc.ThreadResolveTerms,
+) (emailsvc.ThreadResolution, app.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return emailsvc.ThreadResolution{}, s.err
+	}
+	return emailsvc.ThreadResolution{}, nil
+}
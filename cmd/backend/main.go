@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"time"
@@ -12,13 +12,15 @@ import (
 	"github.com/benjamonnguyen/gootils/devlog"
 	"github.com/benjamonnguyen/opendoorchat/backend"
 	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc/consumer"
 	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
-	"github.com/benjamonnguyen/opendoorchat/backend/mailersend"
+	"github.com/benjamonnguyen/opendoorchat/backend/localfs"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailcapture"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailrouter"
 	"github.com/benjamonnguyen/opendoorchat/backend/mongodb"
-	"github.com/jhillyerd/enmime"
+	"github.com/benjamonnguyen/opendoorchat/keycloak"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/twmb/franz-go/pkg/kgo"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -39,24 +41,38 @@ func main() {
 		<-interruptSignal
 		cancel()
 	}()
-	shutdownManager := backend.GracefulShutdownManager{}
+	shutdownManager := &backend.GracefulShutdownManager{}
 
 	// dependencies
-	m := mailersend.NewMailer(cfg.MailerSendApiKey)
+	m := initMailer(cfg, shutdownManager)
+	cl, producer := initKafka(ctx, cfg, shutdownManager)
 
 	// repositories
 	dbClient := initDbClient(ctx, cfg, shutdownManager)
 	emailRepo := mongodb.NewEmailRepo(cfg, dbClient)
+	blobStore := localfs.BlobStoreFromConfig(cfg.BlobStore)
+	userRepo := keycloak.NewUserRepo(&http.Client{Timeout: cfg.RequestTimeout}, cfg.Keycloak)
 
 	// services
-	emailService := emailsvc.NewEmailService(emailRepo)
+	emailService := emailsvc.NewEmailService(cfg, emailRepo, emailRepo, blobStore)
 
 	// controllers
-	emailCtrl := emailsvc.NewEmailController(emailService)
+	emailCtrl := emailsvc.NewEmailController(cfg, emailService, userRepo)
+	kafkaAdminCtrl := kafka.NewAdminController(cfg, cl)
+	var inboxCtrl mailcapture.InboxController
+	if c, ok := m.(mailcapture.Capture); ok {
+		inboxCtrl = mailcapture.NewInboxController(cfg, c, emailService)
+	}
 
 	// meat and potatoes
-	go startEmailSvcConsumers(ctx, cfg, shutdownManager, emailService, m)
-	go listenAndServeRoutes(ctx, cfg, shutdownManager, emailCtrl)
+	go func() {
+		if err := startEmailSvcConsumers(ctx, cfg, emailService, m, cl, producer); err != nil {
+			log.Error().Err(err).Msg("failed email-svc consumers, shutting down")
+			cancel()
+		}
+	}()
+	go emailService.DispatchOutbox(ctx, m)
+	go listenAndServeRoutes(ctx, cfg, shutdownManager, emailCtrl, kafkaAdminCtrl, inboxCtrl)
 
 	log.Info().Msgf("started application after %s", time.Since(start).Truncate(time.Second))
 
@@ -79,7 +95,7 @@ func loadConfig(path string) backend.Config {
 func initDbClient(
 	ctx context.Context,
 	cfg backend.Config,
-	shutdownManager backend.GracefulShutdownManager,
+	shutdownManager *backend.GracefulShutdownManager,
 ) *mongo.Client {
 	connCtx, connCanc := context.WithTimeout(ctx, 10*time.Second)
 	defer connCanc()
@@ -92,13 +108,52 @@ func initDbClient(
 	return dbClient
 }
 
+func initMailer(
+	cfg backend.Config,
+	shutdownManager *backend.GracefulShutdownManager,
+) emailsvc.Mailer {
+	m, closeMailer := mailrouter.FromConfig(cfg)
+	shutdownManager.AddHandler(closeMailer)
+	return m
+}
+
+func initKafka(
+	ctx context.Context,
+	cfg backend.Config,
+	shutdownManager *backend.GracefulShutdownManager,
+) (kafka.KafkaConsumerClient, kafka.KafkaProducerClient) {
+	var cl kafka.KafkaConsumerClient
+	var producer kafka.KafkaProducerClient
+	if cfg.Kafka.InMemory {
+		log.Warn().Msg("using in-memory kafka broker")
+		broker := kafka.NewMemoryBroker(3)
+		cl, producer = broker.NewConsumerClient(emailSvcGroupId(cfg)), broker.NewProducerClient()
+	} else {
+		cl = kafka.NewSplitConsumerClient(ctx, cfg.Kafka, emailSvcGroupId(cfg))
+		producer = kafka.NewProducerClient(ctx, cfg.Kafka)
+	}
+	shutdownManager.AddHandler(func() {
+		cl.Shutdown()
+	})
+	shutdownManager.AddHandler(func() {
+		producer.Shutdown()
+	})
+	return cl, producer
+}
+
+func emailSvcGroupId(cfg backend.Config) string {
+	return fmt.Sprintf("%s-%s", cfg.Kafka.User, "email-svc")
+}
+
 func listenAndServeRoutes(
 	ctx context.Context,
 	cfg backend.Config,
-	shutdownManager backend.GracefulShutdownManager,
+	shutdownManager *backend.GracefulShutdownManager,
 	emailCtrl emailsvc.EmailController,
+	kafkaAdminCtrl kafka.AdminController,
+	inboxCtrl mailcapture.InboxController,
 ) {
-	srv := buildServer(cfg, emailCtrl)
+	srv := buildServer(cfg, emailCtrl, kafkaAdminCtrl, inboxCtrl)
 	shutdownManager.AddHandler(func() {
 		if err := srv.Shutdown(ctx); err != nil {
 			log.Error().Err(err).Msg("failed srv.Shutdown")
@@ -113,36 +168,17 @@ func listenAndServeRoutes(
 func startEmailSvcConsumers(
 	ctx context.Context,
 	cfg backend.Config,
-	shutdownManager backend.GracefulShutdownManager,
 	emailService emailsvc.EmailService,
 	m emailsvc.Mailer,
-) {
-	cl := kafka.NewSplitConsumerClient(
-		ctx,
-		cfg.Kafka,
-		fmt.Sprintf("%s-%s", cfg.Kafka.User, "email-svc"),
-	)
-
+	cl kafka.KafkaConsumerClient,
+	producer kafka.KafkaProducerClient,
+) error {
 	// inboundEmailsConsumer
-	if err := cl.SetRecordHandler(cfg.Kafka.Topics.InboundEmails, func(rec *kgo.Record) {
-		inbound, err := enmime.ReadEnvelope(bytes.NewReader(rec.Value))
-		if err != nil {
-			log.Error().Err(err).Send()
-			return
-		}
-		if err := emailService.ForwardInboundEmail(ctx, cfg, m, inbound); err != nil {
-			// TODO DLQ e.StatusCode()
-			log.Error().Err(err).Send()
-			return
-		}
-	}); err != nil {
-		log.Fatal().Err(err).Msg("failed AddInboundEmailsConsumer")
-	}
-	log.Info().Msg("added inboundEmails consumer")
-	shutdownManager.AddHandler(func() {
-		cl.Shutdown()
-	})
+	consumer.AddInboundEmailsConsumer(ctx, cfg, emailService, m, cl, producer)
+
+	// chatMessagesConsumer
+	consumer.AddChatMessagesConsumer(ctx, cfg, emailService, m, cl)
 
 	//
-	cl.Poll(ctx)
+	return cl.Poll(ctx)
 }
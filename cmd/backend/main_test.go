@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/benjamonnguyen/opendoorchat/keycloak"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+func TestInboundEmailsConsumer(t *testing.T) {
+	cfg := backend.Config{
+		Domain:         "domain.com",
+		ReadTimeout:    time.Second,
+		RequestTimeout: time.Second,
+	}
+	cfg.Kafka.InMemory = true
+	cfg.Kafka.Topics.InboundEmails = "inboundEmails"
+	cfg.Kafka.Topics.InboundEmailsRetry = "inboundEmailsRetry"
+	cfg.Kafka.Topics.InboundEmailsDLQ = "inboundEmailsDLQ"
+	cfg.Kafka.Topics.ChatMessages = "chatMessages"
+	cfg.Kafka.Retry.MaxRetries = 1
+	cfg.Kafka.Retry.Backoff = time.Millisecond
+
+	thread := emailsvc.EmailThread{
+		Id: primitive.NewObjectID(),
+		Participants: []app.User{
+			keycloak.User{FirstName: "John", LastName: "Smith", Email: "johnsmith@yahoo.com"},
+			keycloak.User{FirstName: "Ben", LastName: "N", Email: "ben@yahoo.com"},
+		},
+		Subject: "subject",
+		Emails:  []emailsvc.Email{{MessageId: "<first@mailer.net>"}},
+	}
+	repo := &fakeEmailRepo{thread: thread, inbound: make(map[string]emailsvc.InboundRecord)}
+	// the first send fails with a retryable error
+	m := &fakeMailer{failures: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := kafka.NewMemoryBroker(3)
+	cl, producer := broker.NewConsumerClient(emailSvcGroupId(cfg)), broker.NewProducerClient()
+	defer cl.Shutdown()
+	go startEmailSvcConsumers(ctx, cfg, emailsvc.NewEmailService(cfg, repo, nil, nil), m, cl, producer)
+
+	raw := "From: John Smith <johnsmith@yahoo.com>\r\n" +
+		"To: ben@domain.com\r\n" +
+		"Subject: Re: subject\r\n" +
+		"Message-Id: <reply@yahoo.com>\r\n" +
+		"In-Reply-To: <first@mailer.net>\r\n" +
+		"\r\n" +
+		"Hello, world!\r\n"
+	rec := kafka.NewRecord(cfg.Kafka.Topics.InboundEmails, "<first@mailer.net>", []byte(raw))
+	if err := producer.ProduceSync(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for repo.status("<reply@yahoo.com>") != emailsvc.InboundCompleted {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for inbound email to be forwarded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sent := m.sentEnvelopes()
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 forwarded email, got %d", len(sent))
+	}
+	if to := sent[0].GetHeader("To"); to != "Ben N <ben@yahoo.com>" {
+		t.Fatalf("unexpected To header %q", to)
+	}
+	if got := broker.CommittedOffset(emailSvcGroupId(cfg), rec.Topic, rec.Partition); got != rec.Offset+1 {
+		t.Fatalf("expected committed offset %d, got %d", rec.Offset+1, got)
+	}
+}
+
+type fakeEmailRepo struct {
+	mu      sync.Mutex
+	thread  emailsvc.EmailThread
+	inbound map[string]emailsvc.InboundRecord
+}
+
+func (r *fakeEmailRepo) ThreadSearch(
+	_ context.Context,
+	st emailsvc.ThreadSearchTerms,
+) (emailsvc.EmailThread, app.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.thread.Emails {
+		if st.EmailMessageId != "" && e.MessageId == st.EmailMessageId {
+			return r.thread, nil
+		}
+	}
+	return emailsvc.EmailThread{}, app.NewErr(http.StatusNotFound, "", "thread not found")
+}
+
+func (r *fakeEmailRepo) AddEmail(_ context.Context, _ primitive.ObjectID, email emailsvc.Email) app.Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.thread.Emails = append(r.thread.Emails, email)
+	return nil
+}
+
+func (r *fakeEmailRepo) BeginInbound(
+	_ context.Context,
+	messageId string,
+	threadId primitive.ObjectID,
+	_ time.Time,
+	_ time.Duration,
+) (emailsvc.InboundRecord, app.Error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rec, ok := r.inbound[messageId]; ok {
+		return rec, nil
+	}
+	rec := emailsvc.InboundRecord{
+		MessageId: messageId,
+		ThreadId:  threadId,
+		Status:    emailsvc.InboundProcessing,
+	}
+	r.inbound[messageId] = rec
+	return rec, nil
+}
+
+func (r *fakeEmailRepo) UpdateInbound(_ context.Context, rec emailsvc.InboundRecord) app.Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inbound[rec.MessageId] = rec
+	return nil
+}
+
+func (r *fakeEmailRepo) status(messageId string) emailsvc.InboundStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.inbound[messageId].Status
+}
+
+type fakeMailer struct {
+	mu       sync.Mutex
+	failures int
+	sent     []enmime.Envelope
+}
+
+func (m *fakeMailer) Send(_ context.Context, env enmime.Envelope) (emailsvc.SendResult, app.Error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return emailsvc.SendResult{}, app.NewErr(http.StatusServiceUnavailable, "", "mailer unavailable")
+	}
+	m.sent = append(m.sent, env)
+	return emailsvc.SendResult{
+		Provider:          "fake",
+		ProviderMessageId: fmt.Sprint(len(m.sent)),
+		Accepted:          []string{env.GetHeader("To")},
+	}, nil
+}
+
+func (m *fakeMailer) GetEmail(_ context.Context, id string) (emailsvc.Email, app.Error) {
+	return emailsvc.Email{MessageId: fmt.Sprintf("<%s@mailer.net>", id)}, nil
+}
+
+func (m *fakeMailer) sentEnvelopes() []enmime.Envelope {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]enmime.Envelope(nil), m.sent...)
+}
@@ -1,21 +1,55 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"time"
 
+	app "github.com/benjamonnguyen/opendoorchat"
 	"github.com/benjamonnguyen/opendoorchat/backend"
 	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailcapture"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/negroni"
 )
 
 func buildServer(
 	cfg backend.Config,
 	emailsvc emailsvc.EmailController,
+	kafkaAdmin kafka.AdminController,
+	inbox mailcapture.InboxController,
 ) *http.Server {
 	// email
 	http.HandleFunc("POST /email/thread/search", emailsvc.ThreadSearch)
+	http.HandleFunc("GET /email/thread/{threadId}/attachments/{sha256}", emailsvc.DownloadAttachment)
+
+	// health
+	http.HandleFunc("GET /healthz", kafkaAdmin.ConsumerHealth)
+	http.Handle("GET /metrics", promhttp.Handler())
+
+	// admin
+	if cfg.AdminToken != "" {
+		// called by the inbound SMTP gatekeeper
+		http.HandleFunc("POST /email/thread/resolve",
+			requireAdminToken(cfg, emailsvc.ThreadResolve))
+		http.HandleFunc("POST /admin/kafka/dlq/replay",
+			requireAdminToken(cfg, kafkaAdmin.ReplayDeadLetters))
+		http.HandleFunc("POST /admin/kafka/topics/pause",
+			requireAdminToken(cfg, kafkaAdmin.PauseTopics))
+		http.HandleFunc("POST /admin/kafka/topics/resume",
+			requireAdminToken(cfg, kafkaAdmin.ResumeTopics))
+	}
+
+	// dev
+	if inbox != nil {
+		http.HandleFunc("GET /dev/mail", mailcapture.LocalOnly(inbox.Inbox))
+		http.HandleFunc("GET /dev/mail/{id}", mailcapture.LocalOnly(inbox.Message))
+		http.HandleFunc("GET /dev/mail/{id}/html", mailcapture.LocalOnly(inbox.MessageHTML))
+		http.HandleFunc("GET /dev/mail/{id}/parts/{part}", mailcapture.LocalOnly(inbox.Part))
+		http.HandleFunc("POST /dev/mail/{id}/reply", mailcapture.LocalOnly(inbox.Reply))
+	}
 
 	n := negroni.Classic()
 	n.UseHandler(http.DefaultServeMux)
@@ -27,3 +61,14 @@ func buildServer(
 		WriteTimeout: time.Minute,
 	}
 }
+
+func requireAdminToken(cfg backend.Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tkn := r.Header.Get(app.ADMIN_TOKEN_HEADER_KEY)
+		if subtle.ConstantTimeCompare([]byte(tkn), []byte(cfg.AdminToken)) != 1 {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -48,7 +48,7 @@ func main() {
 	authenticationCtrl := html.NewAuthenticationController(authCl, userRepo)
 
 	// server
-	srv := buildServer(cfg, hub, cl, authenticationCtrl)
+	srv := buildServer(cfg, hub, cl, authCl, authenticationCtrl)
 	go func() {
 		if err := srv.ListenAndServe(); err != nil {
 			log.Println("ListenAndServe:", err)
@@ -7,6 +7,7 @@ import (
 	"github.com/benjamonnguyen/opendoorchat/frontend/be"
 	"github.com/benjamonnguyen/opendoorchat/frontend/html"
 	"github.com/benjamonnguyen/opendoorchat/frontend/ws"
+	"github.com/benjamonnguyen/opendoorchat/keycloak"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/negroni"
@@ -16,6 +17,7 @@ func buildServer(
 	cfg frontend.Config,
 	hub *ws.Hub,
 	cl *http.Client,
+	authCl *keycloak.AuthClient,
 	authenticationCtrl *html.AuthenticationController,
 ) *http.Server {
 	upgrader := websocket.Upgrader{
@@ -54,6 +56,9 @@ func buildServer(
 	chatCtrl := html.NewChatController(backendCl)
 	http.HandleFunc("GET /api/chat-view", chatCtrl.ChatView)
 	http.HandleFunc("POST /api/chat", chatCtrl.CreateChat)
+	// attachment links of emails, served to logged in thread participants
+	attachmentCtrl := html.NewAttachmentController(authCl, backendCl)
+	http.HandleFunc("GET /email/thread/{threadId}/attachments/{sha256}", attachmentCtrl.Download)
 
 	// WS
 	http.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
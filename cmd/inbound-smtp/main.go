@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/benjamonnguyen/opendoorchat/backend/localfs"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailrouter"
+	"github.com/benjamonnguyen/opendoorchat/backend/mongodb"
+	"github.com/benjamonnguyen/opendoorchat/backend/smtpd"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	start := time.Now()
+
+	// config
+	cfgFile := flag.String("cfg", "config.yml", "configuration file")
+	flag.Parse()
+	cfg := loadConfig(*cfgFile)
+
+	// set up graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	interruptSignal := make(chan os.Signal, 1)
+	signal.Notify(interruptSignal, os.Interrupt)
+	go func() {
+		<-interruptSignal
+		cancel()
+	}()
+	shutdownManager := &backend.GracefulShutdownManager{}
+
+	// repositories
+	connCtx, connCanc := context.WithTimeout(ctx, 10*time.Second)
+	defer connCanc()
+	dbClient := mongodb.ConnectMongoClient(connCtx, cfg.Mongo)
+	shutdownManager.AddHandler(func() {
+		if err := dbClient.Disconnect(ctx); err != nil {
+			log.Error().Err(err).Msg("failed dbClient.Disconnect")
+		}
+	})
+	emailRepo := mongodb.NewEmailRepo(cfg, dbClient)
+	blobStore := localfs.BlobStoreFromConfig(cfg.BlobStore)
+
+	// services
+	emailService := emailsvc.NewEmailService(cfg, emailRepo, emailRepo, blobStore)
+
+	// inbound handler
+	var handler smtpd.InboundHandler
+	switch cfg.InboundSmtp.Mode {
+	case smtpd.ModeForward:
+		m, closeMailer := mailrouter.FromConfig(cfg)
+		shutdownManager.AddHandler(closeMailer)
+		go emailService.DispatchOutbox(ctx, m)
+		handler = forwardHandler(cfg, emailService, m)
+	case smtpd.ModeKafka, "":
+		if cfg.Kafka.InMemory {
+			log.Fatal().Msg("in-memory kafka broker is not shared with the backend, use InboundSmtp.Mode forward")
+		}
+		handler = publishHandler(ctx, cfg, shutdownManager)
+	default:
+		log.Fatal().Str("mode", cfg.InboundSmtp.Mode).Msg("unknown InboundSmtp.Mode")
+	}
+
+	// meat and potatoes
+	srv := smtpd.NewServer(ctx, cfg, emailService, handler)
+	shutdownManager.AddHandler(func() {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("failed srv.Shutdown")
+		}
+	})
+	go func() {
+		log.Info().Msgf("starting smtp server on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Error().Err(err).Msg("failed srv.ListenAndServe")
+			cancel()
+		}
+	}()
+
+	log.Info().Msgf("started application after %s", time.Since(start).Truncate(time.Second))
+
+	// graceful shutdown
+	<-ctx.Done()
+	shutdownManager.ShutdownOnInterrupt(20 * time.Second)
+}
+
+func loadConfig(path string) backend.Config {
+	cfg := backend.LoadConfig(path)
+	lvl, err := zerolog.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		lvl = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(lvl)
+
+	return cfg
+}
+
+// forwardHandler forwards inbound emails in-process, skipping Kafka entirely.
+func forwardHandler(
+	cfg backend.Config,
+	emailService emailsvc.EmailService,
+	m emailsvc.Mailer,
+) smtpd.InboundHandler {
+	return func(ctx context.Context, _ []byte, inbound *enmime.Envelope) error {
+		if err := emailService.ForwardInboundEmail(ctx, m, inbound); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// publishHandler publishes raw inbound emails to the inboundEmails topic
+// keyed by "In-Reply-To" so replies to the same thread share a partition.
+func publishHandler(
+	ctx context.Context,
+	cfg backend.Config,
+	shutdownManager *backend.GracefulShutdownManager,
+) smtpd.InboundHandler {
+	producer := kafka.NewProducerClient(ctx, cfg.Kafka)
+	shutdownManager.AddHandler(func() {
+		producer.Shutdown()
+	})
+	return func(ctx context.Context, raw []byte, inbound *enmime.Envelope) error {
+		rec := kafka.NewRecord(
+			cfg.Kafka.Topics.InboundEmails,
+			strings.TrimSpace(inbound.GetHeader("In-Reply-To")),
+			raw,
+		)
+		return producer.ProduceSync(ctx, rec)
+	}
+}
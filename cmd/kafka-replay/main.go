@@ -0,0 +1,193 @@
+// Command kafka-replay re-forwards inbound emails of a topic partition within an
+// offset or time range. Forwarding is idempotent by Message-Id, so emails that
+// already went out are skipped.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/benjamonnguyen/opendoorchat/backend"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc"
+	"github.com/benjamonnguyen/opendoorchat/backend/emailsvc/consumer"
+	"github.com/benjamonnguyen/opendoorchat/backend/kafka"
+	"github.com/benjamonnguyen/opendoorchat/backend/localfs"
+	"github.com/benjamonnguyen/opendoorchat/backend/mailrouter"
+	"github.com/benjamonnguyen/opendoorchat/backend/mongodb"
+	"github.com/jhillyerd/enmime"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+type filters struct {
+	from      string
+	inReplyTo string
+	threadId  string
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	// config
+	cfgFile := flag.String("cfg", "config.yml", "configuration file")
+	topic := flag.String("topic", "", "topic to replay, defaults to Kafka.Topics.InboundEmails")
+	partition := flag.Int("partition", 0, "partition to replay")
+	fromOffset := flag.Int64("from-offset", 0, "first offset to replay")
+	toOffset := flag.Int64("to-offset", 0, "offset to stop at, exclusive")
+	since := flag.String("since", "", "RFC3339 time of the first record to replay")
+	until := flag.String("until", "", "RFC3339 time to stop at, exclusive")
+	var f filters
+	flag.StringVar(&f.from, "from", "", "only replay emails from this address")
+	flag.StringVar(&f.inReplyTo, "in-reply-to", "", "only replay emails with this In-Reply-To")
+	flag.StringVar(&f.threadId, "thread", "", "only replay emails resolving to this thread id")
+	dryRun := flag.Bool("dry-run", false, "print matching emails without forwarding them")
+	flag.Parse()
+	cfg := loadConfig(*cfgFile)
+
+	q := kafka.RangeQuery{
+		Topic:      *topic,
+		Partition:  int32(*partition),
+		FromOffset: *fromOffset,
+		ToOffset:   *toOffset,
+		Since:      parseTime("since", *since),
+		Until:      parseTime("until", *until),
+	}
+	if q.Topic == "" {
+		q.Topic = cfg.Kafka.Topics.InboundEmails
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interruptSignal := make(chan os.Signal, 1)
+	signal.Notify(interruptSignal, os.Interrupt)
+	go func() {
+		<-interruptSignal
+		cancel()
+	}()
+
+	// dependencies
+	var emailService emailsvc.EmailService
+	if !*dryRun || f.threadId != "" {
+		connCtx, connCanc := context.WithTimeout(ctx, 10*time.Second)
+		defer connCanc()
+		dbClient := mongodb.ConnectMongoClient(connCtx, cfg.Mongo)
+		defer dbClient.Disconnect(context.Background())
+		// send right away rather than through the outbox to report failures
+		emailService = emailsvc.NewEmailService(
+			cfg,
+			mongodb.NewEmailRepo(cfg, dbClient),
+			nil,
+			localfs.BlobStoreFromConfig(cfg.BlobStore),
+		)
+	}
+	var handler kafka.RecordHandler
+	if !*dryRun {
+		m, closeMailer := mailrouter.FromConfig(cfg)
+		defer closeMailer()
+		handler = consumer.InboundEmailsHandler(ctx, cfg, emailService, m)
+	}
+
+	// meat and potatoes
+	var matched, replayed, failed int
+	read, err := kafka.ReadRange(ctx, cfg.Kafka, q, func(rec *kgo.Record) error {
+		inbound, err := enmime.ReadEnvelope(bytes.NewReader(rec.Value))
+		if err != nil {
+			log.Warn().Err(err).Int64("offset", rec.Offset).Msg("skipping unparsable record")
+			return nil
+		}
+		if !f.match(ctx, emailService, inbound) {
+			return nil
+		}
+		matched++
+		if *dryRun {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\n",
+				rec.Offset,
+				rec.Timestamp.UTC().Format(time.RFC3339),
+				inbound.GetHeader("Message-Id"),
+				inbound.GetHeader("From"),
+				inbound.GetHeader("Subject"),
+			)
+			return nil
+		}
+		if err := handler(rec); err != nil {
+			failed++
+			log.Error().Err(err).
+				Int64("offset", rec.Offset).
+				Str("messageId", inbound.GetHeader("Message-Id")).
+				Msg("failed replaying record")
+			return nil
+		}
+		replayed++
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Error().Err(err).Msg("failed ReadRange")
+	}
+	log.Info().
+		Int("read", read).
+		Int("matched", matched).
+		Int("replayed", replayed).
+		Int("failed", failed).
+		Bool("dryRun", *dryRun).
+		Msg("finished replay")
+	if err != nil || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func loadConfig(path string) backend.Config {
+	cfg := backend.LoadConfig(path)
+	lvl, err := zerolog.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		lvl = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(lvl)
+
+	return cfg
+}
+
+func parseTime(name, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatal().Err(err).Str("flag", name).Msg("failed parsing time")
+	}
+	return t
+}
+
+func (f filters) match(
+	ctx context.Context,
+	emailService emailsvc.EmailService,
+	inbound *enmime.Envelope,
+) bool {
+	if f.from != "" {
+		addr, err := mail.ParseAddress(inbound.GetHeader("From"))
+		if err != nil || !strings.EqualFold(addr.Address, f.from) {
+			return false
+		}
+	}
+	if f.inReplyTo != "" &&
+		strings.Trim(strings.TrimSpace(inbound.GetHeader("In-Reply-To")), "<>") != strings.Trim(f.inReplyTo, "<>") {
+		return false
+	}
+	if f.threadId != "" {
+		resolution, err := emailService.ResolveThread(ctx, emailsvc.NewThreadResolveTerms(inbound))
+		if err != nil || resolution.Thread.Id.Hex() != f.threadId {
+			return false
+		}
+	}
+	return true
+}
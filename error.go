@@ -27,6 +27,10 @@ func (e *err) Error() string {
 	return fmt.Sprintf("%s: %d %s", e.Message(), e.code, e.status)
 }
 
+func (e *err) Unwrap() error {
+	return e.Err
+}
+
 func (e *err) StatusCode() int {
 	if e.code == 0 {
 		return 500
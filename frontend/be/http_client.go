@@ -1,7 +1,10 @@
 package be
 
 import (
+	"context"
 	"net/http"
+
+	app "github.com/benjamonnguyen/opendoorchat"
 )
 
 // TODO all users and auth stuff is handled by auth client
@@ -40,6 +43,21 @@ func NewClient(cl *http.Client, baseUrl string) *Client {
 
 // }
 
+// DownloadAttachment requests a signed attachment download link of the backend, by its
+// path and query, as the user of accessToken. The caller closes the response body.
+func (cl *Client) DownloadAttachment(
+	ctx context.Context,
+	requestURI string,
+	accessToken string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cl.baseUrl+requestURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(app.AUTH_TOKEN_HEADER_KEY, accessToken)
+	return cl.cl.Do(req)
+}
+
 func addAccessTokenHeader(req *http.Request) error {
 	// token, err := req.Cookie(AccessTokenCookieKey)
 	// if err != nil {
@@ -0,0 +1,66 @@
+package html
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	app "github.com/benjamonnguyen/opendoorchat"
+	"github.com/benjamonnguyen/opendoorchat/frontend/be"
+	"github.com/benjamonnguyen/opendoorchat/keycloak"
+)
+
+type AttachmentController struct {
+	authCl *keycloak.AuthClient
+	cl     *be.Client
+}
+
+func NewAttachmentController(authCl *keycloak.AuthClient, cl *be.Client) *AttachmentController {
+	return &AttachmentController{
+		authCl: authCl,
+		cl:     cl,
+	}
+}
+
+// Download proxies an attachment download link of an email to the backend as the
+// logged in user, who the backend checks is a participant of the thread.
+func (ctrl *AttachmentController) Download(w http.ResponseWriter, r *http.Request) {
+	const op = "AttachmentController.Download"
+	// authenticate
+	token, _ := r.Cookie(app.REFRESH_TOKEN_COOKIE_KEY)
+	if token == nil {
+		http.Redirect(w, r, "/app/login", http.StatusSeeOther)
+		return
+	}
+	accessToken, _, err := ctrl.authCl.RequestAccessToken(r.Context(), token.Value, "", "")
+	if err != nil {
+		log.Println(app.FromErr(err, op))
+		http.Redirect(w, r, "/app/login", http.StatusSeeOther)
+		return
+	}
+
+	//
+	resp, e := ctrl.cl.DownloadAttachment(r.Context(), r.URL.RequestURI(), accessToken)
+	if e != nil {
+		log.Println(app.FromErr(e, op))
+		http.Error(w, "", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	//
+	for _, key := range []string{
+		"Content-Type",
+		"Content-Length",
+		"Content-Disposition",
+		"X-Content-Type-Options",
+	} {
+		if v := resp.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Println(app.FromErr(err, op))
+	}
+}
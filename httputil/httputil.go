@@ -36,7 +36,7 @@ func DoWithRetries[T any](
 		v, err = call()
 		if err != nil {
 			if retryOn(err.StatusCode()) {
-				time.Sleep(exponentialBackoff(backoffConfigs, i))
+				time.Sleep(ExponentialBackoff(backoffConfigs, i))
 			}
 			continue
 		}
@@ -50,7 +50,8 @@ type ExponentialBackoffConfigs struct {
 	Interval, Initial, Max time.Duration
 }
 
-func exponentialBackoff(
+// ExponentialBackoff returns the backoff before retry number iteration (starting at 0).
+func ExponentialBackoff(
 	cfg ExponentialBackoffConfigs,
 	iteration int,
 ) time.Duration {
@@ -3,24 +3,33 @@ const fetch = require('node-fetch');
 
 exports.register = function () {
     this.cfg = this.config.get("gatekeep.ini").main;
-    this.loginfo("cfg: " + JSON.stringify(this.cfg));
+    this.loginfo("uri: " + this.cfg.uri);
 }
 
 exports.hook_data_post = async function (next, conn) {
     // only replies to server sent emails qualify as valid inbound emails.
-    // gatekeep verifies the "In-Reply-To" header against the emailThreads collection.
-    const inReplyTo = conn?.transaction?.header?.get("In-Reply-To");
-    if (inReplyTo) {
-        const body = JSON.stringify({emailMessageId: inReplyTo.trim()});
+    // gatekeep resolves the threading headers against the emailThreads collection.
+    const header = conn?.transaction?.header;
+    const inReplyTo = header?.get("In-Reply-To")?.trim();
+    const references = (header?.get("References") || "").split(/\s+/).filter(Boolean);
+    if (header) {
+        const body = JSON.stringify({
+            recipients: (conn.transaction.rcpt_to || []).map(r => r.address()),
+            inReplyTo,
+            references,
+            subject: header.get_decoded("Subject")?.trim(),
+            from: header.get("From")?.match(/<?([^<>\s]+@[^<>\s]+)>?/)?.[1],
+        });
         // this.loginfo("body: " + body);
         const reqOpts = {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
+                'X-Admin-Token': this.cfg.admin_token,
             },
             body,
         };
-        const resp = await fetchPlus(this.cfg.uri + "/email/thread/search", reqOpts, 3);
+        const resp = await fetchPlus(this.cfg.uri + "/email/thread/resolve", reqOpts, 3);
         if (resp && resp.status == 200) {
             return next();
         }